@@ -2,17 +2,31 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"runtime/pprof"
+	"strings"
+	"syscall"
 
-	"github.com/csvquery/csvquery/pkg/csvquery/index"
 	"github.com/csvquery/csvquery/pkg/csvquery/query"
-	"github.com/csvquery/csvquery/pkg/csvquery/types"
+	"github.com/csvquery/csvquery/pkg/csvquery/server"
+	"github.com/csvquery/csvquery/pkg/csvquery/utils"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "daemon" {
+		runDaemon(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "sql" {
+		runSQL(os.Args[2:])
+		return
+	}
+
 	requestJSON := flag.String("request", "", "JSON request payload")
 	cpuProfile := flag.String("cpuprofile", "", "Write cpu profile to file")
 	flag.Parse()
@@ -48,111 +62,83 @@ func main() {
 		fatalError("Invalid JSON request: " + err.Error())
 	}
 
-	action, ok := rawRequest["action"].(string)
-	if !ok {
-		fatalError("Action required")
-	}
-
-	switch action {
-	case "index":
-		handleIndex(rawRequest)
-	case "query", "count":
-		handleQuery(rawRequest)
-	default:
-		fatalError("Unknown action: " + action)
-	}
+	handle(rawRequest)
 }
 
-func handleIndex(req map[string]interface{}) {
-	cfg := index.IndexerConfig{
-		InputFile:   getString(req, "csv"),
-		OutputDir:   getString(req, "out"),
-		Columns:     getString(req, "cols"), // JSON string
-		Separator:   getString(req, "sep"),
-		Workers:     getInt(req, "workers"),
-		MemoryMB:    getInt(req, "memory"),
-		BloomFPRate: getFloat(req, "bloom_rate"),
-		Verbose:     getBool(req, "verbose"),
-	}
-
-	if cfg.Separator == "" {
-		cfg.Separator = ","
-	}
-
-	manager := index.NewIndexManager(cfg)
-	if err := manager.Run(); err != nil {
+func handle(rawRequest map[string]interface{}) {
+	if err := server.NewHandler(nil).Handle(rawRequest, os.Stdout); err != nil {
+		var reported *query.ReportedError
+		if errors.As(err, &reported) {
+			os.Exit(1)
+		}
 		fatalError(err.Error())
 	}
-
-	response := map[string]string{"status": "ok"}
-	json.NewEncoder(os.Stdout).Encode(response)
 }
 
-func handleQuery(req map[string]interface{}) {
-	// Parse Where condition
-	var where *types.Condition
-	if whereData, ok := req["where"]; ok {
-		// whereData is map[string]interface{} or JSON raw?
-		// Types.QueryRequest defines Where as map[string]interface{}.
-		// We need to re-marshal to pass to ParseCondition which expects []byte or we can adapt ParseCondition.
-		// Adapt: Marshal back to bytes for ParseCondition
-		bytes, _ := json.Marshal(whereData)
-		var err error
-		where, err = query.ParseCondition(bytes)
-		if err != nil {
-			fatalError("Invalid where condition: " + err.Error())
+func runSQL(args []string) {
+	fs := flag.NewFlagSet("sql", flag.ExitOnError)
+	indexDir := fs.String("index-dir", "", "Directory holding the indexes (default: next to the CSV)")
+	protocol := fs.Int("protocol", 0, "Result protocol version (0 = legacy text output)")
+	explain := fs.Bool("explain", false, "Print the query plan instead of running the query")
+	analyze := fs.Bool("analyze", false, "Run the query and print the plan with execution counters")
+	columnTypes := fs.String("types", "", "Column types, e.g. price=decimal,created=date:02/01/2006")
+	onStale := fs.String("on-stale", "", "What to do with indexes that no longer match the CSV: fail, fallback or rebuild")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s sql [flags] \"SELECT ...\"\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	req := map[string]interface{}{
+		"action":   "query",
+		"sql":      fs.Arg(0),
+		"indexDir": *indexDir,
+		"protocol": *protocol,
+		"explain":  *explain,
+		"analyze":  *analyze,
+		"onStale":  *onStale,
+	}
+	if *columnTypes != "" {
+		decl := make(map[string]interface{})
+		for _, item := range strings.Split(*columnTypes, ",") {
+			col, typ, ok := strings.Cut(item, "=")
+			if !ok {
+				fatalError(fmt.Sprintf("Invalid --types entry: %q", item))
+			}
+			typ, format, _ := strings.Cut(typ, ":")
+			decl[col] = map[string]interface{}{"type": typ, "format": format}
 		}
+		req["types"] = decl
 	}
+	handle(req)
+}
 
-	cfg := types.QueryConfig{
-		CsvPath:   getString(req, "csv"),
-		IndexDir:  getString(req, "indexDir"),
-		GroupBy:   getString(req, "groupBy"),
-		AggCol:    getString(req, "aggCol"),
-		AggFunc:   getString(req, "aggFunc"),
-		CountOnly: getString(req, "action") == "count" || getBool(req, "countOnly"),
-		Limit:     getInt(req, "limit"),
-		Offset:    getInt(req, "offset"),
-		Explain:   getBool(req, "explain"),
-	}
+func runDaemon(args []string) {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	socketPath := fs.String("socket", "/tmp/csvquery.sock", "Unix domain socket to listen on")
+	verbose := fs.Bool("verbose", false, "Log connection errors")
+	fs.Parse(args)
 
-	updates, err := query.LoadUpdates(cfg.CsvPath)
-	if err != nil {
-		// log error but continue? or fail?
-		// fail for now as consistency matters
-		// fatalError("Failed to load updates: " + err.Error())
-		// Actually, if file defaults to missing it's fine.
-	}
+	srv := server.NewServer(*socketPath, utils.NewStandardLogger(*verbose))
 
-	executor := query.NewExecutor(cfg.IndexDir, updates) // Assuming updates can be nil or loaded internally
-	// Note: Executor was refactored to take updates in constructor.
-
-	// Output buffering? or Streaming?
-	// For large results, streaming to Stdout is preferred.
-	// However, json.Encoder does buffering.
-	// Manually ensure correct JSON array around results?
-	// QueryResult struct expects []RowOffset.
-	// If we follow QueryResult struct, we must buffer.
-	// If user expects stream, we stream.
-	// The PHP wrapper likely expects JSON.
-	// If it's a huge list, streaming JSON array `[{}, {}, ...]` is needed.
-	// Executor writes line-by-line CSV-like "offset,line".
-	// The PHP wrapper parses standard output.
-	// If Executor outputs "offset,line\n", PHP can parse it easily.
-	// But valid JSON {"status": "ok", "rows": [...]} is what QueryResult defines.
-	// Let's output JSON for now as per QueryResult struct, assuming fits in memory or use streaming writer later.
-	// Wait, Executor.runStandardOutput writes "offset,line\n". This is NOT JSON.
-	// This matches the original `engine.go` behavior.
-	// So `handleQuery` should just call `ExecuteWithCondition` and let it write to stdout.
-	// But main also prints status?
-	// If Executor writes raw lines, where is the JSON status?
-	// Original `engine.go` wrote ONLY results or JSON plan.
-	// Protocol seems to be: Raw lines for query results. JSON for plan/index.
-	// Let's stick to that.
-
-	if err := executor.ExecuteWithCondition(cfg, where, os.Stdout); err != nil {
-		fatalError(err.Error())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		<-sigs
+		srv.Close()
+		close(done)
+	}()
+
+	if err := srv.ListenAndServe(); err != nil {
+		log.Fatal(err)
 	}
+	<-done
 }
 
 func fatalError(msg string) {
@@ -160,37 +146,3 @@ func fatalError(msg string) {
 	json.NewEncoder(os.Stdout).Encode(resp)
 	os.Exit(1)
 }
-
-// Helpers
-func getString(m map[string]interface{}, key string) string {
-	if v, ok := m[key].(string); ok {
-		return v
-	}
-	// Debug
-	// log.Printf("Key %s not found or not string in %v", key, m)
-	return ""
-}
-
-func getInt(m map[string]interface{}, key string) int {
-	if v, ok := m[key].(float64); ok {
-		return int(v)
-	}
-	if v, ok := m[key].(int); ok {
-		return v
-	}
-	return 0
-}
-
-func getFloat(m map[string]interface{}, key string) float64 {
-	if v, ok := m[key].(float64); ok {
-		return v
-	}
-	return 0
-}
-
-func getBool(m map[string]interface{}, key string) bool {
-	if v, ok := m[key].(bool); ok {
-		return v
-	}
-	return false
-}
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"fmt"
 	"io"
+	"unicode/utf8"
 
 	"github.com/csvquery/csvquery/pkg/csvquery/storage"
 	"github.com/csvquery/csvquery/pkg/csvquery/types"
@@ -17,7 +19,10 @@ const (
 )
 
 type BlockMeta struct {
-	StartKey    string `json:"startKey"`
+	StartKey string `json:"startKey"`
+	// StartKeyRaw holds start keys that are not valid UTF-8, which JSON
+	// strings cannot carry, such as the keys of typed indexes
+	StartKeyRaw []byte `json:"startKeyRaw,omitempty"`
 	Offset      int64  `json:"offset"`
 	Length      int64  `json:"length"`
 	RecordCount int64  `json:"recordCount"`
@@ -25,7 +30,8 @@ type BlockMeta struct {
 }
 
 type SparseIndex struct {
-	Blocks []BlockMeta `json:"blocks"`
+	Blocks  []BlockMeta       `json:"blocks"`
+	KeyType *types.ColumnSpec `json:"keyType,omitempty"`
 }
 
 type BlockWriter struct {
@@ -103,6 +109,9 @@ func (bw *BlockWriter) FlushBlock() error {
 		RecordCount: int64(len(bw.buffer)),
 		IsDistinct:  isDistinct,
 	}
+	if !utf8.ValidString(keyStr) {
+		meta.StartKeyRaw = []byte(keyStr)
+	}
 	bw.sparseIndex.Blocks = append(bw.sparseIndex.Blocks, meta)
 
 	n, err := bw.w.Write(compressedBytes)
@@ -116,6 +125,13 @@ func (bw *BlockWriter) FlushBlock() error {
 	return nil
 }
 
+// SetKeyType records the key type of a typed index in the footer.
+func (bw *BlockWriter) SetKeyType(spec types.ColumnSpec) {
+	if !spec.IsString() {
+		bw.sparseIndex.KeyType = &spec
+	}
+}
+
 func (bw *BlockWriter) Close() error {
 	if err := bw.FlushBlock(); err != nil {
 		return err
@@ -138,29 +154,29 @@ func (bw *BlockWriter) Close() error {
 	return nil
 }
 
+// BlockReader reads blocks from a .cidx file. It only uses positional reads,
+// so a single reader can be shared by concurrent iterators.
 type BlockReader struct {
-	r       io.ReadSeeker
-	Footer  SparseIndex
-	compBuf []byte
-	recBuf  []types.IndexRecord
+	r      io.ReaderAt
+	Footer SparseIndex
 }
 
-func NewBlockReader(r io.ReadSeeker) (*BlockReader, error) {
-	if _, err := r.Seek(-8, io.SeekEnd); err != nil {
-		return nil, err
+func NewBlockReader(r io.ReaderAt, size int64) (*BlockReader, error) {
+	if size < 8 {
+		return nil, fmt.Errorf("index file too small")
 	}
 
-	var footerLen int64
-	if err := binary.Read(r, binary.BigEndian, &footerLen); err != nil {
+	var lenBuf [8]byte
+	if _, err := r.ReadAt(lenBuf[:], size-8); err != nil {
 		return nil, err
 	}
-
-	if _, err := r.Seek(-(8 + footerLen), io.SeekEnd); err != nil {
-		return nil, err
+	footerLen := int64(binary.BigEndian.Uint64(lenBuf[:]))
+	if footerLen < 0 || footerLen > size-8 {
+		return nil, fmt.Errorf("invalid footer length: %d", footerLen)
 	}
 
 	footerBytes := make([]byte, footerLen)
-	if _, err := io.ReadFull(r, footerBytes); err != nil {
+	if _, err := r.ReadAt(footerBytes, size-8-footerLen); err != nil {
 		return nil, err
 	}
 
@@ -168,6 +184,11 @@ func NewBlockReader(r io.ReadSeeker) (*BlockReader, error) {
 	if err := json.Unmarshal(footerBytes, &footer); err != nil {
 		return nil, err
 	}
+	for i := range footer.Blocks {
+		if footer.Blocks[i].StartKeyRaw != nil {
+			footer.Blocks[i].StartKey = string(footer.Blocks[i].StartKeyRaw)
+		}
+	}
 
 	return &BlockReader{
 		r:      r,
@@ -176,22 +197,13 @@ func NewBlockReader(r io.ReadSeeker) (*BlockReader, error) {
 }
 
 func (br *BlockReader) ReadBlock(meta BlockMeta) ([]types.IndexRecord, error) {
-	if _, err := br.r.Seek(meta.Offset, io.SeekStart); err != nil {
-		return nil, err
-	}
-
-	needed := int(meta.Length)
-	if cap(br.compBuf) < needed {
-		br.compBuf = make([]byte, needed)
-	}
-	br.compBuf = br.compBuf[:needed]
-
-	if _, err := io.ReadFull(br.r, br.compBuf); err != nil {
+	compBuf := make([]byte, meta.Length)
+	if _, err := br.r.ReadAt(compBuf, meta.Offset); err != nil {
 		return nil, err
 	}
 
-	lr := lz4.NewReader(bytes.NewReader(br.compBuf))
-	br.recBuf = br.recBuf[:0]
+	lr := lz4.NewReader(bytes.NewReader(compBuf))
+	recs := make([]types.IndexRecord, 0, meta.RecordCount)
 	for {
 		rec, err := storage.ReadRecord(lr)
 		if err == io.EOF {
@@ -200,8 +212,8 @@ func (br *BlockReader) ReadBlock(meta BlockMeta) ([]types.IndexRecord, error) {
 		if err != nil {
 			return nil, err
 		}
-		br.recBuf = append(br.recBuf, rec)
+		recs = append(recs, rec)
 	}
 
-	return br.recBuf, nil
+	return recs, nil
 }
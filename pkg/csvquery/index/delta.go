@@ -0,0 +1,302 @@
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/storage"
+	"github.com/csvquery/csvquery/pkg/csvquery/types"
+)
+
+// A delta holds the index records of rows appended to a CSV after its index
+// was built, in <index>.delta next to the index, until the index is built
+// again. It is a storage.Log with one record per insert: the offsets where
+// the inserted rows start and end and the line number of the row that would
+// follow them, as big-endian int64s, then the index records of the rows.
+const deltaHeaderSize = 24
+
+// DeltaPath returns the location of the delta of the index at indexPath.
+func DeltaPath(indexPath string) string {
+	return indexPath + ".delta"
+}
+
+// AppendDelta adds the records of rows appended to the CSV between the
+// offsets csvStart and csvEnd, after which it continues with line nextLine,
+// to the delta of the index at indexPath.
+func AppendDelta(indexPath string, csvStart, csvEnd, nextLine int64, records []types.IndexRecord) error {
+	var buf bytes.Buffer
+	var header [deltaHeaderSize]byte
+	binary.BigEndian.PutUint64(header[0:8], uint64(csvStart))
+	binary.BigEndian.PutUint64(header[8:16], uint64(csvEnd))
+	binary.BigEndian.PutUint64(header[16:24], uint64(nextLine))
+	buf.Write(header[:])
+	if err := storage.WriteBatchRecords(&buf, records); err != nil {
+		return err
+	}
+	_, err := storage.NewLog(DeltaPath(indexPath)).Append(buf.Bytes())
+	return err
+}
+
+// LoadDelta reads the delta of the index at indexPath, whose keys are of
+// type spec. It returns nil if the index has none.
+func LoadDelta(indexPath string, spec types.ColumnSpec) (*MemIndex, error) {
+	var delta *MemIndex
+	err := storage.NewLog(DeltaPath(indexPath)).Read(func(records [][]byte) error {
+		if len(records) == 0 {
+			return nil
+		}
+		delta = &MemIndex{keyType: spec}
+		for _, rec := range records {
+			n := (len(rec) - deltaHeaderSize) / types.RecordSize
+			if len(rec) < deltaHeaderSize || deltaHeaderSize+n*types.RecordSize != len(rec) {
+				return fmt.Errorf("invalid delta record in %s", DeltaPath(indexPath))
+			}
+			start := int64(binary.BigEndian.Uint64(rec[0:8]))
+			if start != delta.CsvEnd {
+				// Rows were appended between the inserts without a delta
+				delta.CsvStart = start
+			}
+			delta.CsvEnd = int64(binary.BigEndian.Uint64(rec[8:16]))
+			delta.NextLine = int64(binary.BigEndian.Uint64(rec[16:24]))
+			recs, err := storage.ReadBatchRecords(bytes.NewReader(rec[deltaHeaderSize:]), n)
+			if err != nil {
+				return err
+			}
+			delta.records = append(delta.records, recs...)
+		}
+		sort.Slice(delta.records, func(i, j int) bool {
+			return lessRecord(&delta.records[i], &delta.records[j])
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return delta, nil
+}
+
+// RemoveDelta deletes the delta of the index at indexPath, once the index
+// has been built again with the rows it held.
+func RemoveDelta(indexPath string) error {
+	if err := os.Remove(DeltaPath(indexPath)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// lessRecord orders records like the sorter writes them: by key, then by
+// offset.
+func lessRecord(a, b *types.IndexRecord) bool {
+	if cmp := bytes.Compare(a.Key[:], b.Key[:]); cmp != 0 {
+		return cmp < 0
+	}
+	return a.Offset < b.Offset
+}
+
+// MemIndex is an Index over records held in memory, such as a delta.
+type MemIndex struct {
+	CsvStart int64 // start of the CSV rows the records cover without gaps
+	CsvEnd   int64 // end of the CSV rows the records cover
+	NextLine int64 // line number of the row after them
+
+	records []types.IndexRecord // sorted by lessRecord
+	keyType types.ColumnSpec
+}
+
+// Len returns the number of records.
+func (m *MemIndex) Len() int {
+	return len(m.records)
+}
+
+func (m *MemIndex) Search(key string) (Iterator, error) {
+	bound := &keyBound{key: []byte(keyString(m.keyType, key)), inclusive: true}
+	return m.between(bound, bound, false), nil
+}
+
+func (m *MemIndex) SearchRange(lower, upper *Bound) (Iterator, error) {
+	lower, upper = encodeRange(m.keyType, lower, upper)
+	var lo, hi *keyBound
+	if lower != nil {
+		lo = &keyBound{key: []byte(lower.Key), inclusive: lower.Inclusive}
+	}
+	if upper != nil {
+		hi = &keyBound{key: []byte(upper.Key), inclusive: upper.Inclusive}
+	}
+	return m.between(lo, hi, false), nil
+}
+
+func (m *MemIndex) Scan() (Iterator, error) {
+	return m.between(nil, nil, false), nil
+}
+
+func (m *MemIndex) ScanReverse() (Iterator, error) {
+	return m.between(nil, nil, true), nil
+}
+
+func (m *MemIndex) Close() error {
+	return nil
+}
+
+func (m *MemIndex) ApproximateCount() int64 {
+	return int64(len(m.records))
+}
+
+func (m *MemIndex) between(lower, upper *keyBound, reverse bool) Iterator {
+	start := 0
+	if lower != nil {
+		start = sort.Search(len(m.records), func(i int) bool {
+			cmp := compareRecordKey(&m.records[i].Key, lower.key)
+			return cmp > 0 || cmp == 0 && lower.inclusive
+		})
+	}
+	end := len(m.records)
+	if upper != nil {
+		end = sort.Search(len(m.records), func(i int) bool {
+			cmp := compareRecordKey(&m.records[i].Key, upper.key)
+			return cmp > 0 || cmp == 0 && !upper.inclusive
+		})
+	}
+	if end < start {
+		end = start
+	}
+	return &sliceIterator{records: m.records[start:end], reverse: reverse}
+}
+
+type sliceIterator struct {
+	records []types.IndexRecord
+	reverse bool
+	current types.IndexRecord
+}
+
+func (it *sliceIterator) Next() bool {
+	n := len(it.records)
+	if n == 0 {
+		return false
+	}
+	if it.reverse {
+		it.current, it.records = it.records[n-1], it.records[:n-1]
+	} else {
+		it.current, it.records = it.records[0], it.records[1:]
+	}
+	return true
+}
+
+func (it *sliceIterator) Record() types.IndexRecord { return it.current }
+func (it *sliceIterator) Close()                    {}
+func (it *sliceIterator) Error() error              { return nil }
+
+// WithDelta returns an Index over the records of base and delta together,
+// returned in the order base would return them had the delta been merged
+// into it. A nil or empty delta returns base.
+func WithDelta(base Index, delta *MemIndex) Index {
+	if delta == nil || len(delta.records) == 0 {
+		return base
+	}
+	return &deltaIndex{base: base, delta: delta}
+}
+
+type deltaIndex struct {
+	base  Index
+	delta *MemIndex
+}
+
+func (d *deltaIndex) Search(key string) (Iterator, error) {
+	it, err := d.base.Search(key)
+	if err != nil {
+		return nil, err
+	}
+	extra, _ := d.delta.Search(key)
+	return mergeSorted(it, extra, false), nil
+}
+
+func (d *deltaIndex) SearchRange(lower, upper *Bound) (Iterator, error) {
+	it, err := d.base.SearchRange(lower, upper)
+	if err != nil {
+		return nil, err
+	}
+	extra, _ := d.delta.SearchRange(lower, upper)
+	return mergeSorted(it, extra, false), nil
+}
+
+func (d *deltaIndex) Scan() (Iterator, error) {
+	it, err := d.base.Scan()
+	if err != nil {
+		return nil, err
+	}
+	extra, _ := d.delta.Scan()
+	return mergeSorted(it, extra, false), nil
+}
+
+func (d *deltaIndex) ScanReverse() (Iterator, error) {
+	it, err := d.base.ScanReverse()
+	if err != nil {
+		return nil, err
+	}
+	extra, _ := d.delta.ScanReverse()
+	return mergeSorted(it, extra, true), nil
+}
+
+func (d *deltaIndex) Close() error {
+	return d.base.Close()
+}
+
+func (d *deltaIndex) ApproximateCount() int64 {
+	return d.base.ApproximateCount() + d.delta.ApproximateCount()
+}
+
+// mergeSorted merges two iterators whose records are in lessRecord order,
+// or in reverse order.
+func mergeSorted(a, b Iterator, reverse bool) Iterator {
+	return &sortedMergeIterator{a: a, b: b, reverse: reverse}
+}
+
+type sortedMergeIterator struct {
+	a, b     Iterator
+	aOK, bOK bool
+	started  bool
+	reverse  bool
+	current  types.IndexRecord
+}
+
+func (m *sortedMergeIterator) Next() bool {
+	if !m.started {
+		m.aOK, m.bOK, m.started = m.a.Next(), m.b.Next(), true
+	}
+	switch {
+	case m.aOK && (!m.bOK || !m.less(m.b.Record(), m.a.Record())):
+		m.current = m.a.Record()
+		m.aOK = m.a.Next()
+	case m.bOK && m.a.Error() == nil:
+		m.current = m.b.Record()
+		m.bOK = m.b.Next()
+	default:
+		return false
+	}
+	return true
+}
+
+func (m *sortedMergeIterator) less(x, y types.IndexRecord) bool {
+	if m.reverse {
+		return lessRecord(&y, &x)
+	}
+	return lessRecord(&x, &y)
+}
+
+func (m *sortedMergeIterator) Record() types.IndexRecord {
+	return m.current
+}
+
+func (m *sortedMergeIterator) Close() {
+	m.a.Close()
+	m.b.Close()
+}
+
+func (m *sortedMergeIterator) Error() error {
+	if err := m.a.Error(); err != nil {
+		return err
+	}
+	return m.b.Error()
+}
@@ -15,6 +15,7 @@ type DiskIndex struct {
 	reader       *BlockReader
 	bloom        *BloomFilter
 	bloomCleanup func()
+	keyType      types.ColumnSpec
 }
 
 // OpenDiskIndex opens an existing index file
@@ -24,7 +25,13 @@ func OpenDiskIndex(path string) (*DiskIndex, error) {
 		return nil, fmt.Errorf("failed to open index file: %w", err)
 	}
 
-	br, err := NewBlockReader(file)
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to stat index file: %w", err)
+	}
+
+	br, err := NewBlockReader(file, stat.Size())
 	if err != nil {
 		file.Close()
 		return nil, fmt.Errorf("failed to init block reader: %w", err)
@@ -35,6 +42,9 @@ func OpenDiskIndex(path string) (*DiskIndex, error) {
 		file:   file,
 		reader: br,
 	}
+	if br.Footer.KeyType != nil {
+		idx.keyType = *br.Footer.KeyType
+	}
 
 	// Try loading bloom filter
 	bloomPath := path + ".bloom"
@@ -49,11 +59,28 @@ func OpenDiskIndex(path string) (*DiskIndex, error) {
 	return idx, nil
 }
 
+// KeyType returns the key type of a typed index. Keys passed to a typed
+// index are values as they appear in the CSV; the index encodes them.
+func (idx *DiskIndex) KeyType() types.ColumnSpec {
+	return idx.keyType
+}
+
 func (idx *DiskIndex) Search(key string) (Iterator, error) {
+	return idx.search(key, nil)
+}
+
+func (idx *DiskIndex) search(key string, stats *Stats) (Iterator, error) {
+	key = keyString(idx.keyType, key)
 	if idx.bloom != nil {
 		if !idx.bloom.MightContain(key) {
+			if stats != nil {
+				stats.BloomMisses++
+			}
 			return &emptyIterator{}, nil
 		}
+		if stats != nil {
+			stats.BloomHits++
+		}
 	}
 
 	startBlockIdx := idx.findStartBlock(key)
@@ -61,27 +88,70 @@ func (idx *DiskIndex) Search(key string) (Iterator, error) {
 		return &emptyIterator{}, nil
 	}
 
+	bound := &keyBound{key: []byte(key), inclusive: true}
 	return &diskIterator{
 		idx:          idx,
-		searchKey:    []byte(key),
+		lower:        bound,
+		upper:        bound,
 		currentBlock: startBlockIdx,
-		records:      nil,
-		recordIndex:  0,
 		totalBlocks:  len(idx.reader.Footer.Blocks),
+		stats:        stats,
 	}, nil
 }
 
+func (idx *DiskIndex) SearchRange(lower, upper *Bound) (Iterator, error) {
+	return idx.searchRange(lower, upper, nil)
+}
+
+func (idx *DiskIndex) searchRange(lower, upper *Bound, stats *Stats) (Iterator, error) {
+	it := &diskIterator{
+		idx:         idx,
+		totalBlocks: len(idx.reader.Footer.Blocks),
+		stats:       stats,
+	}
+	lower, upper = idx.keyRange(lower, upper)
+	if lower != nil {
+		it.lower = &keyBound{key: []byte(lower.Key), inclusive: lower.Inclusive}
+		if start := idx.findStartBlock(lower.Key); start > 0 {
+			it.currentBlock = start
+		}
+	}
+	if upper != nil {
+		it.upper = &keyBound{key: []byte(upper.Key), inclusive: upper.Inclusive}
+	}
+	return it, nil
+}
+
 func (idx *DiskIndex) Scan() (Iterator, error) {
+	return idx.scan(nil)
+}
+
+func (idx *DiskIndex) scan(stats *Stats) (Iterator, error) {
 	return &diskIterator{
-		idx:          idx,
-		scanMode:     true,
-		currentBlock: 0,
-		records:      nil,
-		recordIndex:  0,
-		totalBlocks:  len(idx.reader.Footer.Blocks),
+		idx:         idx,
+		totalBlocks: len(idx.reader.Footer.Blocks),
+		stats:       stats,
+	}, nil
+}
+
+func (idx *DiskIndex) ScanReverse() (Iterator, error) {
+	return idx.scanReverse(nil)
+}
+
+func (idx *DiskIndex) scanReverse(stats *Stats) (Iterator, error) {
+	return &reverseIterator{
+		idx:       idx,
+		nextBlock: len(idx.reader.Footer.Blocks) - 1,
+		stats:     stats,
 	}, nil
 }
 
+// Observe returns a view of idx whose iterators record the work they do in
+// stats. The view shares idx's file; closing it does not close idx.
+func (idx *DiskIndex) Observe(stats *Stats) Index {
+	return &observedIndex{idx: idx, stats: stats}
+}
+
 func (idx *DiskIndex) Close() error {
 	if idx.bloomCleanup != nil {
 		idx.bloomCleanup()
@@ -97,6 +167,81 @@ func (idx *DiskIndex) ApproximateCount() int64 {
 	return total
 }
 
+// EstimateCount returns an upper bound for the number of records with the
+// given key, from the record counts of the blocks that may contain it.
+func (idx *DiskIndex) EstimateCount(key string) int64 {
+	_, upper := idx.CountBounds(key)
+	return upper
+}
+
+// CountBounds bounds the number of records with the given key by the record
+// counts of the blocks that hold nothing else, from below, and of the blocks
+// that may contain it, from above.
+func (idx *DiskIndex) CountBounds(key string) (lower, upper int64) {
+	key = keyString(idx.keyType, key)
+	if idx.bloom != nil && !idx.bloom.MightContain(key) {
+		return 0, 0
+	}
+	start := idx.findStartBlock(key)
+	if start == -1 {
+		return 0, 0
+	}
+	blocks := idx.reader.Footer.Blocks
+	for i := start; i < len(blocks) && blocks[i].StartKey <= key; i++ {
+		upper += blocks[i].RecordCount
+		// Keys are sorted, so a block between two starting with key holds
+		// only key
+		if blocks[i].StartKey == key && i+1 < len(blocks) && blocks[i+1].StartKey == key {
+			lower += blocks[i].RecordCount
+		}
+	}
+	return lower, upper
+}
+
+// EstimateRange returns an upper bound for the number of records in a key
+// range, from the record counts of the blocks that may hold them.
+func (idx *DiskIndex) EstimateRange(lower, upper *Bound) int64 {
+	lower, upper = idx.keyRange(lower, upper)
+	blocks := idx.reader.Footer.Blocks
+	start := 0
+	if lower != nil {
+		if start = idx.findStartBlock(lower.Key); start < 0 {
+			start = 0
+		}
+	}
+	var total int64
+	for i := start; i < len(blocks); i++ {
+		if upper != nil && (blocks[i].StartKey > upper.Key || blocks[i].StartKey == upper.Key && !upper.Inclusive) {
+			break
+		}
+		total += blocks[i].RecordCount
+	}
+	return total
+}
+
+// keyRange encodes the bounds of a range.
+func (idx *DiskIndex) keyRange(lower, upper *Bound) (*Bound, *Bound) {
+	return encodeRange(idx.keyType, lower, upper)
+}
+
+// encodeRange encodes the bounds of a range over keys of type spec. A typed
+// index ranges over values of its type only, so an open lower bound still
+// skips the keys of other values.
+func encodeRange(spec types.ColumnSpec, lower, upper *Bound) (*Bound, *Bound) {
+	if spec.IsString() {
+		return lower, upper
+	}
+	if lower != nil {
+		lower = &Bound{Key: keyString(spec, lower.Key), Inclusive: lower.Inclusive}
+	} else {
+		lower = &Bound{Key: string([]byte{keyTyped}), Inclusive: true}
+	}
+	if upper != nil {
+		upper = &Bound{Key: keyString(spec, upper.Key), Inclusive: upper.Inclusive}
+	}
+	return lower, upper
+}
+
 func (idx *DiskIndex) findStartBlock(key string) int {
 	blocks := idx.reader.Footer.Blocks
 	left, right := 0, len(blocks)-1
@@ -119,15 +264,20 @@ func (idx *DiskIndex) findStartBlock(key string) int {
 		for result > 0 && blocks[result-1].StartKey == key {
 			result--
 		}
+		// The block before the first one starting with key may end with it
+		if result > 0 {
+			result--
+		}
 	}
 	return result
 }
 
-// diskIterator iterates over results matching a key
+// diskIterator iterates over the records between two optional bounds in
+// key order. Search uses the same key as both bounds and Scan uses none.
 type diskIterator struct {
 	idx           *DiskIndex
-	searchKey     []byte
-	scanMode      bool
+	lower         *keyBound
+	upper         *keyBound
 	currentBlock  int
 	records       []types.IndexRecord
 	recordIndex   int
@@ -135,6 +285,12 @@ type diskIterator struct {
 	currentRecord types.IndexRecord
 	err           error
 	done          bool
+	stats         *Stats
+}
+
+type keyBound struct {
+	key       []byte
+	inclusive bool
 }
 
 func (it *diskIterator) Next() bool {
@@ -143,7 +299,7 @@ func (it *diskIterator) Next() bool {
 	}
 
 	for {
-		if it.recordIndex >= len(it.records) {
+		for it.recordIndex >= len(it.records) {
 			if it.currentBlock >= it.totalBlocks {
 				it.done = true
 				return false
@@ -151,9 +307,11 @@ func (it *diskIterator) Next() bool {
 
 			// Check if we should even read the next block
 			blockMeta := it.idx.reader.Footer.Blocks[it.currentBlock]
-			if !it.scanMode && blockMeta.StartKey > string(it.searchKey) {
-				it.done = true
-				return false
+			if it.upper != nil {
+				if blockMeta.StartKey > string(it.upper.key) || blockMeta.StartKey == string(it.upper.key) && !it.upper.inclusive {
+					it.done = true
+					return false
+				}
 			}
 
 			recs, err := it.idx.reader.ReadBlock(blockMeta)
@@ -161,34 +319,33 @@ func (it *diskIterator) Next() bool {
 				it.err = err
 				return false
 			}
+			if it.stats != nil {
+				it.stats.BlocksRead++
+				it.stats.BytesRead += blockMeta.Length
+				it.stats.RecordsDecoded += int64(len(recs))
+			}
 			it.records = recs
 			it.recordIndex = 0
 			it.currentBlock++
 		}
 
-		if it.recordIndex < len(it.records) {
-			rec := it.records[it.recordIndex]
-			it.recordIndex++
-
-			if it.scanMode {
-				it.currentRecord = rec
-				return true
-			}
-
-			cmp := compareRecordKey(&rec.Key, it.searchKey)
+		rec := it.records[it.recordIndex]
+		it.recordIndex++
 
-			if cmp < 0 {
-				continue // Should not happen often given binary search, but safety
-			}
-			if cmp == 0 {
-				it.currentRecord = rec
-				return true
+		if it.lower != nil {
+			// The start block may begin below the lower bound
+			if cmp := compareRecordKey(&rec.Key, it.lower.key); cmp < 0 || cmp == 0 && !it.lower.inclusive {
+				continue
 			}
-			if cmp > 0 {
+		}
+		if it.upper != nil {
+			if cmp := compareRecordKey(&rec.Key, it.upper.key); cmp > 0 || cmp == 0 && !it.upper.inclusive {
 				it.done = true
 				return false
 			}
 		}
+		it.currentRecord = rec
+		return true
 	}
 }
 
@@ -204,6 +361,72 @@ func (it *diskIterator) Error() error {
 	return it.err
 }
 
+// reverseIterator walks the blocks from last to first and each block's
+// records backwards, so keys come out in descending order.
+type reverseIterator struct {
+	idx           *DiskIndex
+	nextBlock     int
+	records       []types.IndexRecord
+	recordIndex   int
+	currentRecord types.IndexRecord
+	err           error
+	stats         *Stats
+}
+
+func (it *reverseIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	for it.recordIndex <= 0 {
+		if it.nextBlock < 0 {
+			return false
+		}
+		blockMeta := it.idx.reader.Footer.Blocks[it.nextBlock]
+		recs, err := it.idx.reader.ReadBlock(blockMeta)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if it.stats != nil {
+			it.stats.BlocksRead++
+			it.stats.BytesRead += blockMeta.Length
+			it.stats.RecordsDecoded += int64(len(recs))
+		}
+		it.records = recs
+		it.recordIndex = len(recs)
+		it.nextBlock--
+	}
+	it.recordIndex--
+	it.currentRecord = it.records[it.recordIndex]
+	return true
+}
+
+func (it *reverseIterator) Record() types.IndexRecord {
+	return it.currentRecord
+}
+
+func (it *reverseIterator) Close() {
+	it.records = nil
+}
+
+func (it *reverseIterator) Error() error {
+	return it.err
+}
+
+type observedIndex struct {
+	idx   *DiskIndex
+	stats *Stats
+}
+
+func (o *observedIndex) Search(key string) (Iterator, error) { return o.idx.search(key, o.stats) }
+func (o *observedIndex) SearchRange(lower, upper *Bound) (Iterator, error) {
+	return o.idx.searchRange(lower, upper, o.stats)
+}
+func (o *observedIndex) Scan() (Iterator, error)        { return o.idx.scan(o.stats) }
+func (o *observedIndex) ScanReverse() (Iterator, error) { return o.idx.scanReverse(o.stats) }
+func (o *observedIndex) Close() error                   { return nil }
+func (o *observedIndex) ApproximateCount() int64        { return o.idx.ApproximateCount() }
+
 type emptyIterator struct{}
 
 func (e *emptyIterator) Next() bool                { return false }
@@ -7,9 +7,17 @@ type Index interface {
 	// Search returns an iterator over records matching the key
 	Search(key string) (Iterator, error)
 
+	// SearchRange returns an iterator over the records whose keys lie
+	// between lower and upper, in key order. A nil bound leaves that end of
+	// the range open.
+	SearchRange(lower, upper *Bound) (Iterator, error)
+
 	// Scan returns an iterator over all records in the index
 	Scan() (Iterator, error)
 
+	// ScanReverse returns an iterator over all records in descending key order
+	ScanReverse() (Iterator, error)
+
 	// Close releases resources
 	Close() error
 
@@ -17,6 +25,12 @@ type Index interface {
 	ApproximateCount() int64
 }
 
+// Bound is one end of a key range
+type Bound struct {
+	Key       string
+	Inclusive bool
+}
+
 // Iterator allows iterating over index results
 type Iterator interface {
 	Next() bool
@@ -24,3 +38,13 @@ type Iterator interface {
 	Close()
 	Error() error
 }
+
+// Stats counts the work done by the iterators of one query.
+// It is not safe for concurrent use.
+type Stats struct {
+	BloomHits      int64 `json:"bloomHits"`   // key might be present, blocks were read
+	BloomMisses    int64 `json:"bloomMisses"` // key absent, lookup skipped
+	BlocksRead     int64 `json:"blocksRead"`
+	BytesRead      int64 `json:"bytesRead"`
+	RecordsDecoded int64 `json:"recordsDecoded"`
+}
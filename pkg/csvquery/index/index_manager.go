@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"github.com/csvquery/csvquery/pkg/csvquery/parser"
+	"github.com/csvquery/csvquery/pkg/csvquery/storage"
 	"github.com/csvquery/csvquery/pkg/csvquery/types"
 )
 
@@ -25,11 +26,22 @@ type IndexerConfig struct {
 	MemoryMB    int
 	BloomFPRate float64
 	Verbose     bool
+	Types       map[string]types.ColumnSpec // key types of single-column indexes
+	Full        bool                        // rebuild even if the CSV only grew
+	StalePolicy string                      // types.StalePolicy recorded for the dataset, if set
 }
 
+// Build modes reported by IndexManager.Mode.
+const (
+	ModeFull        = "full"        // indexes built from the whole CSV
+	ModeIncremental = "incremental" // rows appended since the last build merged in
+	ModeUnchanged   = "unchanged"   // the CSV has not changed since the last build
+)
+
 type IndexManager struct {
 	config      IndexerConfig
 	colDefs     [][]string
+	keyTypes    []types.ColumnSpec // per column definition
 	scanner     parser.Parser
 	tempDir     string
 	meta        types.IndexMeta
@@ -37,6 +49,10 @@ type IndexManager struct {
 	sorters     []*Sorter
 	sorterMutex sync.RWMutex
 	stopReport  chan struct{}
+	// refresh is the metadata of the build the indexes are refreshed from,
+	// or nil for a full build
+	refresh *types.IndexMeta
+	mode    string
 }
 
 func NewIndexManager(config IndexerConfig) *IndexManager {
@@ -58,16 +74,23 @@ func (idx *IndexManager) Run() error {
 		return fmt.Errorf("failed to create output directory: %w", err)
 	}
 
+	// Builds into the same directory share its temp directory and metadata
+	lock, err := storage.LockExclusive(MetaPath(idx.config.OutputDir, idx.config.InputFile))
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
 	idx.tempDir = filepath.Join(idx.config.OutputDir, ".csvquery_temp")
 	if err := os.MkdirAll(idx.tempDir, 0755); err != nil {
 		return fmt.Errorf("failed to create temp directory: %w", err)
 	}
 
-	var err error
-	idx.scanner, err = parser.NewSIMDParser(idx.config.InputFile, idx.config.Separator)
+	scanner, err := parser.NewSIMDParser(idx.config.InputFile, idx.separator())
 	if err != nil {
 		return err
 	}
+	idx.scanner = scanner
 	if idx.config.Workers > 0 {
 		idx.scanner.SetWorkers(idx.config.Workers)
 	}
@@ -79,6 +102,24 @@ func (idx *IndexManager) Run() error {
 		}
 	}
 
+	idx.mode = ModeFull
+	if !idx.config.Full {
+		idx.refresh = idx.refreshable(scanner.Size())
+	}
+	if idx.refresh != nil {
+		if idx.refresh.CsvSize == scanner.Size() {
+			idx.mode = ModeUnchanged
+			idx.Cleanup()
+			if policy := idx.config.StalePolicy; policy != "" && policy != idx.refresh.StalePolicy {
+				idx.meta = *idx.refresh
+				return idx.saveMeta()
+			}
+			return nil
+		}
+		idx.mode = ModeIncremental
+		scanner.SetStart(idx.refresh.CsvSize, idx.refresh.TotalRows+2)
+	}
+
 	numIndexes := len(idx.colDefs)
 	channels := make([]chan []types.IndexRecord, numIndexes)
 	errors := make(chan error, numIndexes)
@@ -95,7 +136,7 @@ func (idx *IndexManager) Run() error {
 		go func(indexIdx int, columns []string, ch <-chan []types.IndexRecord) {
 			defer wg.Done()
 			colName := strings.ToLower(strings.Join(columns, "_"))
-			err := idx.runSorterNode(colName, ch)
+			err := idx.runSorterNode(colName, columns, idx.keyTypes[indexIdx], ch)
 			if err != nil {
 				errors <- fmt.Errorf("%s: %v", colName, err)
 			} else {
@@ -132,13 +173,11 @@ func (idx *IndexManager) Run() error {
 		}
 		buffers := workerBuffers[workerID]
 		for i, key := range keys {
-			var keyBytes [64]byte
-			copy(keyBytes[:], key)
 			rec := types.IndexRecord{
-				Key:    keyBytes,
 				Offset: offset,
 				Line:   line,
 			}
+			EncodeKey(&rec.Key, idx.keyTypes[i], key)
 			buffers[i] = append(buffers[i], rec)
 			if len(buffers[i]) >= batchSize {
 				batchToSend := buffers[i]
@@ -189,8 +228,12 @@ func (idx *IndexManager) Run() error {
 
 	rows, _ := idx.scanner.GetStats()
 	idx.meta.TotalRows = rows
+	if idx.refresh != nil {
+		idx.meta.TotalRows += idx.refresh.TotalRows
+	}
 
-	if csvMeta, err := idx.calculateFingerprint(); err == nil {
+	// Rows appended during the scan are left for the next refresh
+	if csvMeta, err := idx.calculateFingerprint(scanner.Size()); err == nil {
 		idx.meta.CsvSize = csvMeta.size
 		idx.meta.CsvMtime = csvMeta.mtime
 		idx.meta.CsvHash = csvMeta.hash
@@ -207,7 +250,7 @@ func (idx *IndexManager) Run() error {
 	return nil
 }
 
-func (idx *IndexManager) runSorterNode(name string, ch <-chan []types.IndexRecord) error {
+func (idx *IndexManager) runSorterNode(name string, columns []string, keyType types.ColumnSpec, ch <-chan []types.IndexRecord) error {
 	csvName := strings.TrimSuffix(filepath.Base(idx.config.InputFile), filepath.Ext(idx.config.InputFile))
 	indexPath := filepath.Join(idx.config.OutputDir, csvName+"_"+name+".cidx")
 	bloomPath := indexPath + ".bloom"
@@ -224,12 +267,32 @@ func (idx *IndexManager) runSorterNode(name string, ch <-chan []types.IndexRecor
 		memoryPerIndex = 10 * 1024 * 1024
 	}
 
+	bloomRate := idx.config.BloomFPRate
+	if _, err := os.Stat(bloomPath); err == nil && bloomRate == 0 {
+		// A filter left from the last build would lack new keys, so an index
+		// that has one keeps one
+		bloomRate = 0.01
+	}
 	var bloom *BloomFilter
-	if idx.config.BloomFPRate > 0 {
-		bloom = NewBloomFilter(10_000_000, idx.config.BloomFPRate)
+	if bloomRate > 0 {
+		bloom = NewBloomFilter(10_000_000, bloomRate)
 	}
 
 	sorter := NewSorter(name, indexPath, tempSortDir, memoryPerIndex, bloom)
+	sorter.SetKeyType(keyType)
+	if idx.refresh != nil {
+		base, err := OpenDiskIndex(indexPath)
+		if err != nil {
+			return err
+		}
+		defer base.Close()
+		it, err := base.Scan()
+		if err != nil {
+			return err
+		}
+		defer it.Close()
+		sorter.SetBase(it)
+	}
 	idx.sorterMutex.Lock()
 	idx.sorters = append(idx.sorters, sorter)
 	idx.sorterMutex.Unlock()
@@ -247,18 +310,32 @@ func (idx *IndexManager) runSorterNode(name string, ch <-chan []types.IndexRecor
 	if err != nil {
 		return err
 	}
+	// The rebuilt index holds the rows inserted since the last build
+	if err := RemoveDelta(indexPath); err != nil {
+		return err
+	}
 
 	stat, _ := os.Stat(indexPath)
 	fileSize := stat.Size()
 	idx.metaMutex.Lock()
-	idx.meta.Indexes[name] = types.IndexStats{
+	stats := types.IndexStats{
 		DistinctCount: distinctCount,
 		FileSize:      fileSize,
+		BloomRate:     bloomRate,
 	}
+	if !keyType.IsString() {
+		stats.Type = &keyType
+	}
+	if len(columns) > 1 {
+		for _, col := range columns {
+			stats.Columns = append(stats.Columns, strings.ToLower(strings.TrimSpace(col)))
+		}
+	}
+	idx.meta.Indexes[name] = stats
 	idx.metaMutex.Unlock()
 
 	if bloom != nil {
-		if err := os.WriteFile(bloomPath, bloom.Serialize(), 0644); err != nil {
+		if err := storage.WriteFileAtomic(bloomPath, bloom.Serialize()); err != nil {
 			return fmt.Errorf("bloom filter failed for %s: %w", name, err)
 		}
 	}
@@ -294,18 +371,131 @@ func (idx *IndexManager) parseColumns() error {
 	if len(idx.colDefs) == 0 {
 		return fmt.Errorf("no valid column definitions found")
 	}
+	return idx.resolveKeyTypes()
+}
+
+// resolveKeyTypes assigns the configured types to the single-column indexes.
+// Composite indexes always have text keys.
+func (idx *IndexManager) resolveKeyTypes() error {
+	idx.keyTypes = make([]types.ColumnSpec, len(idx.colDefs))
+	typed := make(map[string]bool)
+	for i, cols := range idx.colDefs {
+		if len(cols) != 1 {
+			continue
+		}
+		col := strings.ToLower(cols[0])
+		spec, ok := idx.config.Types[col]
+		if !ok || spec.IsString() {
+			continue
+		}
+		if err := IndexableType(spec); err != nil {
+			return fmt.Errorf("%s: %w", col, err)
+		}
+		idx.keyTypes[i] = spec
+		typed[col] = true
+	}
+	for col, spec := range idx.config.Types {
+		if !spec.IsString() && !typed[col] {
+			return fmt.Errorf("no single-column index for typed column %s", col)
+		}
+	}
 	return nil
 }
 
 func (idx *IndexManager) saveMeta() error {
 	idx.meta.CapturedAt = time.Now()
+	idx.meta.Separator = idx.separator()
+	if idx.config.StalePolicy != "" {
+		idx.meta.StalePolicy = idx.config.StalePolicy
+	}
+	if old, err := LoadMeta(idx.config.OutputDir, idx.config.InputFile); err == nil {
+		if old.CsvSize == idx.meta.CsvSize && old.CsvHash == idx.meta.CsvHash && old.CsvSeparator() == idx.meta.Separator {
+			// Indexes built from the same CSV by earlier runs stay valid
+			for name, stats := range old.Indexes {
+				if _, ok := idx.meta.Indexes[name]; !ok {
+					idx.meta.Indexes[name] = stats
+				}
+			}
+		}
+		if idx.meta.StalePolicy == "" {
+			idx.meta.StalePolicy = old.StalePolicy
+		}
+	}
 	data, err := json.MarshalIndent(idx.meta, "", "  ")
 	if err != nil {
 		return err
 	}
+	return storage.WriteFileAtomic(MetaPath(idx.config.OutputDir, idx.config.InputFile), data)
+}
+
+// separator returns the field separator of the build, a comma by default.
+func (idx *IndexManager) separator() string {
+	if idx.config.Separator == "" {
+		return ","
+	}
+	return idx.config.Separator
+}
+
+// Mode returns how Run built the indexes: ModeFull, ModeIncremental or
+// ModeUnchanged.
+func (idx *IndexManager) Mode() string {
+	return idx.mode
+}
+
+// refreshable returns the metadata of the last build if the indexes can be
+// refreshed from it instead of being built again: the CSV, now size bytes,
+// only grew since, by whole lines, the build used the same separator and
+// made every index asked for with the same key type, and those that need a
+// bloom filter have one.
+func (idx *IndexManager) refreshable(size int64) *types.IndexMeta {
+	meta, err := LoadMeta(idx.config.OutputDir, idx.config.InputFile)
+	if err != nil || meta.CsvSize <= 0 || meta.CsvSize > size || meta.CsvSeparator() != idx.separator() {
+		return nil
+	}
+	if _, reason := CheckCsv(idx.config.InputFile, meta); reason != "" {
+		return nil
+	}
+	if !endsWithLineBreak(idx.config.InputFile, meta.CsvSize) {
+		// Its last row would be scanned again with the new ones
+		return nil
+	}
+
 	csvName := strings.TrimSuffix(filepath.Base(idx.config.InputFile), filepath.Ext(idx.config.InputFile))
-	metaPath := filepath.Join(idx.config.OutputDir, csvName+"_meta.json")
-	return os.WriteFile(metaPath, data, 0644)
+	for i, cols := range idx.colDefs {
+		name := strings.ToLower(strings.Join(cols, "_"))
+		stats, ok := meta.Indexes[name]
+		if !ok {
+			return nil
+		}
+		var built types.ColumnSpec
+		if stats.Type != nil {
+			built = *stats.Type
+		}
+		if !built.SameAs(idx.keyTypes[i]) {
+			return nil
+		}
+		indexPath := filepath.Join(idx.config.OutputDir, csvName+"_"+name+".cidx")
+		if _, err := os.Stat(indexPath); err != nil {
+			return nil
+		}
+		if _, err := os.Stat(indexPath + ".bloom"); err != nil && idx.config.BloomFPRate > 0 {
+			return nil
+		}
+	}
+	return meta
+}
+
+// endsWithLineBreak reports whether the first size bytes of the file at path
+// end with a line break.
+func endsWithLineBreak(path string, size int64) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	last := make([]byte, 1)
+	_, err = file.ReadAt(last, size-1)
+	return err == nil && last[0] == '\n'
 }
 
 type csvDNA struct {
@@ -314,7 +504,8 @@ type csvDNA struct {
 	hash  string
 }
 
-func (idx *IndexManager) calculateFingerprint() (csvDNA, error) {
+// calculateFingerprint describes the first size bytes of the CSV.
+func (idx *IndexManager) calculateFingerprint(size int64) (csvDNA, error) {
 	file, err := os.Open(idx.config.InputFile)
 	if err != nil {
 		return csvDNA{}, err
@@ -324,11 +515,19 @@ func (idx *IndexManager) calculateFingerprint() (csvDNA, error) {
 	if err != nil {
 		return csvDNA{}, err
 	}
-	size := stat.Size()
-	mtime := stat.ModTime().Unix()
+	return csvDNA{
+		size:  size,
+		mtime: stat.ModTime().Unix(),
+		hash:  fingerprint(file, size),
+	}, nil
+}
+
+// fingerprint hashes samples from the start, middle and end of the first
+// size bytes of file.
+func fingerprint(file *os.File, size int64) string {
 	sampleSize := int64(512 * 1024)
 	hasher := sha1.New()
-	buf := make([]byte, sampleSize)
+	buf := make([]byte, min(sampleSize, size))
 	n, _ := file.ReadAt(buf, 0)
 	hasher.Write(buf[:n])
 	if size > sampleSize*3 {
@@ -343,11 +542,7 @@ func (idx *IndexManager) calculateFingerprint() (csvDNA, error) {
 		n, _ = file.ReadAt(buf, start)
 		hasher.Write(buf[:n])
 	}
-	return csvDNA{
-		size:  size,
-		mtime: mtime,
-		hash:  hex.EncodeToString(hasher.Sum(nil)),
-	}, nil
+	return hex.EncodeToString(hasher.Sum(nil))
 }
 
 func (idx *IndexManager) Cleanup() {
@@ -0,0 +1,166 @@
+package index
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/types"
+)
+
+const testColumns = `["id","city",["city","id"],"price"]`
+
+var testTypes = map[string]types.ColumnSpec{"price": {Type: types.TypeInt}}
+
+// testRows returns the rows from to to of a CSV with an id, one of 7
+// cities and a price, each row ending with lineBreak.
+func testRows(from, to int, lineBreak string) string {
+	var b strings.Builder
+	for i := from; i < to; i++ {
+		fmt.Fprintf(&b, "%d,city%d,%d%s", i, i%7, (i*37)%1000-500, lineBreak)
+	}
+	return b.String()
+}
+
+// build indexes the CSV at csvPath into dir, from the start if full is set,
+// and returns the build mode.
+func build(t *testing.T, csvPath, dir string, full bool) string {
+	t.Helper()
+	manager := NewIndexManager(IndexerConfig{
+		InputFile: csvPath,
+		OutputDir: dir,
+		Columns:   testColumns,
+		Types:     testTypes,
+		Full:      full,
+	})
+	if err := manager.Run(); err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	return manager.Mode()
+}
+
+// indexRecords returns every record of the indexes of csvPath in dir, in
+// index order, keyed by index file name, and the row count of its metadata.
+func indexRecords(t *testing.T, csvPath, dir string) (map[string][]types.IndexRecord, int64) {
+	t.Helper()
+	paths, _ := filepath.Glob(filepath.Join(dir, "data_*.cidx"))
+	if len(paths) != 4 {
+		t.Fatalf("found indexes %v, want 4", paths)
+	}
+	all := make(map[string][]types.IndexRecord)
+	for _, path := range paths {
+		idx, err := OpenDiskIndex(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		it, err := idx.Scan()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var records []types.IndexRecord
+		for it.Next() {
+			records = append(records, it.Record())
+		}
+		if err := it.Error(); err != nil {
+			t.Fatal(err)
+		}
+		it.Close()
+		idx.Close()
+		all[filepath.Base(path)] = records
+	}
+	meta, err := LoadMeta(dir, csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return all, meta.TotalRows
+}
+
+func TestIncrementalRefresh(t *testing.T) {
+	tests := []struct {
+		name string
+		// the CSV indexed first and what is appended to it
+		initial, appended string
+		mode              string
+	}{
+		{
+			name:     "appended rows",
+			initial:  "id,city,price\n" + testRows(0, 1000, "\n"),
+			appended: testRows(1000, 1500, "\n"),
+			mode:     ModeIncremental,
+		},
+		{
+			name:     "appended crlf rows",
+			initial:  "id,city,price\r\n" + testRows(0, 1000, "\r\n"),
+			appended: testRows(1000, 1500, "\r\n"),
+			mode:     ModeIncremental,
+		},
+		{
+			name:     "appended rows without a final line break",
+			initial:  "id,city,price\n" + testRows(0, 1000, "\n"),
+			appended: strings.TrimSuffix(testRows(1000, 1500, "\n"), "\n"),
+			mode:     ModeIncremental,
+		},
+		{
+			name:     "last line without a line break",
+			initial:  "id,city,price\n" + strings.TrimSuffix(testRows(0, 1000, "\n"), "\n"),
+			appended: "\n" + testRows(1000, 1500, "\n"),
+			mode:     ModeFull,
+		},
+		{
+			name:     "last line continued",
+			initial:  "id,city,price\n" + strings.TrimSuffix(testRows(0, 1000, "\n"), "\n"),
+			appended: "7\n" + testRows(1000, 1500, "\n"),
+			mode:     ModeFull,
+		},
+		{
+			name:    "unchanged",
+			initial: "id,city,price\n" + testRows(0, 1000, "\n"),
+			mode:    ModeUnchanged,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			csvPath := filepath.Join(dir, "data.csv")
+			if err := os.WriteFile(csvPath, []byte(tt.initial), 0644); err != nil {
+				t.Fatal(err)
+			}
+			refreshed := filepath.Join(dir, "refreshed")
+			if mode := build(t, csvPath, refreshed, false); mode != ModeFull {
+				t.Fatalf("first build ran as %s", mode)
+			}
+
+			f, err := os.OpenFile(csvPath, os.O_APPEND|os.O_WRONLY, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = f.WriteString(tt.appended)
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if mode := build(t, csvPath, refreshed, false); mode != tt.mode {
+				t.Fatalf("second build ran as %s, want %s", mode, tt.mode)
+			}
+			rebuilt := filepath.Join(dir, "rebuilt")
+			build(t, csvPath, rebuilt, true)
+
+			got, gotRows := indexRecords(t, csvPath, refreshed)
+			want, wantRows := indexRecords(t, csvPath, rebuilt)
+			if gotRows != wantRows || gotRows != int64(strings.Count(tt.initial+tt.appended, ",city")-1) {
+				t.Fatalf("refreshed metadata counts %d rows, a full build %d", gotRows, wantRows)
+			}
+			for name, records := range want {
+				if !reflect.DeepEqual(got[name], records) {
+					t.Errorf("%s: refreshed index has %d records, a full build %d, or they differ", name, len(got[name]), len(records))
+				}
+			}
+		})
+	}
+}
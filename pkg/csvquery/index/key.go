@@ -0,0 +1,55 @@
+package index
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/types"
+)
+
+// Keys of typed indexes hold the values of their type behind a 02 byte, in
+// the order of the type, and any other value behind a 01 byte as text. Text
+// values sort first, as they do in a typed ORDER BY.
+const (
+	keyText  = 1
+	keyTyped = 2
+)
+
+// IndexableType reports whether an index can be typed with spec. Keys must be
+// of fixed length to compare correctly once trailing zero bytes are trimmed.
+func IndexableType(spec types.ColumnSpec) error {
+	switch spec.Type {
+	case types.TypeInt, types.TypeFloat, types.TypeDate, types.TypeDatetime:
+		return nil
+	}
+	return fmt.Errorf("type %s cannot be used for an index", spec.Type)
+}
+
+// EncodeKey fills key with the index key of value. Untyped keys are the value
+// itself, cut off at the key size.
+func EncodeKey(key *[types.KeySize]byte, spec types.ColumnSpec, value []byte) {
+	*key = [types.KeySize]byte{}
+	if spec.IsString() {
+		copy(key[:], value)
+		return
+	}
+	var buf [16]byte
+	if typed, ok := spec.AppendKey(buf[:0], string(value)); ok {
+		key[0] = keyTyped
+		copy(key[1:], typed)
+		return
+	}
+	key[0] = keyText
+	copy(key[1:], value)
+}
+
+// keyString returns the index key of value in the form the footer and the
+// bloom filter hold keys: without trailing zero bytes.
+func keyString(spec types.ColumnSpec, value string) string {
+	if spec.IsString() {
+		return value
+	}
+	var key [types.KeySize]byte
+	EncodeKey(&key, spec, []byte(value))
+	return string(bytes.TrimRight(key[:], "\x00"))
+}
@@ -0,0 +1,95 @@
+package index
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/types"
+)
+
+func TestEncodeKeyOrder(t *testing.T) {
+	tests := []struct {
+		spec types.ColumnSpec
+		// values in ascending order, with the values of a group equal
+		groups [][]string
+	}{
+		{
+			spec: types.ColumnSpec{Type: types.TypeInt},
+			groups: [][]string{
+				// values that are not ints sort first, as text
+				{""}, {"1.5"}, {"abc"},
+				{"-9223372036854775808"}, {"-100"}, {"-10"}, {"-1"}, {"0", "-0", " 0 "},
+				{"1"}, {"2"}, {"10"}, {"100"}, {"9223372036854775807"},
+			},
+		},
+		{
+			spec: types.ColumnSpec{Type: types.TypeFloat},
+			groups: [][]string{
+				{"NaN"}, {"x"},
+				{"-Inf"}, {"-1e300"}, {"-2.5"}, {"-1"}, {"-0.5"}, {"-1e-300"}, {"-0", "0", "0.0"},
+				{"1e-300"}, {"0.5"}, {"1", "1.0", "1e0"}, {"1.5"}, {"10"}, {"1e300"}, {"+Inf"},
+			},
+		},
+		{
+			spec: types.ColumnSpec{Type: types.TypeDate, Format: types.DefaultDateFormat},
+			groups: [][]string{
+				{"2024-02-30"}, {"n/a"},
+				{"0001-01-01"}, {"1969-12-31"}, {"1970-01-01"}, {"2000-01-01"}, {"2024-02-29"}, {"9999-12-31"},
+			},
+		},
+		{
+			spec: types.ColumnSpec{Type: types.TypeDatetime, Format: "2006-01-02 15:04:05.999999999"},
+			groups: [][]string{
+				{"bad"},
+				{"1969-12-31 23:59:59.5"}, {"1970-01-01 00:00:00", "1970-01-01 00:00:00.000"},
+				{"2024-01-01 00:00:00.000000001"}, {"2024-01-01 00:00:00.5"}, {"2024-01-01 00:00:01"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		type encoded struct {
+			value, short string
+			full         []byte
+			group        int
+		}
+		var keys []encoded
+		for g, group := range tt.groups {
+			for _, v := range group {
+				var key [types.KeySize]byte
+				EncodeKey(&key, tt.spec, []byte(v))
+				keys = append(keys, encoded{value: v, short: keyString(tt.spec, v), full: key[:], group: g})
+			}
+		}
+		for _, a := range keys {
+			for _, b := range keys {
+				want := 0
+				if a.group < b.group {
+					want = -1
+				} else if a.group > b.group {
+					want = 1
+				}
+				if got := bytes.Compare(a.full, b.full); got != want {
+					t.Errorf("%s: keys of %q and %q compare %d, want %d", tt.spec, a.value, b.value, got, want)
+				}
+				if got := strings.Compare(a.short, b.short); got != want {
+					t.Errorf("%s: trimmed keys of %q and %q compare %d, want %d", tt.spec, a.value, b.value, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestEncodeKeyString(t *testing.T) {
+	long := strings.Repeat("x", types.KeySize+10)
+	var key [types.KeySize]byte
+	EncodeKey(&key, types.ColumnSpec{}, []byte(long))
+	if string(key[:]) != long[:types.KeySize] {
+		t.Fatalf("key = %q, want the value cut at %d bytes", key, types.KeySize)
+	}
+	EncodeKey(&key, types.ColumnSpec{}, []byte("ab"))
+	if want := "ab" + strings.Repeat("\x00", types.KeySize-2); string(key[:]) != want {
+		t.Fatalf("key = %q, want %q", key, want)
+	}
+}
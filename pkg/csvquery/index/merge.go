@@ -0,0 +1,291 @@
+package index
+
+import (
+	"container/heap"
+	"sort"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/types"
+)
+
+// SearchKeys looks up every key in idx and merges the matches into a single
+// iterator in file (offset) order. Each Search consults the bloom filter, so
+// absent keys cost no block reads.
+func SearchKeys(idx Index, keys []string) (Iterator, error) {
+	iters := make([]Iterator, 0, len(keys))
+	for _, key := range keys {
+		it, err := idx.Search(key)
+		if err != nil {
+			for _, open := range iters {
+				open.Close()
+			}
+			return nil, err
+		}
+		iters = append(iters, it)
+	}
+	return MergeByOffset(iters), nil
+}
+
+// MergeByOffset merges iterators whose records are each in offset order,
+// as the records of a single key are. Closing the result closes them all.
+func MergeByOffset(iters []Iterator) Iterator {
+	m := &mergeIterator{iters: iters}
+	for _, it := range iters {
+		if it.Next() {
+			m.heap = append(m.heap, it)
+		} else if err := it.Error(); err != nil && m.err == nil {
+			m.err = err
+		}
+	}
+	heap.Init(&m.heap)
+	return m
+}
+
+type mergeIterator struct {
+	iters   []Iterator
+	heap    offsetHeap
+	current types.IndexRecord
+	started bool
+	err     error
+}
+
+func (m *mergeIterator) Next() bool {
+	if m.err != nil {
+		return false
+	}
+	// The iterator that produced the previous record moves on only now, so
+	// the record stays valid until Next is called again.
+	if m.started && len(m.heap) > 0 {
+		top := m.heap[0]
+		if top.Next() {
+			heap.Fix(&m.heap, 0)
+		} else {
+			if err := top.Error(); err != nil {
+				m.err = err
+				return false
+			}
+			heap.Pop(&m.heap)
+		}
+	}
+	m.started = true
+	if len(m.heap) == 0 {
+		return false
+	}
+	m.current = m.heap[0].Record()
+	return true
+}
+
+func (m *mergeIterator) Record() types.IndexRecord {
+	return m.current
+}
+
+func (m *mergeIterator) Close() {
+	for _, it := range m.iters {
+		it.Close()
+	}
+	m.heap = nil
+}
+
+func (m *mergeIterator) Error() error {
+	return m.err
+}
+
+type offsetHeap []Iterator
+
+func (h offsetHeap) Len() int            { return len(h) }
+func (h offsetHeap) Less(i, j int) bool  { return h[i].Record().Offset < h[j].Record().Offset }
+func (h offsetHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *offsetHeap) Push(x interface{}) { *h = append(*h, x.(Iterator)) }
+func (h *offsetHeap) Pop() interface{} {
+	old := *h
+	it := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return it
+}
+
+// IntersectByOffset returns the records of the first iterator whose offsets
+// every other iterator returns too. The iterators must return their
+// records in offset order, as single-key lookups and MergeByOffset do. They
+// are read in step, each skipping to the offset the others have reached,
+// and the intersection ends as soon as one runs out, so the one expected to
+// return the fewest records should come first. Closing the result closes
+// them all.
+func IntersectByOffset(iters []Iterator) Iterator {
+	return &intersectIterator{iters: iters}
+}
+
+type intersectIterator struct {
+	iters   []Iterator
+	current types.IndexRecord
+	started bool
+	done    bool
+	err     error
+}
+
+func (it *intersectIterator) Next() bool {
+	if it.done || len(it.iters) == 0 {
+		return false
+	}
+	if !it.started {
+		it.started = true
+		for _, other := range it.iters[1:] {
+			if !it.step(other) {
+				return false
+			}
+		}
+	}
+	lead := it.iters[0]
+	if !it.step(lead) {
+		return false
+	}
+	for {
+		target, matched := lead.Record().Offset, true
+		for _, other := range it.iters[1:] {
+			for other.Record().Offset < target {
+				if !it.step(other) {
+					return false
+				}
+			}
+			if offset := other.Record().Offset; offset > target {
+				for lead.Record().Offset < offset {
+					if !it.step(lead) {
+						return false
+					}
+				}
+				matched = false
+				break
+			}
+		}
+		if matched {
+			it.current = lead.Record()
+			return true
+		}
+	}
+}
+
+// step advances iter, ending the intersection when it runs out.
+func (it *intersectIterator) step(iter Iterator) bool {
+	if iter.Next() {
+		return true
+	}
+	it.done = true
+	it.err = iter.Error()
+	return false
+}
+
+func (it *intersectIterator) Record() types.IndexRecord {
+	return it.current
+}
+
+func (it *intersectIterator) Close() {
+	for _, iter := range it.iters {
+		iter.Close()
+	}
+}
+
+func (it *intersectIterator) Error() error {
+	return it.err
+}
+
+// SortByOffset returns the records of it in offset order. They are read
+// whole and it is closed, so it is meant for range scans, which return their
+// records in key order, when nothing else can put them in file order.
+func SortByOffset(it Iterator) (Iterator, error) {
+	defer it.Close()
+	var records []types.IndexRecord
+	for it.Next() {
+		records = append(records, it.Record())
+	}
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+	sort.Slice(records, func(a, b int) bool { return records[a].Offset < records[b].Offset })
+	return &sliceIterator{records: records}, nil
+}
+
+// LineSet is a bitmap of the line numbers of index records, which are dense
+// from 2, so it takes one bit per row of the CSV up to the last line added.
+type LineSet struct {
+	bits []uint64
+}
+
+// CollectLines reads it whole, in any order, into a LineSet and closes it.
+func CollectLines(it Iterator) (*LineSet, error) {
+	defer it.Close()
+	s := &LineSet{}
+	for it.Next() {
+		line := it.Record().Line
+		if line < 0 {
+			continue
+		}
+		word := int(line / 64)
+		if word >= len(s.bits) {
+			s.bits = append(s.bits, make([]uint64, word+1-len(s.bits))...)
+		}
+		s.bits[word] |= 1 << uint(line%64)
+	}
+	return s, it.Error()
+}
+
+// Has reports whether line was added to s.
+func (s *LineSet) Has(line int64) bool {
+	word := line / 64
+	return line >= 0 && word < int64(len(s.bits)) && s.bits[word]&(1<<uint(line%64)) != 0
+}
+
+// FilterLines returns the records of it whose lines are in every set, in
+// the order it returns them.
+func FilterLines(it Iterator, sets []*LineSet) Iterator {
+	if len(sets) == 0 {
+		return it
+	}
+	return &lineFilterIterator{Iterator: it, sets: sets}
+}
+
+type lineFilterIterator struct {
+	Iterator
+	sets []*LineSet
+}
+
+func (it *lineFilterIterator) Next() bool {
+	for it.Iterator.Next() {
+		if it.keep(it.Iterator.Record().Line) {
+			return true
+		}
+	}
+	return false
+}
+
+func (it *lineFilterIterator) keep(line int64) bool {
+	for _, s := range it.sets {
+		if !s.Has(line) {
+			return false
+		}
+	}
+	return true
+}
+
+// UnionByOffset merges iterators whose records are each in offset order
+// and returns every offset once, in offset order, dropping the records of
+// an offset after its first as they stream. Closing the result closes them
+// all.
+func UnionByOffset(iters []Iterator) Iterator {
+	return &distinctIterator{Iterator: MergeByOffset(iters)}
+}
+
+type distinctIterator struct {
+	Iterator
+	last    int64
+	started bool
+}
+
+func (it *distinctIterator) Next() bool {
+	for it.Iterator.Next() {
+		offset := it.Iterator.Record().Offset
+		if it.started && offset == it.last {
+			continue
+		}
+		it.last, it.started = offset, true
+		return true
+	}
+	return false
+}
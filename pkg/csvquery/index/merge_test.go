@@ -0,0 +1,106 @@
+package index
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/types"
+)
+
+// closeCounter counts how many times the iterator it wraps is closed.
+type closeCounter struct {
+	Iterator
+	closed *int
+}
+
+func (it closeCounter) Close() {
+	*it.closed++
+	it.Iterator.Close()
+}
+
+func offsetIterators(lists [][]int64, closed *int) []Iterator {
+	iters := make([]Iterator, len(lists))
+	for i, offsets := range lists {
+		records := make([]types.IndexRecord, len(offsets))
+		for j, offset := range offsets {
+			records[j] = types.IndexRecord{Offset: offset, Line: offset}
+		}
+		iters[i] = closeCounter{Iterator: &sliceIterator{records: records}, closed: closed}
+	}
+	return iters
+}
+
+func readOffsets(t *testing.T, it Iterator) []int64 {
+	t.Helper()
+	var got []int64
+	for it.Next() {
+		got = append(got, it.Record().Offset)
+	}
+	if err := it.Error(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return got
+}
+
+func TestUnionByOffset(t *testing.T) {
+	tests := []struct {
+		name     string
+		branches [][]int64
+		want     []int64
+	}{
+		{"no branches", nil, nil},
+		{"empty branches", [][]int64{{}, {}}, nil},
+		{"one branch", [][]int64{{3, 7, 9}}, []int64{3, 7, 9}},
+		{"disjoint", [][]int64{{1, 5}, {2, 6}}, []int64{1, 2, 5, 6}},
+		{"duplicates across branches", [][]int64{{1, 4, 8}, {4, 8, 9}}, []int64{1, 4, 8, 9}},
+		{"identical branches", [][]int64{{2, 3}, {2, 3}, {2, 3}}, []int64{2, 3}},
+		{"duplicate in some branches", [][]int64{{5}, {1, 5, 7}, {5, 7}, {}}, []int64{1, 5, 7}},
+		{"duplicates within a branch", [][]int64{{1, 1, 2}, {2, 2}}, []int64{1, 2}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			closed := 0
+			it := UnionByOffset(offsetIterators(tt.branches, &closed))
+			if got := readOffsets(t, it); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("offsets = %v, want %v", got, tt.want)
+			}
+			it.Close()
+			if closed != len(tt.branches) {
+				t.Fatalf("closed %d of %d branches", closed, len(tt.branches))
+			}
+		})
+	}
+}
+
+func TestIntersectByOffset(t *testing.T) {
+	tests := []struct {
+		name  string
+		parts [][]int64
+		want  []int64
+	}{
+		{"no parts", nil, nil},
+		{"one part", [][]int64{{3, 7}}, []int64{3, 7}},
+		{"empty part", [][]int64{{1, 2}, {}}, nil},
+		{"disjoint", [][]int64{{1, 3, 5}, {2, 4, 6}}, nil},
+		{"overlap", [][]int64{{1, 4, 8, 9}, {2, 4, 9, 10}}, []int64{4, 9}},
+		{"three parts", [][]int64{{1, 2, 3, 4, 5}, {2, 3, 5}, {3, 5, 6}}, []int64{3, 5}},
+		{"shortest last", [][]int64{{1, 2, 3, 4, 5, 6, 7, 8}, {8}}, []int64{8}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			closed := 0
+			it := IntersectByOffset(offsetIterators(tt.parts, &closed))
+			if got := readOffsets(t, it); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("offsets = %v, want %v", got, tt.want)
+			}
+			it.Close()
+			if closed != len(tt.parts) {
+				t.Fatalf("closed %d of %d parts", closed, len(tt.parts))
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package index
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/types"
+)
+
+// MetaPath returns the location of the _meta.json written for csvPath.
+func MetaPath(indexDir, csvPath string) string {
+	csvName := strings.TrimSuffix(filepath.Base(csvPath), filepath.Ext(csvPath))
+	return filepath.Join(indexDir, csvName+"_meta.json")
+}
+
+// LoadMeta reads the index metadata for csvPath from indexDir.
+func LoadMeta(indexDir, csvPath string) (*types.IndexMeta, error) {
+	data, err := os.ReadFile(MetaPath(indexDir, csvPath))
+	if err != nil {
+		return nil, err
+	}
+	var meta types.IndexMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// CheckCsv compares the CSV at csvPath with the one the indexes described
+// by meta were built from. It returns the size of the CSV and, if the
+// meta.CsvSize bytes the indexes cover have changed since, why. Rows
+// appended after them are not a change, nor is a line break ending their
+// last row.
+func CheckCsv(csvPath string, meta *types.IndexMeta) (int64, string) {
+	file, err := os.Open(csvPath)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, err.Error()
+	}
+	size := stat.Size()
+	switch {
+	case size < meta.CsvSize:
+		return size, "the csv is smaller than when the index was built"
+	case size == meta.CsvSize && stat.ModTime().Unix() == meta.CsvMtime && meta.CapturedAt.Unix() > meta.CsvMtime:
+		// A write in the second the index was built in could keep both the
+		// size and the mtime, so the hash decides then
+		return size, ""
+	}
+	if size > meta.CsvSize && meta.CsvSize > 0 {
+		// The last row may have been continued, unless it ended with a line
+		// break or the appended bytes start with one, as inserts add to a
+		// CSV that does not end with one
+		buf := make([]byte, 3)
+		n, _ := file.ReadAt(buf, meta.CsvSize-1)
+		if n < 2 || buf[0] != '\n' && buf[1] != '\n' && string(buf[1:n]) != "\r\n" {
+			return size, "the last row of the csv changed since the index was built"
+		}
+	}
+	if fingerprint(file, meta.CsvSize) != meta.CsvHash {
+		return size, "the csv changed since the index was built"
+	}
+	return size, ""
+}
+
+// CsvVersion returns the size and fingerprint of the CSV at csvPath, which
+// CsvContinues compares it with later.
+func CsvVersion(csvPath string) (types.CsvVersion, error) {
+	file, err := os.Open(csvPath)
+	if err != nil {
+		return types.CsvVersion{}, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return types.CsvVersion{}, err
+	}
+	return types.CsvVersion{Size: stat.Size(), Hash: fingerprint(file, stat.Size())}, nil
+}
+
+// CsvContinues reports whether the CSV at csvPath still starts with the
+// v.Size bytes v was taken from, whether or not rows were appended since.
+func CsvContinues(csvPath string, v types.CsvVersion) (bool, error) {
+	file, err := os.Open(csvPath)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	return stat.Size() >= v.Size && fingerprint(file, v.Size) == v.Hash, nil
+}
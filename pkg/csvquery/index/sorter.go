@@ -41,6 +41,8 @@ type Sorter struct {
 	memBuffer      []types.IndexRecord
 	chunkDistincts []int64
 	bloom          *BloomFilter
+	keyType        types.ColumnSpec
+	base           Iterator
 }
 
 func NewSorter(name, outputPath, tempDir string, memoryLimit int, bloom *BloomFilter) *Sorter {
@@ -59,6 +61,19 @@ func NewSorter(name, outputPath, tempDir string, memoryLimit int, bloom *BloomFi
 	}
 }
 
+// SetKeyType marks the output as a typed index whose keys were encoded with
+// EncodeKey under spec.
+func (s *Sorter) SetKeyType(spec types.ColumnSpec) {
+	s.keyType = spec
+}
+
+// SetBase merges the records of it, which must be in index order, into the
+// output, as when the records of appended rows are added to an existing
+// index. The sorter does not close it.
+func (s *Sorter) SetBase(it Iterator) {
+	s.base = it
+}
+
 func (s *Sorter) Add(record types.IndexRecord) error {
 	s.memBuffer = append(s.memBuffer, record)
 	atomic.AddInt64(&s.totalRecords, 1)
@@ -143,12 +158,14 @@ func (s *Sorter) Finalize() (int64, error) {
 	}
 	atomic.StoreInt32(&s.state, int32(StateMerging))
 
-	if len(s.chunkFiles) == 0 {
-		f, err := os.Create(s.outputPath)
+	if len(s.chunkFiles) == 0 && s.base == nil {
+		f, err := storage.CreateAtomic(s.outputPath)
 		if err != nil {
 			return 0, err
 		}
-		f.Close()
+		if err := f.Commit(); err != nil {
+			return 0, err
+		}
 		atomic.StoreInt32(&s.state, int32(StateDone))
 		return 0, nil
 	}
@@ -250,21 +267,37 @@ func (s *Sorter) kWayMerge() (int64, error) {
 		}
 	}()
 
-	outFile, err := os.Create(s.outputPath)
+	outFile, err := storage.CreateAtomic(s.outputPath)
 	if err != nil {
 		return 0, fmt.Errorf("failed to create output file: %w", err)
 	}
-	defer outFile.Close()
+	defer outFile.Abort()
 
 	writer, err := NewBlockWriter(outFile)
 	if err != nil {
 		return 0, err
 	}
+	writer.SetKeyType(s.keyType)
 
-	h := make(manualHeap, 0, k)
-	for i := 0; i < k; i++ {
-		rec, err := storage.ReadRecord(readers[i])
-		if err == nil {
+	// The base index, if any, is source k
+	read := func(source int) (types.IndexRecord, bool) {
+		if source == k {
+			if s.base.Next() {
+				return s.base.Record(), true
+			}
+			return types.IndexRecord{}, false
+		}
+		rec, err := storage.ReadRecord(readers[source])
+		return rec, err == nil
+	}
+	sources := k
+	if s.base != nil {
+		sources++
+	}
+
+	h := make(manualHeap, 0, sources)
+	for i := 0; i < sources; i++ {
+		if rec, ok := read(i); ok {
 			h = append(h, mergeItem{record: rec, source: i})
 		}
 	}
@@ -296,15 +329,22 @@ func (s *Sorter) kWayMerge() (int64, error) {
 		}
 		atomic.AddInt64(&s.mergedRecords, 1)
 
-		nextRec, err := storage.ReadRecord(readers[item.source])
-		if err == nil {
+		if nextRec, ok := read(item.source); ok {
 			h.Push(mergeItem{record: nextRec, source: item.source})
 		}
 	}
+	if s.base != nil {
+		if err := s.base.Error(); err != nil {
+			return 0, fmt.Errorf("failed to read index: %w", err)
+		}
+	}
 
 	if err := writer.Close(); err != nil {
 		return 0, err
 	}
+	if err := outFile.Commit(); err != nil {
+		return 0, err
+	}
 
 	return distinctCount, nil
 }
@@ -27,6 +27,11 @@ type SIMDParser struct {
 	startTime   time.Time
 	rowsScanned int64
 	scanBytes   int64
+	// borrowed is set when data is mapped by the caller, who unmaps it
+	borrowed bool
+	// scans start at startOffset with line startLine when it is set
+	startOffset int
+	startLine   int64
 }
 
 // NewSIMDParser creates a new Mmap-based CSV scanner
@@ -65,6 +70,23 @@ func NewSIMDParser(filePath, separator string) (*SIMDParser, error) {
 	return p, nil
 }
 
+// NewSIMDParserFromData creates a scanner over CSV data that is already
+// mapped. The caller keeps ownership of data; Close leaves it mapped.
+func NewSIMDParserFromData(data []byte, separator string) (*SIMDParser, error) {
+	p := &SIMDParser{
+		separator: separator[0],
+		data:      data,
+		fileSize:  int64(len(data)),
+		workers:   runtime.NumCPU(),
+		startTime: time.Now(),
+		borrowed:  true,
+	}
+	if err := p.readHeaders(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
 func (p *SIMDParser) readHeaders() error {
 	idx := bytes.IndexByte(p.data, '\n')
 	if idx == -1 {
@@ -85,10 +107,7 @@ func (p *SIMDParser) readHeaders() error {
 	p.headerMap = make(map[string]int)
 
 	for i, part := range parts {
-		name := string(bytes.TrimSpace(part))
-		if len(name) >= 2 && name[0] == '"' && name[len(name)-1] == '"' {
-			name = name[1 : len(name)-1]
-		}
+		name := string(UnquoteField(bytes.TrimSpace(part)))
 		p.headers[i] = name
 		p.headerMap[strings.ToLower(name)] = i
 	}
@@ -121,9 +140,65 @@ func (p *SIMDParser) SetWorkers(n int) {
 	}
 }
 
+// SetStart makes scans begin at offset, which must be the start of a record
+// after the header, and number the records from line, to scan only the rows
+// appended since an earlier scan.
+func (p *SIMDParser) SetStart(offset, line int64) {
+	p.startOffset = int(offset)
+	p.startLine = line
+}
+
+// Size returns the size of the file as it was mapped, which is what scans
+// read.
+func (p *SIMDParser) Size() int64 {
+	return p.fileSize
+}
+
 func (p *SIMDParser) Scan(indexDefs [][]int, handler func(workerID int, keys [][]byte, offset, line int64)) error {
+	return p.scan(indexDefs, func(workerID int, keys [][]byte, offset, line int64) bool {
+		handler(workerID, keys, offset, line)
+		return true
+	}, nil)
+}
+
+// ScanRecords calls handler with the fields of every record. Each worker
+// scans one chunk of the file; workerID numbers the chunks in file order and
+// a worker passes its records in file order. Fields point into the mapped
+// file and are only valid during the call. A worker stops at the first
+// record for which handler returns false. If done is not nil, it is called
+// once for every chunk, by its worker, when the worker has finished it.
+func (p *SIMDParser) ScanRecords(handler func(workerID int, fields [][]byte, offset, line int64) bool, done func(workerID int)) error {
+	defs := make([][]int, len(p.headers))
+	for i := range defs {
+		defs[i] = []int{i}
+	}
+	return p.scan(defs, handler, done)
+}
+
+// Workers returns the number of chunks a scan is split into.
+func (p *SIMDParser) Workers() int {
+	return p.workers
+}
+
+func (p *SIMDParser) scan(indexDefs [][]int, handler func(workerID int, keys [][]byte, offset, line int64) bool, done func(workerID int)) error {
+	if done == nil {
+		done = func(int) {}
+	}
 	startIdx := bytes.IndexByte(p.data, '\n') + 1
-	if startIdx <= 0 || startIdx >= len(p.data) {
+	if startIdx <= 0 {
+		for i := 0; i < p.workers; i++ {
+			done(i)
+		}
+		return nil
+	}
+	firstLine := int64(2) // 1-based index, skipping header (row 1)
+	if p.startOffset > startIdx {
+		startIdx, firstLine = p.startOffset, p.startLine
+	}
+	if startIdx >= len(p.data) {
+		for i := 0; i < p.workers; i++ {
+			done(i)
+		}
 		return nil
 	}
 
@@ -162,7 +237,7 @@ func (p *SIMDParser) Scan(indexDefs [][]int, handler func(workerID int, keys [][
 
 	// Calculate start lines
 	startLines := make([]int64, p.workers)
-	currentLine := int64(2) // 1-based index, skipping header (row 1)
+	currentLine := firstLine
 	for i := 0; i < p.workers; i++ {
 		startLines[i] = currentLine
 		currentLine += chunkLines[i]
@@ -173,11 +248,13 @@ func (p *SIMDParser) Scan(indexDefs [][]int, handler func(workerID int, keys [][
 		start := boundaries[i]
 		end := boundaries[i+1]
 		if start >= end {
+			done(i)
 			continue
 		}
 		wg.Add(1)
 		go func(chunkStart, chunkEnd int, workerID int, startLine int64) {
 			defer wg.Done()
+			defer done(workerID)
 			p.processChunk(chunkStart, chunkEnd, workerID, startLine, indexDefs, handler)
 		}(start, end, i, startLines[i])
 	}
@@ -187,7 +264,7 @@ func (p *SIMDParser) Scan(indexDefs [][]int, handler func(workerID int, keys [][
 	return nil
 }
 
-func (p *SIMDParser) processChunk(start, end int, workerID int, startLine int64, indexDefs [][]int, handler func(workerID int, keys [][]byte, offset, line int64)) {
+func (p *SIMDParser) processChunk(start, end int, workerID int, startLine int64, indexDefs [][]int, handler func(workerID int, keys [][]byte, offset, line int64) bool) {
 	if start >= len(p.data) {
 		return
 	}
@@ -273,9 +350,14 @@ func (p *SIMDParser) processChunk(start, end int, workerID int, startLine int64,
 					for k := range currentRowValues {
 						currentRowValues[k] = nil
 					}
-					p.parseLineSimd(lineBytes, sep, int64(start+lineStart), workerID, indexDefs, handler, keys, currentRowValues, &scratchBuf, lineStart, quotesBitmap, sepsBitmap, currentLine)
+					more := p.parseLineSimd(lineBytes, sep, int64(start+lineStart), workerID, indexDefs, handler, keys, currentRowValues, &scratchBuf, lineStart, quotesBitmap, sepsBitmap, currentLine)
 					localRowsScanned++
 					currentLine++
+					if !more {
+						atomic.AddInt64(&p.scanBytes, localScanBytes)
+						atomic.AddInt64(&p.rowsScanned, localRowsScanned)
+						return
+					}
 				}
 				localScanBytes += int64(lineEnd - lineStart + 1)
 				lineStart = bytePos + 1
@@ -316,19 +398,19 @@ func (p *SIMDParser) parseLineSimd(
 	offset int64,
 	workerID int,
 	indexDefs [][]int,
-	handler func(workerID int, keys [][]byte, offset, line int64),
+	handler func(workerID int, keys [][]byte, offset, line int64) bool,
 	keys [][]byte,
 	currentRowValues [][]byte,
 	scratchBuf *[]byte,
 	lineStartInChunk int,
 	quotesBitmap, sepsBitmap []uint64,
 	lineNum int64,
-) {
+) bool {
 	maxCol := len(currentRowValues) - 1
 	lineLen := len(line)
 
 	if lineLen == 0 {
-		return
+		return true
 	}
 
 	colIdx := 0
@@ -360,22 +442,14 @@ func (p *SIMDParser) parseLineSimd(
 		}
 
 		if isSep && !inQuote {
-			valBytes := line[fieldStart:i]
-			if len(valBytes) >= 2 && valBytes[0] == '"' && valBytes[len(valBytes)-1] == '"' {
-				valBytes = valBytes[1 : len(valBytes)-1]
-			}
-			currentRowValues[colIdx] = valBytes
+			currentRowValues[colIdx] = UnquoteField(line[fieldStart:i])
 			colIdx++
 			fieldStart = i + 1
 		}
 	}
 
 	if colIdx <= maxCol && fieldStart <= lineLen {
-		valBytes := line[fieldStart:]
-		if len(valBytes) >= 2 && valBytes[0] == '"' && valBytes[len(valBytes)-1] == '"' {
-			valBytes = valBytes[1 : len(valBytes)-1]
-		}
-		currentRowValues[colIdx] = valBytes
+		currentRowValues[colIdx] = UnquoteField(line[fieldStart:])
 	}
 
 	*scratchBuf = (*scratchBuf)[:0]
@@ -406,11 +480,12 @@ func (p *SIMDParser) parseLineSimd(
 		}
 	}
 
-	handler(workerID, keys, offset, lineNum)
+	more := handler(workerID, keys, offset, lineNum)
 
 	for k := 0; k < len(currentRowValues); k++ {
 		currentRowValues[k] = nil
 	}
+	return more
 }
 
 func (p *SIMDParser) countChunkLines(start, end int) int64 {
@@ -474,5 +549,22 @@ func (p *SIMDParser) GetStats() (rowsScanned int64, bytesRead int64) {
 }
 
 func (p *SIMDParser) Close() error {
+	if p.borrowed {
+		return nil
+	}
 	return storage.MunmapFile(p.data)
 }
+
+// UnquoteField strips the quotes surrounding a field and turns the doubled
+// quotes inside them back into single ones. Fields without escaped quotes
+// are returned as subslices of field.
+func UnquoteField(field []byte) []byte {
+	if len(field) < 2 || field[0] != '"' || field[len(field)-1] != '"' {
+		return field
+	}
+	field = field[1 : len(field)-1]
+	if bytes.Contains(field, []byte(`""`)) {
+		field = bytes.ReplaceAll(field, []byte(`""`), []byte(`"`))
+	}
+	return field
+}
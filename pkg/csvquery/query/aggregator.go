@@ -105,7 +105,34 @@ func (sa *StreamAggregator) Add(groupVal string, val float64) {
 	}
 }
 
-func (sa *StreamAggregator) Finalize(writer io.Writer) error {
+// Merge folds the partial results of other, aggregated over different rows
+// with the same config, into sa. Neither may have had Result called yet.
+func (sa *StreamAggregator) Merge(other *StreamAggregator) {
+	for groupVal, val := range other.results {
+		curr, ok := sa.results[groupVal]
+		switch sa.config.AggFunc {
+		case "min":
+			if !ok || val < curr {
+				sa.results[groupVal] = val
+			}
+		case "max":
+			if !ok || val > curr {
+				sa.results[groupVal] = val
+			}
+		case "":
+			sa.results[groupVal] = 1
+		default:
+			sa.results[groupVal] = curr + val
+		}
+	}
+	for groupVal, c := range other.counts {
+		sa.counts[groupVal] += c
+	}
+}
+
+// Result returns the final value of every group. It must be called once,
+// after the last Add.
+func (sa *StreamAggregator) Result() map[string]float64 {
 	if sa.config.AggFunc == "avg" {
 		for k, v := range sa.results {
 			if c := sa.counts[k]; c > 0 {
@@ -113,5 +140,9 @@ func (sa *StreamAggregator) Finalize(writer io.Writer) error {
 			}
 		}
 	}
-	return json.NewEncoder(writer).Encode(sa.results)
+	return sa.results
+}
+
+func (sa *StreamAggregator) Finalize(writer io.Writer) error {
+	return json.NewEncoder(writer).Encode(sa.Result())
 }
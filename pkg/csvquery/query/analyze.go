@@ -0,0 +1,155 @@
+package query
+
+import (
+	"time"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/index"
+)
+
+// Analysis holds what actually happened during an EXPLAIN ANALYZE run.
+type Analysis struct {
+	Index        index.Stats  `json:"index"`
+	RowsScanned  int64        `json:"rowsScanned"`  // produced by the access path
+	RowsFetched  int64        `json:"rowsFetched"`  // read and parsed from the CSV
+	RowsRejected int64        `json:"rowsRejected"` // dropped by the residual filter
+	RowsReturned int64        `json:"rowsReturned"`
+	Groups       int64        `json:"groups,omitempty"`
+	Timings      PhaseTimings `json:"timings"`
+
+	timer phaseTimer
+}
+
+// PhaseTimings is the wall time spent in each execution phase.
+type PhaseTimings struct {
+	Planning  string `json:"planning"`
+	Index     string `json:"index"`
+	Fetch     string `json:"fetch"`
+	Filter    string `json:"filter"`
+	Aggregate string `json:"aggregate"`
+	Sort      string `json:"sort"`
+	Total     string `json:"total"`
+}
+
+type phase int
+
+const (
+	phasePlanning phase = iota
+	phaseIndex
+	phaseFetch
+	phaseFilter
+	phaseAggregate
+	phaseSort
+	numPhases
+)
+
+// phaseTimer accumulates per-phase durations. When disabled it never reads
+// the clock, so the counters can stay wired into the hot loops.
+type phaseTimer struct {
+	enabled bool
+	totals  [numPhases]time.Duration
+}
+
+func (t *phaseTimer) start() time.Time {
+	if !t.enabled {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+func (t *phaseTimer) stop(p phase, since time.Time) {
+	if t.enabled {
+		t.totals[p] += time.Since(since)
+	}
+}
+
+func (a *Analysis) finish(total time.Duration) {
+	d := a.timer.totals
+	a.Timings = PhaseTimings{
+		Planning:  d[phasePlanning].String(),
+		Index:     d[phaseIndex].String(),
+		Fetch:     d[phaseFetch].String(),
+		Filter:    d[phaseFilter].String(),
+		Aggregate: d[phaseAggregate].String(),
+		Sort:      d[phaseSort].String(),
+		Total:     total.String(),
+	}
+}
+
+// annotate copies the actual row counts onto the plan tree.
+func (p *Plan) annotate(a *Analysis) {
+	var walk func(n *PlanNode)
+	walk = func(n *PlanNode) {
+		var actual int64
+		switch n.Operation {
+		case "Filter", "Sort":
+			actual = a.RowsScanned - a.RowsRejected
+		case "Limit", "Project", StrategyCount:
+			actual = a.RowsReturned
+		case StrategyIndexIntersect, StrategyIndexUnion:
+			actual = a.RowsScanned
+			n.ActualRows = &actual
+			if n.Operation == StrategyIndexUnion {
+				annotateLookups(n.Children, p.Branches)
+			} else {
+				annotateLookups(n.Children, p.Parts)
+			}
+			return
+		default:
+			if len(n.Children) == 0 {
+				actual = a.RowsScanned
+			} else {
+				// Aggregate
+				actual = a.Groups
+			}
+		}
+		n.ActualRows = &actual
+		for _, c := range n.Children {
+			walk(c)
+		}
+	}
+	if p.Tree != nil {
+		walk(p.Tree)
+	}
+}
+
+// annotateLookups copies the records each lookup returned onto its node of
+// the plan tree, and those of its own lookups onto their nodes.
+func annotateLookups(nodes []*PlanNode, lookups []IndexLookup) {
+	for i, n := range nodes {
+		l := &lookups[i]
+		if n.Operation == "Filter" {
+			// A branch's residual predicates are checked on the union's rows
+			n = n.Children[0]
+		}
+		n.ActualRows = &l.actual
+		if len(l.Branches) > 0 {
+			annotateLookups(n.Children, l.Branches)
+		} else {
+			annotateLookups(n.Children, l.Parts)
+		}
+	}
+}
+
+// analyzeResultWriter discards the query output and only counts it.
+type analyzeResultWriter struct {
+	a *Analysis
+}
+
+func (w *analyzeResultWriter) Row(offset, line int64, values []interface{}) error {
+	w.a.RowsReturned++
+	return nil
+}
+
+func (w *analyzeResultWriter) Count(n int64) error {
+	w.a.RowsReturned = n
+	return nil
+}
+
+func (w *analyzeResultWriter) Groups(groups map[string]float64) error {
+	w.a.Groups = int64(len(groups))
+	w.a.RowsReturned = int64(len(groups))
+	return nil
+}
+
+func (w *analyzeResultWriter) Plan(plan interface{}) error { return nil }
+func (w *analyzeResultWriter) Finish(err error) error      { return err }
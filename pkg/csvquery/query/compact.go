@@ -0,0 +1,345 @@
+package query
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/index"
+	"github.com/csvquery/csvquery/pkg/csvquery/storage"
+	"github.com/csvquery/csvquery/pkg/csvquery/types"
+)
+
+// CompactOptions configures the index rebuild of a compaction, like the
+// options of the index action.
+type CompactOptions struct {
+	Workers     int
+	MemoryMB    int
+	BloomFPRate float64
+}
+
+// CompactResult reports what a compaction changed.
+type CompactResult struct {
+	Rows    int64    `json:"rows"`    // rows in the new file
+	Updated int64    `json:"updated"` // rows rewritten with their updates
+	Deleted int64    `json:"deleted"` // rows removed
+	Indexes []string `json:"indexes"` // indexes rebuilt
+}
+
+// Compact rewrites the CSV with its pending updates applied and its deleted
+// rows removed, rebuilds the indexes listed in the _meta.json of indexDir
+// against the new file and removes the update log and the updates file.
+//
+// The new CSV and indexes are built in temporary directories next to the
+// old ones and only renamed into place under the exclusive lock of the CSV.
+// Requests hold that lock shared, so each one sees either the old files or
+// the new ones, and those already running keep their mappings of the old
+// files. If the CSV or its updates change while the new files are built,
+// Compact fails and leaves everything as it was.
+func Compact(csvPath, indexDir string, opts CompactOptions) (*CompactResult, error) {
+	csvPath, err := filepath.Abs(csvPath)
+	if err != nil {
+		return nil, err
+	}
+	updates, snapshot, err := loadUpdates(csvPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(updates.Overrides) == 0 && len(updates.Deleted) == 0 {
+		return &CompactResult{Indexes: []string{}}, nil
+	}
+	before, err := os.Stat(csvPath)
+	if err != nil {
+		return nil, err
+	}
+
+	tempDir, err := os.MkdirTemp(filepath.Dir(csvPath), ".compact")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	defer os.RemoveAll(tempDir)
+	meta, err := index.LoadMeta(indexDir, csvPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read index metadata: %v", err)
+	}
+	newCSV := filepath.Join(tempDir, filepath.Base(csvPath))
+	headerMap := make(map[string]int)
+	res, err := rewriteCSV(csvPath, newCSV, meta.CsvSeparator()[0], updates, headerMap)
+	if err != nil {
+		return nil, err
+	}
+
+	var indexFiles []string
+	if meta != nil && len(meta.Indexes) > 0 {
+		tempIndexDir, err := os.MkdirTemp(indexDir, ".compact")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create temp directory: %w", err)
+		}
+		defer os.RemoveAll(tempIndexDir)
+		if res.Indexes, err = rebuildIndexes(newCSV, tempIndexDir, indexDir, csvPath, meta, headerMap, opts); err != nil {
+			return nil, err
+		}
+		entries, err := os.ReadDir(tempIndexDir)
+		if err != nil {
+			return nil, err
+		}
+		metaName := filepath.Base(index.MetaPath(indexDir, csvPath))
+		for _, entry := range entries {
+			if entry.Type().IsRegular() && entry.Name() != metaName && filepath.Ext(entry.Name()) != ".lock" {
+				indexFiles = append(indexFiles, filepath.Join(tempIndexDir, entry.Name()))
+			}
+		}
+		// The metadata goes last, as it describes the indexes before it
+		indexFiles = append(indexFiles, filepath.Join(tempIndexDir, metaName))
+	}
+
+	lock, err := storage.LockExclusive(csvPath)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	_, current, err := loadUpdates(csvPath)
+	if err != nil {
+		return nil, err
+	}
+	after, err := os.Stat(csvPath)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(current, snapshot) {
+		return nil, fmt.Errorf("updates changed during compaction")
+	}
+	if !os.SameFile(before, after) || before.Size() != after.Size() || !before.ModTime().Equal(after.ModTime()) {
+		return nil, fmt.Errorf("csv changed during compaction")
+	}
+
+	// Fold the log into the updates file, which records the version of the
+	// CSV its lines refer to, so that the changes left behind if the process
+	// dies after replacing the CSV are ignored rather than applied to the
+	// lines of the new file
+	if err := updates.checkpoint(); err != nil {
+		return nil, err
+	}
+	for _, path := range indexFiles {
+		if err := storage.ReplaceFile(path, filepath.Join(indexDir, filepath.Base(path))); err != nil {
+			return nil, fmt.Errorf("failed to replace index: %w", err)
+		}
+	}
+	csvName := strings.TrimSuffix(filepath.Base(csvPath), filepath.Ext(csvPath))
+	for _, name := range res.Indexes {
+		if err := index.RemoveDelta(filepath.Join(indexDir, csvName+"_"+name+".cidx")); err != nil {
+			return nil, err
+		}
+	}
+	if err := storage.ReplaceFile(newCSV, csvPath); err != nil {
+		return nil, fmt.Errorf("failed to replace csv: %w", err)
+	}
+	if err := updates.remove(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// rewriteCSV copies the CSV at src, whose fields are separated by sep, to
+// dst, record by record, leaving out deleted rows and rewriting the fields
+// that have updates. Everything else, including the header, quoting and line
+// endings, is copied as is. The columns of the header are added to
+// headerMap.
+func rewriteCSV(src, dst string, sep byte, updates *UpdateManager, headerMap map[string]int) (*CompactResult, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := storage.MmapFile(f)
+	if err != nil {
+		return nil, err
+	}
+	defer storage.MunmapFile(data)
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+	w := bufio.NewWriterSize(out, 1<<20)
+
+	parseHeader(data, sep, headerMap)
+	res := &CompactResult{Indexes: []string{}}
+
+	// Records are numbered like the SIMD parser does, see lineOffsets
+	offset := min(recordEnd(data, 0)+1, int64(len(data)))
+	w.Write(data[:offset])
+	line := int64(2)
+	values := make(map[int]string)
+	var buf []byte
+	for offset < int64(len(data)) {
+		next := min(recordEnd(data, offset)+1, int64(len(data)))
+		record := recordAt(data, offset)
+		if len(record) == 0 {
+			w.Write(data[offset:next])
+			offset = next
+			continue
+		}
+		key := lineKey(line)
+		line++
+		switch {
+		case updates.Deleted[key]:
+			res.Deleted++
+		case updates.Overrides[key] != nil:
+			clear(values)
+			for col, val := range updates.Overrides[key] {
+				if i, ok := headerMap[col]; ok {
+					values[i] = val
+				}
+			}
+			buf = rewriteRecord(buf[:0], record, sep, values)
+			w.Write(buf)
+			w.Write(data[offset+int64(len(record)) : next])
+			res.Updated++
+			res.Rows++
+		default:
+			w.Write(data[offset:next])
+			res.Rows++
+		}
+		offset = next
+	}
+
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	if err := out.Sync(); err != nil {
+		return nil, err
+	}
+	return res, out.Close()
+}
+
+// rewriteRecord appends record to dst with the fields at the positions in
+// values replaced, split the way splitFields splits them. Positions past
+// the end of the record are ignored, as they are when updates are applied
+// to rows that are read.
+func rewriteRecord(dst, record []byte, sep byte, values map[int]string) []byte {
+	inQuote := false
+	start, field := 0, 0
+	for i := 0; i <= len(record); i++ {
+		if i < len(record) {
+			if record[i] == '"' {
+				inQuote = !inQuote
+				continue
+			}
+			if record[i] != sep || inQuote {
+				continue
+			}
+		}
+		if val, ok := values[field]; ok {
+			dst = appendField(dst, val, sep)
+		} else {
+			dst = append(dst, record[start:i]...)
+		}
+		if i < len(record) {
+			dst = append(dst, sep)
+		}
+		start = i + 1
+		field++
+	}
+	return dst
+}
+
+// appendField appends a CSV field, quoting it when it holds the separator,
+// a quote or a line break.
+func appendField(dst []byte, val string, sep byte) []byte {
+	if !strings.ContainsAny(val, string(sep)+"\"\r\n") {
+		return append(dst, val...)
+	}
+	dst = append(dst, '"')
+	dst = append(dst, strings.ReplaceAll(val, `"`, `""`)...)
+	return append(dst, '"')
+}
+
+// rebuildIndexes builds the indexes listed in meta for the CSV at src, whose
+// columns are in headerMap, into outDir. A bloom filter is built when the existing index in indexDir has
+// one, at opts.BloomFPRate or 1% if that is not set.
+func rebuildIndexes(src, outDir, indexDir, csvPath string, meta *types.IndexMeta, headerMap map[string]int, opts CompactOptions) ([]string, error) {
+	names := make([]string, 0, len(meta.Indexes))
+	for name := range meta.Indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var colDefs [][]string
+	colTypes := make(map[string]types.ColumnSpec)
+	bloomRate := opts.BloomFPRate
+	csvName := strings.TrimSuffix(filepath.Base(csvPath), filepath.Ext(csvPath))
+	for _, name := range names {
+		cols := indexDefinition(name, meta, headerMap)
+		if cols == nil {
+			return nil, fmt.Errorf("index %s does not match the columns of the csv", name)
+		}
+		colDefs = append(colDefs, cols)
+		if spec := meta.Indexes[name].Type; spec != nil && len(cols) == 1 {
+			colTypes[cols[0]] = *spec
+		}
+		if _, err := os.Stat(filepath.Join(indexDir, csvName+"_"+name+".cidx.bloom")); err == nil && bloomRate == 0 {
+			bloomRate = 0.01
+		}
+	}
+	columns, err := json.Marshal(colDefs)
+	if err != nil {
+		return nil, err
+	}
+
+	manager := index.NewIndexManager(index.IndexerConfig{
+		InputFile:   src,
+		OutputDir:   outDir,
+		Columns:     string(columns),
+		Separator:   meta.CsvSeparator(),
+		Workers:     opts.Workers,
+		MemoryMB:    opts.MemoryMB,
+		BloomFPRate: bloomRate,
+		Types:       colTypes,
+		StalePolicy: meta.StalePolicy,
+	})
+	if err := manager.Run(); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// indexDefinition returns the columns of the index name in key order: those
+// recorded in meta for a composite index, or else those recovered from its
+// name. It returns nil if the CSV, whose columns are in headerMap, lacks one.
+func indexDefinition(name string, meta *types.IndexMeta, headerMap map[string]int) []string {
+	if meta != nil && len(meta.Indexes[name].Columns) > 0 {
+		cols := meta.Indexes[name].Columns
+		for _, col := range cols {
+			if _, ok := headerMap[col]; !ok {
+				return nil
+			}
+		}
+		return cols
+	}
+	return indexColumns(name, headerMap)
+}
+
+// indexColumns recovers the columns of an index from its name, which is
+// their lower-cased names joined by underscores. A column whose own name
+// contains underscores is preferred over splitting it.
+func indexColumns(name string, headerMap map[string]int) []string {
+	if _, ok := headerMap[name]; ok {
+		return []string{name}
+	}
+	for col := range headerMap {
+		if rest, ok := strings.CutPrefix(name, col+"_"); ok {
+			if cols := indexColumns(rest, headerMap); cols != nil {
+				return append([]string{col}, cols...)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package query
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/types"
+)
+
+// TestCompactInterrupted simulates a compaction dying at each step of
+// swapping the files, by putting back the files it had not replaced or
+// removed yet, and checks that the pending updates are applied exactly
+// once: to the old CSV, or not at all to the new one.
+func TestCompactInterrupted(t *testing.T) {
+	const data = "id,status\n1,a\n2,b\n3,c\n4,d\n5,e\n"
+	tests := []struct {
+		name string
+		// what the compaction had not done yet
+		keepCSV, keepCheckpoint, keepLog bool
+	}{
+		{"before replacing the csv", true, true, true},
+		{"after replacing the csv", false, true, true},
+		{"after removing the log", false, true, false},
+		{"done", false, false, false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			csvPath := writeCSV(t, dir, "data.csv", data)
+			buildIndexes(t, csvPath, dir, `["id"]`, nil)
+			req := types.QueryConfig{CsvPath: csvPath}
+			modify(t, dir, req, `{"operator":"=","column":"id","value":"2"}`, nil)
+			modify(t, dir, req, `{"operator":"=","column":"id","value":"3"}`, map[string]string{"status": "x"})
+
+			// Compact folds the log into the checkpoint before the swap
+			updates, err := LoadUpdates(csvPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := updates.checkpoint(); err != nil {
+				t.Fatal(err)
+			}
+			saved := make(map[string][]byte)
+			for _, path := range []string{csvPath, csvPath + "_updates.json", csvPath + "_updates.log"} {
+				if saved[path], err = os.ReadFile(path); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if _, err := Compact(csvPath, dir, CompactOptions{}); err != nil {
+				t.Fatalf("Compact: %v", err)
+			}
+			restore := map[string]bool{
+				csvPath:                   tt.keepCSV,
+				csvPath + "_updates.json": tt.keepCheckpoint,
+				csvPath + "_updates.log":  tt.keepLog,
+			}
+			for path, keep := range restore {
+				if keep {
+					if err := os.WriteFile(path, saved[path], 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			// The indexes were replaced before the CSV, so a full scan reads
+			// the rows of whichever CSV is in place
+			rows := runQuery(t, "", types.QueryConfig{CsvPath: csvPath, Select: []string{"id", "status"}}, "")
+			want := []string{"1,a", "3,x", "4,d", "5,e"}
+			if got := rows.values(); !reflect.DeepEqual(got, want) {
+				t.Fatalf("rows = %q, want %q", got, want)
+			}
+
+			// Changes made afterwards apply to the CSV in place, and survive
+			// the checkpoint that replaces the one left behind
+			modify(t, dir, req, `{"operator":"=","column":"id","value":"4"}`, map[string]string{"status": "y"})
+			updates, err = LoadUpdates(csvPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := updates.checkpoint(); err != nil {
+				t.Fatal(err)
+			}
+			want = []string{"1,a", "3,x", "4,y", "5,e"}
+			rows = runQuery(t, "", types.QueryConfig{CsvPath: csvPath, Select: []string{"id", "status"}}, "")
+			if got := rows.values(); !reflect.DeepEqual(got, want) {
+				t.Fatalf("rows after another update = %q, want %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,343 @@
+package query
+
+import (
+	"math"
+	"slices"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/index"
+	"github.com/csvquery/csvquery/pkg/csvquery/types"
+)
+
+// Relative costs of the work a plan does, in units of one row of a full
+// scan. Full scans parse rows sequentially on every CPU, while rows found
+// through an index are read one by one at their offsets.
+const (
+	costScanRow     = 1.0  // parse and filter a row of a full scan
+	costIndexLookup = 20.0 // find the blocks of a key: bloom filter and footer search
+	costIndexRecord = 0.1  // decompress and compare an index record
+	costFetchRow    = 4.0  // read and parse a row at an offset from an index
+	costSortRow     = 2.0  // add a row to the external sort and read it back
+)
+
+// Selectivities of predicates the index statistics say nothing about
+const (
+	selEq    = 0.1
+	selRange = 1.0 / 3
+	selLike  = 0.25
+	selNull  = 0.1
+)
+
+// CostEstimate is what the planner expects from an access path.
+type CostEstimate struct {
+	Rows    int64   `json:"rows"`    // rows the access path produces
+	Matches int64   `json:"matches"` // rows left after the whole where
+	Cost    float64 `json:"cost"`
+
+	sort float64 // part of Cost spent sorting for ORDER BY
+}
+
+// indexRead is what an access path reads from its index.
+type indexRead struct {
+	lookups int64              // keys or ranges searched
+	records int64              // records decoded
+	rows    int64              // records expected to match
+	cols    []string           // columns whose predicates the index answers
+	conds   []*types.Condition // other predicates it answers, such as an OR
+	ordered bool               // the rows come in ORDER BY order
+	whole   bool               // every record is read before the first row
+}
+
+// costModel estimates the cost of the ways a query can be run from the
+// statistics in _meta.json and the block record counts of the indexes.
+type costModel struct {
+	req   types.QueryConfig
+	where *types.Condition
+	meta  *types.IndexMeta
+	total int64 // rows of the CSV
+	// known holds the rows single-column indexes expect the predicates on
+	// their column to match, which beats the default selectivities
+	known map[string]int64
+}
+
+func newCostModel(req types.QueryConfig, where *types.Condition, meta *types.IndexMeta) *costModel {
+	m := &costModel{req: req, where: where, meta: meta, known: make(map[string]int64)}
+	if meta != nil {
+		m.total = meta.TotalRows
+	}
+	return m
+}
+
+// observe lets an index stand in for the row count of a CSV without
+// _meta.json.
+func (m *costModel) observe(idx *index.DiskIndex) {
+	if m.meta == nil {
+		m.total = max(m.total, idx.ApproximateCount())
+	}
+}
+
+// fullScan estimates scanning the whole CSV.
+func (m *costModel) fullScan() CostEstimate {
+	sel := m.residualSelectivity(indexRead{})
+	est := CostEstimate{Rows: m.total, Matches: round(float64(m.total) * sel)}
+	est.Cost = m.read(m.total, sel, false) * costScanRow
+	m.addSort(&est)
+	return est
+}
+
+// indexScan estimates an access path that reads r from its index.
+func (m *costModel) indexScan(r indexRead) CostEstimate {
+	rest := m.residualSelectivity(r)
+	est := CostEstimate{Rows: r.rows, Matches: round(float64(r.rows) * rest)}
+	read := m.read(r.rows, rest, r.ordered)
+	records := r.records
+	if r.rows > 0 && !r.whole {
+		// Records are decoded as rows are read, so a limit saves both
+		records = round(float64(records) * read / float64(r.rows))
+	}
+	est.Cost = float64(r.lookups)*costIndexLookup + float64(records)*costIndexRecord
+	if m.fetches(r) {
+		est.Cost += read * costFetchRow
+	}
+	if !r.ordered {
+		m.addSort(&est)
+	}
+	est.Cost = math.Round(est.Cost*10) / 10
+	return est
+}
+
+// intersection estimates reading the records of every part from its index
+// and keeping the rows all of them return.
+func (m *costModel) intersection(parts []indexRead) CostEstimate {
+	return m.indexScan(m.intersectRead(parts))
+}
+
+// intersectRead adds up what the parts of an intersection read. Parts are
+// taken to be independent, so each keeps its share of the rows the others
+// return.
+func (m *costModel) intersectRead(parts []indexRead) indexRead {
+	r := indexRead{rows: parts[0].rows, whole: true}
+	share := 1.0
+	for _, p := range parts {
+		r.lookups += p.lookups
+		r.records += p.records
+		r.cols = append(r.cols, p.cols...)
+		r.rows = min(r.rows, p.rows)
+		if m.total > 0 {
+			share *= min(1, float64(p.rows)/float64(m.total))
+		}
+	}
+	if m.total > 0 {
+		r.rows = min(r.rows, round(share*float64(m.total)))
+	}
+	return r
+}
+
+// unionRead adds up what the branches of a union read. Branches are taken
+// to be independent, so the rows of one are partly those of the others.
+func (m *costModel) unionRead(branches []indexRead) indexRead {
+	r := indexRead{whole: true}
+	none := 1.0
+	for _, b := range branches {
+		r.lookups += b.lookups
+		r.records += b.records
+		r.rows += b.rows
+		if m.total > 0 {
+			none *= 1 - min(1, float64(b.rows)/float64(m.total))
+		}
+	}
+	if m.total > 0 {
+		r.rows = min(r.rows, round((1-none)*float64(m.total)))
+	}
+	return r
+}
+
+// addSort adds sorting the matching rows to est if the query is ordered.
+func (m *costModel) addSort(est *CostEstimate) {
+	if len(m.req.OrderBy) > 0 && m.req.GroupBy == "" && !m.req.CountOnly {
+		est.sort = float64(est.Matches) * costSortRow
+		est.Cost += est.sort
+	}
+	est.Cost = math.Round(est.Cost*10) / 10
+}
+
+// read returns how many of n rows, of which a fraction sel matches, are
+// read before LIMIT is reached. Rows that have to be sorted or aggregated
+// are all read.
+func (m *costModel) read(n int64, sel float64, ordered bool) float64 {
+	r := m.req
+	if r.Limit <= 0 || r.CountOnly || r.GroupBy != "" || len(r.OrderBy) > 0 && !ordered || sel <= 0 {
+		return float64(n)
+	}
+	return min(float64(n), float64(r.Offset+r.Limit)/sel)
+}
+
+// fetches reports whether an access path that reads r has to read its rows
+// from the CSV.
+func (m *costModel) fetches(r indexRead) bool {
+	if len(m.req.Select) > 0 || m.req.GroupBy != "" || len(m.req.OrderBy) > 0 && !r.ordered {
+		return true
+	}
+	for _, c := range conjuncts(m.where) {
+		if !r.answers(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// answers reports whether the index read answers the predicate c.
+func (r indexRead) answers(c *types.Condition) bool {
+	return c.Column != "" && slices.Contains(r.cols, c.Column) || slices.Contains(r.conds, c)
+}
+
+// residualSelectivity is the fraction of rows the predicates r does not
+// answer keep.
+func (m *costModel) residualSelectivity(r indexRead) float64 {
+	sel := 1.0
+	done := make(map[string]bool)
+	for _, c := range conjuncts(m.where) {
+		if r.answers(c) {
+			continue
+		}
+		if rows, ok := m.known[c.Column]; ok && m.total > 0 {
+			if !done[c.Column] {
+				done[c.Column] = true
+				sel *= min(1, float64(rows)/float64(m.total))
+			}
+			continue
+		}
+		sel *= m.selectivity(c)
+	}
+	return sel
+}
+
+// selectivity estimates the fraction of rows c keeps. Equality uses the
+// distinct count of the column's index, if it has one.
+func (m *costModel) selectivity(c *types.Condition) float64 {
+	if c == nil {
+		return 1
+	}
+	switch c.Operator {
+	case "AND":
+		sel := 1.0
+		for i := range c.Children {
+			sel *= m.selectivity(&c.Children[i])
+		}
+		return sel
+	case "OR":
+		none := 1.0
+		for i := range c.Children {
+			none *= 1 - m.selectivity(&c.Children[i])
+		}
+		return 1 - none
+	case "NOT":
+		if len(c.Children) == 1 {
+			return 1 - m.selectivity(&c.Children[0])
+		}
+		return 1
+	case types.OpEq:
+		return m.eqSelectivity(c.Column)
+	case types.OpNeq:
+		return 1 - m.eqSelectivity(c.Column)
+	case types.OpIn:
+		return min(1, float64(len(inTargets(c.Value)))*m.eqSelectivity(c.Column))
+	case types.OpGt, types.OpGte, types.OpLt, types.OpLte:
+		return selRange
+	case types.OpLike, types.OpILike:
+		if c.ResolvedLike != nil && c.ResolvedLike.IsLiteral() {
+			return m.eqSelectivity(c.Column)
+		}
+		return selLike
+	case types.OpIsNull:
+		return selNull
+	case types.OpIsNotNull:
+		return 1 - selNull
+	}
+	return 1
+}
+
+func (m *costModel) eqSelectivity(col string) float64 {
+	if m.meta != nil {
+		if stats, ok := m.meta.Indexes[col]; ok && stats.DistinctCount > 0 {
+			return 1 / float64(stats.DistinctCount)
+		}
+	}
+	return selEq
+}
+
+// conjuncts returns the predicates that must all hold for where to hold.
+func conjuncts(where *types.Condition) []*types.Condition {
+	if where == nil {
+		return nil
+	}
+	if where.Operator != "AND" {
+		return []*types.Condition{where}
+	}
+	res := make([]*types.Condition, len(where.Children))
+	for i := range where.Children {
+		res[i] = &where.Children[i]
+	}
+	return res
+}
+
+func round(f float64) int64 {
+	return int64(math.Round(f))
+}
+
+// costLookup estimates looking up keys in the index at indexPath, named
+// name, which answers the predicates on cols. The blocks that may hold a
+// key bound its records, and the average rows per distinct key of the index
+// its rows, within the records of the blocks that hold only the key.
+func (e *Executor) costLookup(m *costModel, indexPath, name string, keys, cols []string) (indexRead, bool) {
+	idx, release, err := e.Resources.OpenIndex(indexPath)
+	if err != nil {
+		return indexRead{}, false
+	}
+	defer release()
+	m.observe(idx)
+
+	var lower, upper int64
+	for _, key := range keys {
+		l, u := idx.CountBounds(key)
+		lower += l
+		upper += u
+	}
+	rows := upper
+	if m.meta != nil {
+		if stats, ok := m.meta.Indexes[name]; ok && stats.DistinctCount > 0 {
+			rows = max(lower, min(upper, int64(len(keys))*m.total/stats.DistinctCount))
+		}
+	}
+	if len(cols) == 1 {
+		m.known[cols[0]] = rows
+	}
+	return indexRead{lookups: int64(len(keys)), records: upper, rows: rows, cols: cols}, true
+}
+
+// costRange estimates scanning the key range r of the index at indexPath,
+// which answers the predicates on cols.
+func (e *Executor) costRange(m *costModel, indexPath string, r KeyRange, cols []string) (indexRead, bool) {
+	idx, release, err := e.Resources.OpenIndex(indexPath)
+	if err != nil {
+		return indexRead{}, false
+	}
+	defer release()
+	m.observe(idx)
+
+	records := idx.EstimateRange(r.Lower, r.Upper)
+	return indexRead{lookups: 1, records: records, rows: records, cols: cols}, true
+}
+
+// costWalk estimates reading every record of the index at indexPath, in
+// ORDER BY order if ordered.
+func (e *Executor) costWalk(m *costModel, indexPath string, ordered bool) (indexRead, bool) {
+	idx, release, err := e.Resources.OpenIndex(indexPath)
+	if err != nil {
+		return indexRead{}, false
+	}
+	defer release()
+	m.observe(idx)
+
+	records := idx.ApproximateCount()
+	return indexRead{lookups: 1, records: records, rows: records, ordered: ordered}, true
+}
@@ -0,0 +1,74 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/types"
+)
+
+func TestPlanChoice(t *testing.T) {
+	csvPath, indexDir := indexedCSV(t, 50000)
+
+	tests := []struct {
+		name  string
+		where string
+		want  string
+	}{
+		{
+			name:  "selective equality",
+			where: `{"operator":"=","column":"id","value":"4242"}`,
+			want:  StrategyIndexScan,
+		},
+		{
+			name:  "fairly selective equality",
+			where: `{"operator":"=","column":"country","value":"C7"}`,
+			want:  StrategyIndexScan,
+		},
+		{
+			name:  "unselective equality",
+			where: `{"operator":"=","column":"status","value":"active"}`,
+			want:  StrategyFullScan,
+		},
+		{
+			name:  "selective IN list",
+			where: `{"operator":"IN","column":"id","value":["1","2","3"]}`,
+			want:  StrategyIndexInList,
+		},
+		{
+			name:  "selective range",
+			where: `{"operator":">=","column":"price","value":995}`,
+			want:  StrategyIndexRange,
+		},
+		{
+			name:  "unselective range",
+			where: `{"operator":">=","column":"price","value":10}`,
+			want:  StrategyFullScan,
+		},
+		{
+			name:  "selective predicate with an unselective one",
+			where: `{"operator":"AND","children":[{"operator":"=","column":"id","value":"4242"},{"operator":"=","column":"status","value":"active"}]}`,
+			want:  StrategyIndexScan,
+		},
+		{
+			name:  "selective branches",
+			where: `{"operator":"OR","children":[{"operator":"=","column":"id","value":"4242"},{"operator":"=","column":"country","value":"C7"}]}`,
+			want:  StrategyIndexUnion,
+		},
+		{
+			name:  "unselective branch",
+			where: `{"operator":"OR","children":[{"operator":"=","column":"id","value":"4242"},{"operator":"=","column":"status","value":"active"}]}`,
+			want:  StrategyFullScan,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			req := types.QueryConfig{CsvPath: csvPath, Select: []string{"id"}, Explain: true}
+			plan := runQuery(t, indexDir, req, tt.where).plan
+			if plan.Strategy != tt.want {
+				t.Fatalf("strategy = %s (cost %.1f), want %s", plan.Strategy, plan.Cost, tt.want)
+			}
+		})
+	}
+}
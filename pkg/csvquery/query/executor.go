@@ -1,17 +1,16 @@
 package query
 
 import (
-	"bufio"
 	"bytes"
 	"fmt"
 	"io"
-	"os"
+	"maps"
 	"path/filepath"
 	"runtime"
-	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/csvquery/csvquery/pkg/csvquery/index"
 	"github.com/csvquery/csvquery/pkg/csvquery/storage"
@@ -19,14 +18,30 @@ import (
 )
 
 type Executor struct {
-	IndexDir string
-	Updates  *UpdateManager
+	IndexDir  string
+	Updates   *UpdateManager
+	Resources Resources
+	// sep is the field separator of the query's CSV
+	sep byte
+	// Lock is the lock of the CSV held for the request, if any, which is
+	// upgraded to rebuild stale indexes
+	Lock *storage.FileLock
+
+	// analysis collects execution counters for the query being run
+	analysis *Analysis
+	// stale holds the indexes of the query's CSV that no longer match it,
+	// with the reason
+	stale map[string]string
+	// scanWorkers, if set, is the number of chunks full scans split the CSV
+	// into, instead of one per CPU
+	scanWorkers int
 }
 
 func NewExecutor(indexDir string, updates *UpdateManager) *Executor {
 	return &Executor{
-		IndexDir: indexDir,
-		Updates:  updates,
+		IndexDir:  indexDir,
+		Updates:   updates,
+		Resources: directResources{},
 	}
 }
 
@@ -42,114 +57,349 @@ func (e *Executor) Execute(req types.QueryConfig, writer io.Writer) error {
 }
 
 func (e *Executor) ExecuteWithCondition(req types.QueryConfig, where *types.Condition, writer io.Writer) error {
+	rw, err := NewResultWriter(req, writer)
+	if err != nil {
+		return err
+	}
+	return rw.Finish(e.Run(req, where, rw))
+}
+
+// Run executes the query and reports its results to rw. The caller owns rw
+// and is responsible for calling Finish on it.
+func (e *Executor) Run(req types.QueryConfig, where *types.Condition, rw ResultWriter) error {
 	if req.CsvPath == "" {
 		return fmt.Errorf("csv path required")
 	}
+	if req.GroupBy != "" && len(req.Select) > 0 {
+		return fmt.Errorf("select cannot be combined with groupBy")
+	}
+	if req.GroupBy != "" && len(req.OrderBy) > 0 {
+		// Groups are returned as a JSON object, which is always sorted by key
+		if len(req.OrderBy) > 1 || req.OrderBy[0].Desc || !strings.EqualFold(req.OrderBy[0].Column, req.GroupBy) {
+			return fmt.Errorf("ORDER BY with GROUP BY is only supported on the group column in ascending order")
+		}
+	}
 
-	// 1. Check for count-only optimization
-	if req.CountOnly && where == nil && req.GroupBy == "" {
-		return e.runCountAll(req, writer)
+	if req.CountOnly {
+		// The count is a single value: LIMIT and OFFSET do not apply to the
+		// rows it counts
+		req.Limit, req.Offset = 0, 0
 	}
 
-	// 2. Check for updates (force full scan if updates exist)
-	if e.Updates != nil && len(e.Updates.Overrides) > 0 {
-		return e.runFullScan(req, where, writer)
+	if !types.ValidStalePolicy(req.OnStale) {
+		return fmt.Errorf("invalid onStale: %s (expected fail, fallback or rebuild)", req.OnStale)
+	}
+	req.Types = e.columnTypes(req)
+	e.sep = e.separator(req.CsvPath)
+	if err := ResolveTypes(where, req.Types); err != nil {
+		return err
 	}
 
-	// 3. Try to find an index
-	indexPath, searchKey, hasSearchKey, plan, err := e.findBestIndex(req, where)
-	if err != nil {
-		// Fallback to full scan
-		return e.runFullScan(req, where, writer)
-	}
-
-	// 4. Index optimization: Covered columns
-	if where != nil {
-		if covered, ok := plan["covered_columns"].([]string); ok && len(covered) > 0 {
-			allCovered := true
-			conds := ExtractIndexConditions(where)
-			for k := range conds {
-				isCovered := false
-				for _, c := range covered {
-					if strings.EqualFold(c, k) {
-						isCovered = true
-						break
-					}
-				}
-				if !isCovered {
-					allCovered = false
-					break
-				}
-			}
-			if allCovered {
-				where = nil
-			}
+	start := time.Now()
+	e.analysis = &Analysis{timer: phaseTimer{enabled: req.Analyze}}
+
+	// 1. Plan: count-only optimization, index selection, covered columns
+	t := e.analysis.timer.start()
+	plan := e.buildPlan(req, where)
+	e.analysis.timer.stop(phasePlanning, t)
+
+	if req.Analyze {
+		// Run for real, discard the rows and report what happened
+		if err := e.execute(req, where, plan, &analyzeResultWriter{a: e.analysis}); err != nil {
+			return err
 		}
+		e.analysis.finish(time.Since(start))
+		plan.Analysis = e.analysis
+		plan.annotate(e.analysis)
+		return rw.Plan(plan)
 	}
 
 	if req.Explain {
 		// Just output plan
-		fmt.Fprintf(writer, "Plan: %v\n", plan)
-		return nil
+		return rw.Plan(plan)
+	}
+
+	return e.execute(req, where, plan, rw)
+}
+
+// separator returns the field separator the CSV was indexed with, which
+// _meta.json records, or a comma. Without an index directory, the metadata
+// is looked for next to the CSV, where indexes are built by default.
+func (e *Executor) separator(csvPath string) byte {
+	dir := e.IndexDir
+	if dir == "" {
+		dir = filepath.Dir(csvPath)
 	}
+	meta, _ := index.LoadMeta(dir, csvPath)
+	return meta.CsvSeparator()[0]
+}
 
-	// 5. Execute with Index
-	idx, err := index.OpenDiskIndex(indexPath)
+// columnTypes adds the key types of typed indexes to the declared column
+// types, so that a column indexed as a number compares as one without being
+// declared again with every query.
+func (e *Executor) columnTypes(req types.QueryConfig) map[string]types.ColumnSpec {
+	if e.IndexDir == "" {
+		return req.Types
+	}
+	meta, err := index.LoadMeta(e.IndexDir, req.CsvPath)
 	if err != nil {
-		return fmt.Errorf("failed to open index: %w", err)
+		return req.Types
 	}
-	defer idx.Close()
+	var merged map[string]types.ColumnSpec
+	for name, stats := range meta.Indexes {
+		if stats.Type == nil {
+			continue
+		}
+		if _, declared := req.Types[name]; declared {
+			continue
+		}
+		if merged == nil {
+			merged = make(map[string]types.ColumnSpec, len(req.Types)+1)
+			maps.Copy(merged, req.Types)
+		}
+		merged[name] = *stats.Type
+	}
+	if merged == nil {
+		return req.Types
+	}
+	return merged
+}
 
-	var iter index.Iterator
-	if hasSearchKey {
-		iter, err = idx.Search(searchKey)
-	} else {
-		iter, err = idx.Scan()
+func (e *Executor) execute(req types.QueryConfig, where *types.Condition, plan *Plan, rw ResultWriter) error {
+	if plan.Staleness != nil && plan.Staleness.err != nil {
+		return plan.Staleness.err
+	}
+	switch plan.Strategy {
+	case StrategyCount:
+		return e.runCountAll(req, rw)
+	case StrategyFullScan:
+		return e.runFullScan(req, where, plan, rw)
 	}
+
+	// 2. Execute with Index
+	iter, release, err := e.lookup(plan)
 	if err != nil {
 		return err
 	}
+	defer release()
+	if len(plan.updatedLines) > 0 {
+		merged, err := e.mergeUpdates(req, iter, plan, where)
+		if err != nil {
+			iter.Close()
+			return err
+		}
+		iter = merged
+	}
 	defer iter.Close()
 
-	if hasSearchKey {
-		// searchKey was used to open iterator
-		// If iterator is empty, we are done
+	// 3. Iterate and fetch rows; only the residual condition is left to check
+	if req.GroupBy != "" {
+		return e.runAggregation(req, iter, plan.residual, rw)
 	}
 
-	// 6. Iterate and fetch rows
-	if req.GroupBy != "" {
-		// Aggregation path
-		// We need to fetch rows and aggregate.
-		// For now, delegating to a helper that mimics runAggregation
-		return e.runAggregation(req, iter, where, writer)
+	return e.runStandardOutput(req, iter, plan, rw)
+}
+
+// searchIndex opens the index of plan and starts its lookup or scan, with
+// the records of inserted rows merged in. The release func closes the index
+// once the iterator is no longer used.
+func (e *Executor) searchIndex(plan *Plan) (index.Iterator, func(), error) {
+	if plan.deltaErr != nil {
+		return nil, nil, fmt.Errorf("failed to read index delta: %w", plan.deltaErr)
+	}
+	idx, release, err := e.Resources.OpenIndex(plan.indexPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open index: %w", err)
 	}
 
-	return e.runStandardOutput(req, iter, hasSearchKey, searchKey, where, writer)
+	observed := index.WithDelta(idx.Observe(&e.analysis.Index), plan.delta)
+	var iter index.Iterator
+	if plan.hasSearchKey {
+		iter, err = observed.Search(plan.SearchKey)
+	} else if plan.Strategy == StrategyIndexInList {
+		iter, err = index.SearchKeys(observed, plan.SearchKeys)
+	} else if plan.keyRange != nil {
+		iter, err = observed.SearchRange(plan.keyRange.Lower, plan.keyRange.Upper)
+	} else if plan.reverse {
+		iter, err = observed.ScanReverse()
+	} else {
+		iter, err = observed.Scan()
+	}
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	return iter, release, nil
 }
 
-func (e *Executor) runCountAll(req types.QueryConfig, writer io.Writer) error {
-	// Try getting from index metadata
-	if count, ok := e.tryCountFromIndex(req); ok {
-		fmt.Fprintln(writer, count)
-		return nil
+// lookup starts the index lookup of plan. The release func closes its
+// indexes once the iterator is no longer used.
+func (e *Executor) lookup(plan *Plan) (index.Iterator, func(), error) {
+	switch plan.Strategy {
+	case StrategyIndexIntersect:
+		return e.intersect(plan.Parts)
+	case StrategyIndexUnion:
+		return e.union(plan.Branches)
 	}
+	return e.searchIndex(plan)
+}
 
-	// Fallback to counting lines
-	f, err := os.Open(req.CsvPath)
+// union runs the lookups of an Index Union and merges their records into
+// file order as they stream, each offset once. Range lookups, which return
+// their records in key order, are sorted into file order first.
+func (e *Executor) union(branches []IndexLookup) (index.Iterator, func(), error) {
+	iters, release, err := e.openLookups(branches)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	defer f.Close()
+	t := e.analysis.timer.start()
+	defer e.analysis.timer.stop(phaseIndex, t)
 
-	data, err := storage.MmapFile(f)
+	for i, iter := range iters {
+		if inFileOrder(branches[i].plan) {
+			continue
+		}
+		sorted, err := index.SortByOffset(iter)
+		if err != nil {
+			for j, open := range iters {
+				if j != i {
+					open.Close()
+				}
+			}
+			release()
+			return nil, nil, err
+		}
+		iters[i] = sorted
+	}
+	return index.UnionByOffset(iters), release, nil
+}
+
+// intersect runs the lookups of an Index Intersection. Those that return
+// their records in file order are intersected as they stream; the others,
+// range scans, are read into line bitmaps that filter the result, except
+// that the first is sorted into file order if no lookup is in it already.
+// Only the rows left are read from the CSV.
+func (e *Executor) intersect(parts []IndexLookup) (index.Iterator, func(), error) {
+	iters, release, err := e.openLookups(parts)
+	if err != nil {
+		return nil, nil, err
+	}
+	t := e.analysis.timer.start()
+	defer e.analysis.timer.stop(phaseIndex, t)
+
+	var ordered, unordered []index.Iterator
+	for i, iter := range iters {
+		if inFileOrder(parts[i].plan) {
+			ordered = append(ordered, iter)
+		} else {
+			unordered = append(unordered, iter)
+		}
+	}
+	fail := func(err error) (index.Iterator, func(), error) {
+		for _, iter := range append(ordered, unordered...) {
+			iter.Close()
+		}
+		release()
+		return nil, nil, err
+	}
+	if len(ordered) == 0 {
+		first := unordered[0]
+		unordered = unordered[1:]
+		sorted, err := index.SortByOffset(first)
+		if err != nil {
+			return fail(err)
+		}
+		ordered = []index.Iterator{sorted}
+	}
+	var sets []*index.LineSet
+	for len(unordered) > 0 {
+		set, err := index.CollectLines(unordered[0])
+		unordered = unordered[1:]
+		if err != nil {
+			return fail(err)
+		}
+		sets = append(sets, set)
+	}
+	return index.FilterLines(index.IntersectByOffset(ordered), sets), release, nil
+}
+
+// inFileOrder reports whether the lookup of plan returns its records in
+// offset order: a single key, an IN list or a combination of lookups.
+// Range scans return theirs in key order.
+func inFileOrder(plan *Plan) bool {
+	switch plan.Strategy {
+	case StrategyIndexInList, StrategyIndexIntersect, StrategyIndexUnion:
+		return true
+	}
+	return plan.hasSearchKey
+}
+
+// openLookups starts the lookups of an Index Intersection or an Index
+// Union, counting the records each returns. The release func closes their
+// indexes once the iterators are no longer used.
+func (e *Executor) openLookups(lookups []IndexLookup) ([]index.Iterator, func(), error) {
+	iters := make([]index.Iterator, 0, len(lookups))
+	var releases []func()
+	release := func() {
+		for _, r := range releases {
+			r()
+		}
+	}
+	for i := range lookups {
+		iter, r, err := e.lookup(lookups[i].plan)
+		if err != nil {
+			for _, open := range iters {
+				open.Close()
+			}
+			release()
+			return nil, nil, err
+		}
+		releases = append(releases, r)
+		iters = append(iters, &countingIterator{Iterator: iter, n: &lookups[i].actual})
+	}
+	return iters, release, nil
+}
+
+// countingIterator counts the records of an iterator.
+type countingIterator struct {
+	index.Iterator
+	n *int64
+}
+
+func (it *countingIterator) Next() bool {
+	if !it.Iterator.Next() {
+		return false
+	}
+	*it.n++
+	return true
+}
+
+// next advances iter, accounting the time and rows to the index phase.
+func (e *Executor) next(iter index.Iterator) bool {
+	t := e.analysis.timer.start()
+	ok := iter.Next()
+	e.analysis.timer.stop(phaseIndex, t)
+	if ok {
+		e.analysis.RowsScanned++
+	}
+	return ok
+}
+
+func (e *Executor) runCountAll(req types.QueryConfig, rw ResultWriter) error {
+	// Try getting from index metadata
+	if count, ok := e.tryCountFromIndex(req); ok {
+		return rw.Count(count - e.Updates.deletedCount())
+	}
+
+	// Fallback to counting lines
+	data, release, err := e.Resources.MapFile(req.CsvPath)
 	if err != nil {
 		return err
 	}
-	defer storage.MunmapFile(data)
+	defer release()
 
 	if len(data) == 0 {
-		fmt.Fprintln(writer, 0)
-		return nil
+		return rw.Count(0)
 	}
 
 	// parallel count
@@ -186,8 +436,7 @@ func (e *Executor) runCountAll(req types.QueryConfig, writer io.Writer) error {
 		totalCount-- // Assume header exists? Or strictly lines? Scanner skips header.
 		// engine.go did totalCount-- presumably for header
 	}
-	fmt.Fprintln(writer, totalCount)
-	return nil
+	return rw.Count(totalCount - e.Updates.deletedCount())
 }
 
 func (e *Executor) tryCountFromIndex(req types.QueryConfig) (int64, bool) {
@@ -202,195 +451,114 @@ func (e *Executor) tryCountFromIndex(req types.QueryConfig) (int64, bool) {
 		return 0, false
 	}
 
-	// Just peek at the first index found
-	idx, err := index.OpenDiskIndex(matches[0])
+	// Just peek at the first index that matches the CSV
+	var path string
+	for _, m := range matches {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(m), csvBase+"_"), ".cidx")
+		if _, stale := e.stale[name]; !stale {
+			path = m
+			break
+		}
+	}
+	if path == "" {
+		return 0, false
+	}
+	idx, release, err := e.Resources.OpenIndex(path)
 	if err != nil {
 		return 0, false
 	}
-	defer idx.Close()
+	defer release()
 
-	return idx.ApproximateCount(), true
+	delta, err := index.LoadDelta(path, idx.KeyType())
+	if err != nil {
+		return 0, false
+	}
+	return index.WithDelta(idx, delta).ApproximateCount(), true
 }
 
-func (e *Executor) findBestIndex(req types.QueryConfig, where *types.Condition) (string, string, bool, map[string]interface{}, error) {
-	plan := make(map[string]interface{})
-	csvName := strings.TrimSuffix(filepath.Base(req.CsvPath), filepath.Ext(req.CsvPath))
-
-	if where != nil {
-		conds := ExtractIndexConditions(where)
-		if len(conds) > 0 {
-			var cols []string
-			for col := range conds {
-				cols = append(cols, col)
-			}
-			sort.Strings(cols)
-
-			// Try finding index for subsets of columns
-			for i := len(cols); i >= 1; i-- {
-				currentCols := cols[:i]
-				indexName := strings.Join(currentCols, "_")
-				var searchKey string
-				if i == 1 {
-					searchKey = conds[currentCols[0]]
-				} else {
-					var b strings.Builder
-					b.WriteByte('[')
-					for k, col := range currentCols {
-						if k > 0 {
-							b.WriteByte(',')
-						}
-						b.WriteByte('"')
-						b.WriteString(conds[col])
-						b.WriteByte('"')
-					}
-					b.WriteByte(']')
-					searchKey = b.String()
-				}
-
-				indexPath := filepath.Join(e.IndexDir, csvName+"_"+indexName+".cidx")
-				if _, err := os.Stat(indexPath); err == nil {
-					plan["strategy"] = "Index Scan"
-					plan["index"] = indexName
-					plan["covered_columns"] = currentCols
-					return indexPath, searchKey, true, plan, nil
-				}
-			}
+func (e *Executor) runStandardOutput(req types.QueryConfig, iter index.Iterator, plan *Plan, rw ResultWriter) error {
+	// Index records carry offset and line. Rows are only read from the CSV
+	// to check the residual condition, to get the ORDER BY values or to
+	// return the selected columns.
+	where := plan.residual
+	var rows *rowSource
+	if where != nil || plan.Sort == SortExternal || len(req.Select) > 0 {
+		data, release, err := e.Resources.MapFile(req.CsvPath)
+		if err != nil {
+			return err
 		}
+		defer release()
+		rows = newRowSource(data, e.sep, e.Updates)
 	}
 
-	if req.GroupBy != "" {
-		groupName := strings.ReplaceAll(req.GroupBy, ",", "_")
-		indexPath := filepath.Join(e.IndexDir, csvName+"_"+groupName+".cidx")
-		if _, err := os.Stat(indexPath); err == nil {
-			plan["strategy"] = "GroupBy Index Scan"
-			plan["index"] = groupName
-			return indexPath, "", false, plan, nil
+	var sorter *externalSort
+	if plan.Sort == SortExternal {
+		var err error
+		if sorter, err = newExternalSort(req, rows.column); err != nil {
+			return err
 		}
+		defer sorter.Close()
 	}
 
-	return "", "", false, nil, fmt.Errorf("no index found")
-}
-
-func (e *Executor) runFullScan(req types.QueryConfig, where *types.Condition, writer io.Writer) error {
-	f, err := os.Open(req.CsvPath)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	reader := bufio.NewReader(f)
-
-	// Read header
-	headerLine, err := reader.ReadBytes('\n')
-	if err != nil {
-		return err
-	}
-
-	headers := strings.Split(string(bytes.TrimSpace(headerLine)), ",") // Simplified header parsing
-	// In reality we should use CSV parser for header to handle quotes
-	// But let's assume we can get headers properly or reuse schema
-
-	// Map headers
-	headerMap := make(map[string]int)
-	for i, h := range headers {
-		clean := strings.Trim(strings.TrimSpace(h), "\"")
-		headerMap[strings.ToLower(clean)] = i
+	var proj *projection
+	if rows != nil {
+		var err error
+		if proj, err = newProjection(req.Select, rows.column); err != nil {
+			return err
+		}
 	}
 
-	lineNum := int64(1)
-	currentOffset := int64(len(headerLine))
-
-	w := bufio.NewWriter(writer)
-	defer w.Flush()
-
 	count := int64(0)
 	skipped := 0
+	timer := &e.analysis.timer
 
-	// Prepare aggregator if relevant
-	var aggregator *StreamAggregator
-	var groupIdx = -1
-	var aggIdx = -1
-	if req.GroupBy != "" {
-		aggregator = NewStreamAggregator(req)
-		key := strings.ToLower(req.GroupBy)
-		if idx, ok := headerMap[key]; ok {
-			groupIdx = idx
-		}
-		if req.AggCol != "" {
-			if idx, ok := headerMap[strings.ToLower(req.AggCol)]; ok {
-				aggIdx = idx
-			}
-		}
-	}
-
-	rowMap := make(map[string]string)
+	for e.next(iter) {
+		rec := iter.Record()
 
-	for {
-		line, err := reader.ReadBytes('\n')
-		if err != nil {
-			if err == io.EOF {
-				if len(line) == 0 {
-					break
-				}
-			} else {
-				return err
+		if rows != nil {
+			t := timer.start()
+			row, ok := rows.rowAt(rec.Offset, rec.Line)
+			timer.stop(phaseFetch, t)
+			if !ok {
+				continue
 			}
-		}
-
-		rowOffset := currentOffset
-		currentOffset += int64(len(line))
-		lineNum++
-
-		trimmed := bytes.TrimSpace(line)
-		// Parse CSV line simply
-		// Optimization: Use extractCols from aggregator or similar
-		cols := parseCSVLine(string(trimmed)) // TODO: Optimize
-
-		// Apply updates
-		if e.Updates != nil {
-			if override := e.Updates.GetRow(lineNum); override != nil {
-				for col, val := range override {
-					if idx, ok := headerMap[col]; ok && idx < len(cols) {
-						cols[idx] = val
-					}
+			e.analysis.RowsFetched++
+
+			if where != nil {
+				t = timer.start()
+				matched := Evaluate(where, row)
+				timer.stop(phaseFilter, t)
+				if !matched {
+					e.analysis.RowsRejected++
+					continue
 				}
 			}
-		}
 
-		if where != nil {
-			// Populate rowMap
-			for k, idx := range headerMap {
-				if idx < len(cols) {
-					rowMap[k] = cols[idx]
+			if sorter != nil {
+				t = timer.start()
+				err := sorter.Add(rows.fields, rec.Offset, rec.Line)
+				timer.stop(phaseSort, t)
+				if err != nil {
+					return err
 				}
-			}
-			if !Evaluate(where, rowMap) {
 				continue
 			}
 		}
 
-		if aggregator != nil {
-			fmt.Fprintf(os.Stderr, "DEBUG: RowCols=%v GroupIdx=%d AggIdx=%d\n", cols, groupIdx, aggIdx)
-			if groupIdx >= 0 && groupIdx < len(cols) {
-				groupVal := cols[groupIdx]
-				var val float64
-				if aggIdx >= 0 && aggIdx < len(cols) {
-					val, _ = strconv.ParseFloat(cols[aggIdx], 64)
-				}
-				aggregator.Add(groupVal, val)
-			}
-			continue
-		}
-
 		if skipped < req.Offset {
 			skipped++
 			continue
 		}
 
 		count++
-
 		if !req.CountOnly {
-			fmt.Fprintf(w, "%d,%d\n", rowOffset, lineNum)
+			var values []interface{}
+			if proj != nil {
+				values = proj.extract(rows.fields)
+			}
+			if err := rw.Row(rec.Offset, rec.Line, values); err != nil {
+				return err
+			}
 		}
 
 		if req.Limit > 0 && count >= int64(req.Limit) {
@@ -398,218 +566,94 @@ func (e *Executor) runFullScan(req types.QueryConfig, where *types.Condition, wr
 		}
 	}
 
-	if aggregator != nil {
-		return aggregator.Finalize(w)
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	if sorter != nil {
+		return e.emitSorted(req, sorter, rows, proj, rw)
 	}
 
 	if req.CountOnly {
-		fmt.Fprintln(w, count)
+		return rw.Count(count)
 	}
 
 	return nil
 }
 
-func parseCSVLine(line string) []string {
-	// Simple split for now, real implementation should handle quotes
-	// Replacing with a proper parser call is recommended
-	return strings.Split(line, ",")
-}
-
-func (e *Executor) runStandardOutput(req types.QueryConfig, iter index.Iterator, hasSearchKey bool, searchKey string, where *types.Condition, writer io.Writer) error {
-	// Need to load CSV to retrieve actual data for filtering/displaying?
-	// If where is nil (covered), we might not need to load, but we output offset/line.
-	// Actually we output IndexRecord offset/line.
-	// But if where is NOT nil (partial cover or non-indexed filter), we MUST load row.
-
-	var csvF *os.File
-	var csvData []byte
-	defer func() {
-		if csvData != nil {
-			storage.MunmapFile(csvData)
-		}
-		if csvF != nil {
-			csvF.Close()
-		}
-	}()
-
-	ensureCsvLoaded := func() error {
-		if csvData != nil {
-			return nil
-		}
-		var err error
-		csvF, err = os.Open(req.CsvPath)
-		if err != nil {
-			return err
-		}
-		csvData, err = storage.MmapFile(csvF)
-		return err
-	}
-
-	// Need headers for filtering
-	// Using LoadSchema or parsing header again
-	var headerMap map[string]int
-	_ = headerMap // Helper placeholder
-	if where != nil {
-		if err := ensureCsvLoaded(); err != nil {
-			return err
-		}
-		// Parsing header from csvData ... logic omitted for brevity, assuming simple
-	}
-
-	w := bufio.NewWriter(writer)
-	defer w.Flush()
+// emitSorted writes the rows collected by sorter, applying OFFSET and LIMIT.
+// Selected values are read again from rows, since the sort only keeps the
+// row locations.
+func (e *Executor) emitSorted(req types.QueryConfig, sorter *externalSort, rows *rowSource, proj *projection, rw ResultWriter) error {
+	t := e.analysis.timer.start()
+	defer e.analysis.timer.stop(phaseSort, t)
 
 	count := int64(0)
 	skipped := 0
-	limitReached := false
-	searchKeyBytes := []byte(searchKey)
-
-	for iter.Next() {
-		rec := iter.Record()
-
-		// Secondary check for range (since iterator might go beyond)
-		if hasSearchKey {
-			// Iterator ensures >= searchKey, but we need to check if prefix still matches?
-			// DiskIndex implementation handles StartKey check, but records within block might exceed?
-			// The original logic checked `compareRecordKey`.
-			// DiskIndex iterator implementation handles block logic, but we should verify key match for exact lookups.
-			// Compare key prefix.
-			keyLen := 64
-			for keyLen > 0 && rec.Key[keyLen-1] == 0 {
-				keyLen--
-			}
-			slicedKey := rec.Key[:keyLen]
-			cmp := bytes.Compare(slicedKey, searchKeyBytes)
-			if cmp != 0 {
-				// Different key (e.g. range query or end of matching block)
-				// If we strictly want equality:
-				if cmp > 0 {
-					break
-				}
-			}
-		}
-
-		if where != nil {
-			if err := ensureCsvLoaded(); err != nil {
-				return err
-			}
-			// Load row and evaluate...
-			// logic similar to full scan
-		}
-
+	return sorter.Drain(rows, func(offset, line int64) (bool, error) {
 		if skipped < req.Offset {
 			skipped++
-			continue
+			return true, nil
 		}
-
 		count++
-		if !req.CountOnly {
-			fmt.Fprintf(w, "%d,%d\n", rec.Offset, rec.Line)
+		var values []interface{}
+		if proj != nil {
+			fields, _ := rows.fieldsAt(offset, line)
+			values = proj.extract(fields)
 		}
-
-		if req.Limit > 0 && count >= int64(req.Limit) {
-			limitReached = true
-			break
+		if err := rw.Row(offset, line, values); err != nil {
+			return false, err
 		}
-
-		if limitReached {
-			break
-		}
-	}
-
-	if req.CountOnly {
-		fmt.Fprintln(w, count)
-	}
-
-	return nil
+		return req.Limit <= 0 || count < int64(req.Limit), nil
+	})
 }
 
-func (e *Executor) runAggregation(req types.QueryConfig, iter index.Iterator, where *types.Condition, writer io.Writer) error {
-	var csvF *os.File
-	var csvData []byte
-	defer func() {
-		if csvData != nil {
-			storage.MunmapFile(csvData)
-		}
-		if csvF != nil {
-			csvF.Close()
-		}
-	}()
-
-	ensureCsvLoaded := func() error {
-		if csvData != nil {
-			return nil
-		}
-		var err error
-		csvF, err = os.Open(req.CsvPath)
-		if err != nil {
-			return err
-		}
-		csvData, err = storage.MmapFile(csvF)
-		return err
-	}
-
-	// We need header map to extract columns
-	// Simplified parsing for now
-	if err := ensureCsvLoaded(); err != nil {
+func (e *Executor) runAggregation(req types.QueryConfig, iter index.Iterator, where *types.Condition, rw ResultWriter) error {
+	data, release, err := e.Resources.MapFile(req.CsvPath)
+	if err != nil {
 		return err
 	}
-	// Extract header from first line
-	headerMap := make(map[string]int)
-	if idx := bytes.IndexByte(csvData, '\n'); idx > 0 {
-		headerLine := csvData[:idx]
-		if len(headerLine) > 0 && headerLine[len(headerLine)-1] == '\r' {
-			headerLine = headerLine[:len(headerLine)-1]
-		}
-		headers := strings.Split(string(headerLine), ",") // Simple split
-		for i, h := range headers {
-			clean := strings.Trim(strings.TrimSpace(h), "\"")
-			headerMap[strings.ToLower(clean)] = i
-		}
-	}
+	defer release()
+	rows := newRowSource(data, e.sep, e.Updates)
 
 	aggregator := NewStreamAggregator(req)
 
 	groupKey := strings.ToLower(req.GroupBy)
 	aggCol := strings.ToLower(req.AggCol)
-	groupIdx, ok := headerMap[groupKey]
-	if !ok {
+	groupIdx := rows.column(groupKey)
+	if groupIdx < 0 {
 		return fmt.Errorf("group by column not found: %s", groupKey)
 	}
 
 	aggIdx := -1
 	if aggCol != "" && req.AggFunc != "count" {
-		if idx, ok := headerMap[aggCol]; ok {
-			aggIdx = idx
-		}
+		aggIdx = rows.column(aggCol)
 	}
 
-	for iter.Next() {
+	timer := &e.analysis.timer
+	for e.next(iter) {
 		rec := iter.Record()
 
-		// Load row
-		if int(rec.Offset) >= len(csvData) {
+		t := timer.start()
+		cols, ok := rows.fieldsAt(rec.Offset, rec.Line)
+		timer.stop(phaseFetch, t)
+		if !ok {
 			continue
 		}
+		e.analysis.RowsFetched++
 
-		rowEnd := bytes.IndexByte(csvData[rec.Offset:], '\n')
-		if rowEnd == -1 {
-			rowEnd = len(csvData) - int(rec.Offset)
-		}
-		rowBytes := csvData[rec.Offset : int(rec.Offset)+rowEnd]
-		rowBytes = bytes.TrimSuffix(rowBytes, []byte{'\r'})
-
-		cols := parseCSVLine(string(rowBytes)) // Optimization needed here too
-
-		// Apply updates if needed
-		// ... (Updates logic same as standard output)
-
-		// Check where condition
 		if where != nil {
-			// Check logic
-			// ...
+			t = timer.start()
+			fillRow(rows.row, rows.headerMap, cols)
+			matched := Evaluate(where, rows.row)
+			timer.stop(phaseFilter, t)
+			if !matched {
+				e.analysis.RowsRejected++
+				continue
+			}
 		}
 
+		t = timer.start()
 		if groupIdx < len(cols) {
 			groupVal := cols[groupIdx]
 			var val float64
@@ -618,7 +662,12 @@ func (e *Executor) runAggregation(req types.QueryConfig, iter index.Iterator, wh
 			}
 			aggregator.Add(groupVal, val)
 		}
+		timer.stop(phaseAggregate, t)
+	}
+
+	if err := iter.Error(); err != nil {
+		return err
 	}
 
-	return aggregator.Finalize(writer)
+	return rw.Groups(aggregator.Result())
 }
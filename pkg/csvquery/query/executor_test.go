@@ -0,0 +1,177 @@
+package query
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/index"
+	"github.com/csvquery/csvquery/pkg/csvquery/types"
+)
+
+// collector keeps what a query reports.
+type collector struct {
+	rows   []collectedRow
+	count  int64
+	groups map[string]float64
+	plan   *Plan
+}
+
+type collectedRow struct {
+	offset, line int64
+	values       []string
+}
+
+func (c *collector) Row(offset, line int64, values []interface{}) error {
+	row := collectedRow{offset: offset, line: line}
+	for _, v := range values {
+		row.values = append(row.values, fmt.Sprint(v))
+	}
+	c.rows = append(c.rows, row)
+	return nil
+}
+
+func (c *collector) Count(n int64) error {
+	c.count = n
+	return nil
+}
+
+func (c *collector) Groups(groups map[string]float64) error {
+	c.groups = groups
+	return nil
+}
+
+func (c *collector) Plan(plan interface{}) error {
+	c.plan = plan.(*Plan)
+	return nil
+}
+
+func (c *collector) Finish(err error) error { return err }
+
+// lines returns the lines of the rows in the order they were reported.
+func (c *collector) lines() []int64 {
+	lines := make([]int64, len(c.rows))
+	for i, row := range c.rows {
+		lines[i] = row.line
+	}
+	return lines
+}
+
+// values returns the selected values of the rows, one string per row with
+// the values separated by commas.
+func (c *collector) values() []string {
+	var values []string
+	for _, row := range c.rows {
+		values = append(values, strings.Join(row.values, ","))
+	}
+	return values
+}
+
+// writeCSV writes content to name in dir and returns its path.
+func writeCSV(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// buildIndexes builds the indexes described by columns, a JSON array as in
+// the index action, for the CSV at csvPath into indexDir.
+func buildIndexes(t *testing.T, csvPath, indexDir, columns string, colTypes map[string]types.ColumnSpec) {
+	t.Helper()
+	manager := index.NewIndexManager(index.IndexerConfig{
+		InputFile: csvPath,
+		OutputDir: indexDir,
+		Columns:   columns,
+		Types:     colTypes,
+	})
+	if err := manager.Run(); err != nil {
+		t.Fatalf("failed to build indexes: %v", err)
+	}
+}
+
+// indexedCSV writes a CSV of rows rows, with a unique id, a status shared
+// by half of the rows, one of 50 countries and a price from 0 to 999, and
+// indexes every column.
+func indexedCSV(t *testing.T, rows int) (csvPath, indexDir string) {
+	t.Helper()
+	dir := t.TempDir()
+	var b strings.Builder
+	b.WriteString("id,status,country,price\n")
+	for i := 0; i < rows; i++ {
+		status := "active"
+		if i%2 == 1 {
+			status = "inactive"
+		}
+		fmt.Fprintf(&b, "%d,%s,C%d,%d\n", i, status, i%50, i%1000)
+	}
+	csvPath = writeCSV(t, dir, "data.csv", b.String())
+
+	price, err := types.ParseColumnSpec("int", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexDir = filepath.Join(dir, "indexes")
+	buildIndexes(t, csvPath, indexDir, `["id","status","country","price"]`, map[string]types.ColumnSpec{"price": price})
+	return csvPath, indexDir
+}
+
+// parseWhere parses a JSON condition, or returns nil for an empty one.
+func parseWhere(t *testing.T, where string) *types.Condition {
+	t.Helper()
+	if where == "" {
+		return nil
+	}
+	cond, err := ParseCondition([]byte(where))
+	if err != nil {
+		t.Fatalf("ParseCondition(%s): %v", where, err)
+	}
+	return cond
+}
+
+// runQuery runs req with the condition where, given as JSON, on an
+// executor with the pending updates of the CSV, as the query action does.
+func runQuery(t *testing.T, indexDir string, req types.QueryConfig, where string) *collector {
+	t.Helper()
+	c, err := tryQuery(indexDir, req, parseWhere(t, where))
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	return c
+}
+
+// tryQuery is runQuery that returns the error the query fails with.
+func tryQuery(indexDir string, req types.QueryConfig, where *types.Condition) (*collector, error) {
+	updates, err := LoadUpdates(req.CsvPath)
+	if err != nil {
+		return nil, err
+	}
+	c := &collector{}
+	return c, NewExecutor(indexDir, updates).Run(req, where, c)
+}
+
+// modify runs an update, with set, or else a delete of the rows matching
+// where, as the update and delete actions do, and returns the number of
+// rows affected.
+func modify(t *testing.T, indexDir string, req types.QueryConfig, where string, set map[string]string) int64 {
+	t.Helper()
+	updates, err := LoadUpdates(req.CsvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewExecutor(indexDir, updates)
+	var n int64
+	if set != nil {
+		n, err = e.Update(req, parseWhere(t, where), set)
+	} else {
+		n, err = e.Delete(req, parseWhere(t, where))
+	}
+	if err != nil {
+		t.Fatalf("modify failed: %v", err)
+	}
+	return n
+}
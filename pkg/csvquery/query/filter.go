@@ -1,10 +1,14 @@
 package query
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 
+	"github.com/csvquery/csvquery/pkg/csvquery/index"
 	"github.com/csvquery/csvquery/pkg/csvquery/types"
 )
 
@@ -44,7 +48,9 @@ func ParseCondition(data []byte) (*types.Condition, error) {
 }
 
 func ResolveTargets(c *types.Condition) {
-	if c.Value != nil {
+	if c.Operator == types.OpIn {
+		c.ResolvedTargets = inTargets(c.Value)
+	} else if c.Value != nil {
 		c.ResolvedTarget = fmt.Sprintf("%v", c.Value)
 	}
 	for i := range c.Children {
@@ -52,6 +58,87 @@ func ResolveTargets(c *types.Condition) {
 	}
 }
 
+// ResolveTypes decides how each range predicate compares: as the type
+// declared for its column or, for an undeclared column compared with a
+// number literal, as a decimal. Anything else compares as a string. It also
+// compiles LIKE and ILIKE patterns.
+func ResolveTypes(c *types.Condition, declared map[string]types.ColumnSpec) error {
+	if c == nil {
+		return nil
+	}
+	for i := range c.Children {
+		if err := ResolveTypes(&c.Children[i], declared); err != nil {
+			return err
+		}
+	}
+	if c.Operator == types.OpLike || c.Operator == types.OpILike {
+		pattern, err := types.CompileLike(c.ResolvedTarget, c.Escape, c.Operator == types.OpILike)
+		if err != nil {
+			return err
+		}
+		c.ResolvedLike = pattern
+		return nil
+	}
+	if !isRangeOp(c.Operator) {
+		return nil
+	}
+
+	spec, ok := declared[c.Column]
+	if !ok {
+		if !isNumberLiteral(c.Value) {
+			return nil
+		}
+		spec = types.ColumnSpec{Type: types.TypeDecimal}
+	}
+	c.ResolvedType = spec
+	c.ResolvedKey = nil
+	if spec.IsString() {
+		return nil
+	}
+
+	target := c.ResolvedTarget
+	if f, ok := c.Value.(float64); ok {
+		target = strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	key, ok := spec.AppendKey(nil, target)
+	if !ok {
+		return fmt.Errorf("cannot compare %s with %s: not a valid %s", c.Column, formatLiteral(c.Value), spec.Type)
+	}
+	c.ResolvedTarget = target
+	c.ResolvedKey = key
+	return nil
+}
+
+func isRangeOp(op types.FilterOp) bool {
+	switch op {
+	case types.OpGt, types.OpLt, types.OpGte, types.OpLte:
+		return true
+	}
+	return false
+}
+
+func isNumberLiteral(v interface{}) bool {
+	switch v.(type) {
+	case float64, json.Number, int, int64:
+		return true
+	}
+	return false
+}
+
+// compareValue compares a row value with the target of a range predicate.
+// It reports false if the value is not of the predicate's type.
+func compareValue(c *types.Condition, val string) (int, bool) {
+	if c.ResolvedKey == nil {
+		return strings.Compare(val, c.ResolvedTarget), true
+	}
+	var buf [32]byte
+	key, ok := c.ResolvedType.AppendKey(buf[:0], val)
+	if !ok {
+		return 0, false
+	}
+	return bytes.Compare(key, c.ResolvedKey), true
+}
+
 func Evaluate(c *types.Condition, row map[string]string) bool {
 	switch c.Operator {
 	case "AND":
@@ -68,6 +155,8 @@ func Evaluate(c *types.Condition, row map[string]string) bool {
 			}
 		}
 		return false
+	case "NOT":
+		return len(c.Children) == 1 && !Evaluate(&c.Children[0], row)
 	}
 
 	val, exists := row[c.Column]
@@ -88,16 +177,25 @@ func Evaluate(c *types.Condition, row map[string]string) bool {
 		return val == target
 	case types.OpNeq:
 		return val != target
-	case types.OpGt:
-		return val > target
-	case types.OpLt:
-		return val < target
-	case types.OpGte:
-		return val >= target
-	case types.OpLte:
-		return val <= target
-	case types.OpLike:
-		return strings.Contains(strings.ToLower(val), strings.ToLower(target))
+	case types.OpGt, types.OpLt, types.OpGte, types.OpLte:
+		cmp, ok := compareValue(c, val)
+		if !ok {
+			return false
+		}
+		switch c.Operator {
+		case types.OpGt:
+			return cmp > 0
+		case types.OpLt:
+			return cmp < 0
+		case types.OpGte:
+			return cmp >= 0
+		}
+		return cmp <= 0
+	case types.OpLike, types.OpILike:
+		return c.ResolvedLike != nil && c.ResolvedLike.Match(val)
+	case types.OpIn:
+		i := sort.SearchStrings(c.ResolvedTargets, val)
+		return i < len(c.ResolvedTargets) && c.ResolvedTargets[i] == val
 	}
 
 	return false
@@ -124,3 +222,218 @@ func ExtractIndexConditions(c *types.Condition) map[string]string {
 	}
 	return res
 }
+
+// ExtractInConditions returns the IN lists that restrict the whole
+// condition, keyed by column, as sorted and de-duplicated keys.
+func ExtractInConditions(c *types.Condition) map[string][]string {
+	res := make(map[string][]string)
+	if c.Operator == "AND" {
+		for _, child := range c.Children {
+			if child.Operator == types.OpIn {
+				res[child.Column] = inTargets(child.Value)
+			}
+		}
+	} else if c.Operator == types.OpIn {
+		res[c.Column] = inTargets(c.Value)
+	}
+	return res
+}
+
+// KeyRange is a key range of an index scan. Bound keys are values as they
+// appear in the CSV, compared as Type.
+type KeyRange struct {
+	Lower *index.Bound
+	Upper *index.Bound
+	Type  types.ColumnSpec
+
+	lowerKey, upperKey []byte
+}
+
+func (r KeyRange) bounded() bool {
+	return r.Lower != nil && r.Upper != nil
+}
+
+// String renders the range in interval notation for plans.
+func (r KeyRange) String() string {
+	lower, upper := "(-inf", "+inf)"
+	if r.Lower != nil {
+		lower = "(" + formatLiteral(r.Lower.Key)
+		if r.Lower.Inclusive {
+			lower = "[" + formatLiteral(r.Lower.Key)
+		}
+	}
+	if r.Upper != nil {
+		upper = formatLiteral(r.Upper.Key) + ")"
+		if r.Upper.Inclusive {
+			upper = formatLiteral(r.Upper.Key) + "]"
+		}
+	}
+	return lower + ", " + upper
+}
+
+// ExtractRangeConditions returns, per column, the tightest key range implied
+// by the range predicates and LIKE prefixes that restrict the whole
+// condition. The predicates of a range all compare as the same type; text
+// comparisons only qualify with targets short enough to compare exactly
+// against a truncated index key.
+func ExtractRangeConditions(c *types.Condition) map[string]KeyRange {
+	res := make(map[string]KeyRange)
+	tighten := func(col string, spec types.ColumnSpec, lower bool, b *index.Bound, key []byte) {
+		r, seen := res[col]
+		if !seen {
+			r.Type = spec
+		} else if !r.Type.SameAs(spec) {
+			return
+		}
+		if lower {
+			if cmp := bytes.Compare(key, r.lowerKey); r.Lower == nil || cmp > 0 || cmp == 0 && !b.Inclusive {
+				r.Lower, r.lowerKey = b, key
+			}
+		} else if cmp := bytes.Compare(key, r.upperKey); r.Upper == nil || cmp < 0 || cmp == 0 && !b.Inclusive {
+			r.Upper, r.upperKey = b, key
+		}
+		res[col] = r
+	}
+	add := func(c *types.Condition) {
+		if lower, upper, ok := likeRange(c); ok {
+			tighten(c.Column, types.ColumnSpec{}, true, lower, []byte(lower.Key))
+			if upper != nil {
+				tighten(c.Column, types.ColumnSpec{}, false, upper, []byte(upper.Key))
+			}
+			return
+		}
+		if !isIndexableRange(c) {
+			return
+		}
+		key := c.ResolvedKey
+		if key == nil {
+			key = []byte(c.ResolvedTarget)
+		}
+		b := &index.Bound{Key: c.ResolvedTarget, Inclusive: c.Operator == types.OpGte || c.Operator == types.OpLte}
+		tighten(c.Column, c.ResolvedType, c.Operator == types.OpGt || c.Operator == types.OpGte, b, key)
+	}
+	if c.Operator == "AND" {
+		for i := range c.Children {
+			add(&c.Children[i])
+		}
+	} else {
+		add(c)
+	}
+	return res
+}
+
+// isIndexableRange reports whether a range predicate can be answered by an
+// index whose keys compare like the predicate.
+func isIndexableRange(c *types.Condition) bool {
+	return isRangeOp(c.Operator) && (c.ResolvedKey != nil || len(c.ResolvedTarget) < types.KeySize)
+}
+
+// likeRange returns the key range holding every value a LIKE pattern with a
+// literal prefix can match. Prefixes longer than an index key are cut to its
+// length, as the keys are.
+func likeRange(c *types.Condition) (lower, upper *index.Bound, ok bool) {
+	if c.ResolvedLike == nil || c.ResolvedLike.Prefix() == "" {
+		return nil, nil, false
+	}
+	prefix := c.ResolvedLike.Prefix()
+	if len(prefix) > types.KeySize {
+		prefix = prefix[:types.KeySize]
+	}
+	lower = &index.Bound{Key: prefix, Inclusive: true}
+	if c.ResolvedLike.IsLiteral() {
+		return lower, lower, true
+	}
+	return lower, prefixEnd(prefix), true
+}
+
+// prefixEnd returns the exclusive upper bound of the keys starting with
+// prefix: the first string after all of them, or nil if there is none.
+func prefixEnd(prefix string) *index.Bound {
+	end := []byte(prefix)
+	for len(end) > 0 && end[len(end)-1] == 0xff {
+		end = end[:len(end)-1]
+	}
+	if len(end) == 0 {
+		return nil
+	}
+	end[len(end)-1]++
+	return &index.Bound{Key: string(end)}
+}
+
+// isCoveredLike reports whether the key range of a LIKE pattern matches
+// exactly the values the pattern does.
+func isCoveredLike(c *types.Condition) bool {
+	p := c.ResolvedLike
+	return p != nil && p.Prefix() != "" && len(p.Prefix()) < types.KeySize && (p.IsLiteral() || p.IsPrefixOnly())
+}
+
+// inTargets turns the value of an IN condition into sorted, unique strings.
+// A single non-list value is treated as a one-element list.
+func inTargets(v interface{}) []string {
+	var targets []string
+	switch list := v.(type) {
+	case nil:
+	case []interface{}:
+		for _, item := range list {
+			targets = append(targets, fmt.Sprintf("%v", item))
+		}
+	case []string:
+		targets = append(targets, list...)
+	default:
+		targets = append(targets, fmt.Sprintf("%v", v))
+	}
+	sort.Strings(targets)
+	out := targets[:0]
+	for i, t := range targets {
+		if i == 0 || t != targets[i-1] {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// FormatCondition renders a condition tree in SQL-like form for plans.
+func FormatCondition(c *types.Condition) string {
+	switch c.Operator {
+	case "AND", "OR":
+		parts := make([]string, len(c.Children))
+		for i := range c.Children {
+			parts[i] = FormatCondition(&c.Children[i])
+		}
+		if len(parts) == 1 {
+			return parts[0]
+		}
+		return "(" + strings.Join(parts, " "+string(c.Operator)+" ") + ")"
+	case "NOT":
+		if len(c.Children) == 1 {
+			return "NOT " + FormatCondition(&c.Children[0])
+		}
+	case types.OpIsNull, types.OpIsNotNull:
+		return c.Column + " " + string(c.Operator)
+	case types.OpLike, types.OpILike:
+		if c.Escape != "" {
+			return c.Column + " " + string(c.Operator) + " " + formatLiteral(c.Value) + " ESCAPE " + formatLiteral(c.Escape)
+		}
+	case types.OpIn:
+		var vals []string
+		if list, ok := c.Value.([]interface{}); ok {
+			for _, v := range list {
+				vals = append(vals, formatLiteral(v))
+			}
+		} else {
+			vals = append(vals, formatLiteral(c.Value))
+		}
+		return c.Column + " IN (" + strings.Join(vals, ", ") + ")"
+	}
+	return c.Column + " " + string(c.Operator) + " " + formatLiteral(c.Value)
+}
+
+func formatLiteral(v interface{}) string {
+	switch val := v.(type) {
+	case string:
+		return "'" + strings.ReplaceAll(val, "'", "''") + "'"
+	case nil:
+		return "NULL"
+	}
+	return fmt.Sprintf("%v", v)
+}
@@ -0,0 +1,124 @@
+package query
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/types"
+)
+
+func TestRangeComparison(t *testing.T) {
+	dateSpec := types.ColumnSpec{Type: types.TypeDate, Format: types.DefaultDateFormat}
+	tests := []struct {
+		name     string
+		where    string
+		declared map[string]types.ColumnSpec
+		match    []string
+		miss     []string
+	}{
+		{
+			name:  "number literal compares numerically",
+			where: `{"operator":">","column":"v","value":9}`,
+			match: []string{"10", "9.5", "100", " 10 "},
+			miss:  []string{"9", "9.0", "-10", "1", "09"},
+		},
+		{
+			name:  "number literal skips values that are not numbers",
+			where: `{"operator":"<","column":"v","value":9}`,
+			match: []string{"-1", "0", "8.99", "-100"},
+			miss:  []string{"", "abc", "NULL", "1e1", "9", "1,5"},
+		},
+		{
+			name:  "decimal scales",
+			where: `{"operator":">=","column":"v","value":0.1}`,
+			match: []string{"0.1", "0.10", ".1", "0.100000000000000000001", "1"},
+			miss:  []string{"0.09", "-0.1", "0", ""},
+		},
+		{
+			name:  "string literal compares lexicographically",
+			where: `{"operator":">","column":"v","value":"9"}`,
+			match: []string{"90", "abc", "9 "},
+			miss:  []string{"10", "100", "", "9", "-1"},
+		},
+		{
+			name:  "empty cells sort first as strings",
+			where: `{"operator":"<","column":"v","value":"a"}`,
+			match: []string{"", "9", "A"},
+			miss:  []string{"a", "b"},
+		},
+		{
+			name:     "declared int with a string literal",
+			where:    `{"operator":">","column":"v","value":"9"}`,
+			declared: map[string]types.ColumnSpec{"v": {Type: types.TypeInt}},
+			match:    []string{"10", "100", "+10"},
+			miss:     []string{"9", "-10", "9.5", "abc", ""},
+		},
+		{
+			name:     "declared float",
+			where:    `{"operator":"<=","column":"v","value":10}`,
+			declared: map[string]types.ColumnSpec{"v": {Type: types.TypeFloat}},
+			match:    []string{"1e1", "10.0", "-Inf", "-0", "9.99"},
+			miss:     []string{"10.01", "+Inf", "NaN", "x", ""},
+		},
+		{
+			name:     "declared date",
+			where:    `{"operator":">","column":"v","value":"2024-01-31"}`,
+			declared: map[string]types.ColumnSpec{"v": dateSpec},
+			match:    []string{"2024-02-01", "2025-01-01"},
+			miss:     []string{"2024-01-31", "2023-12-31", "2024-2-1", "2024-02-30", ""},
+		},
+		{
+			name:     "declared string with a number literal",
+			where:    `{"operator":">","column":"v","value":9}`,
+			declared: map[string]types.ColumnSpec{"v": {Type: types.TypeString}},
+			match:    []string{"90", "abc"},
+			miss:     []string{"10", "100", ""},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			cond, err := ParseCondition([]byte(tt.where))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ResolveTypes(cond, tt.declared); err != nil {
+				t.Fatalf("ResolveTypes: %v", err)
+			}
+			for _, v := range tt.match {
+				if !Evaluate(cond, map[string]string{"v": v}) {
+					t.Errorf("%q does not match %s", v, FormatCondition(cond))
+				}
+			}
+			for _, v := range tt.miss {
+				if Evaluate(cond, map[string]string{"v": v}) {
+					t.Errorf("%q matches %s", v, FormatCondition(cond))
+				}
+			}
+		})
+	}
+}
+
+func TestResolveTypesInvalidTarget(t *testing.T) {
+	tests := []struct {
+		where string
+		spec  types.ColumnSpec
+	}{
+		{`{"operator":">","column":"v","value":"abc"}`, types.ColumnSpec{Type: types.TypeInt}},
+		{`{"operator":">","column":"v","value":1.5}`, types.ColumnSpec{Type: types.TypeInt}},
+		{`{"operator":"<","column":"v","value":""}`, types.ColumnSpec{Type: types.TypeDecimal}},
+		{`{"operator":"<=","column":"v","value":"31/01/2024"}`, types.ColumnSpec{Type: types.TypeDate, Format: types.DefaultDateFormat}},
+	}
+
+	for _, tt := range tests {
+		cond, err := ParseCondition([]byte(tt.where))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ResolveTypes(cond, map[string]types.ColumnSpec{"v": tt.spec})
+		if err == nil || !strings.Contains(err.Error(), "not a valid "+string(tt.spec.Type)) {
+			t.Errorf("ResolveTypes(%s) as %s: error %v, want it to reject the literal", tt.where, tt.spec, err)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package query
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/parser"
+	"github.com/csvquery/csvquery/pkg/csvquery/types"
+)
+
+// heldRowsPerChunk bounds the matching rows a full scan worker holds back
+// while the chunks before its own are still being written.
+const heldRowsPerChunk = 1024
+
+// scanChunk is the state of one worker of a full scan. A worker only touches
+// its own chunk, so its row map, filter counters and partial aggregate need
+// no locking.
+type scanChunk struct {
+	cols     []string
+	row      map[string]string
+	agg      *StreamAggregator
+	out      chan scanMatch // matching rows, in file order, for the writer
+	count    int64
+	scanned  int64
+	rejected int64
+	err      error
+}
+
+type scanMatch struct {
+	offset, line int64
+	picked       []string
+}
+
+// runFullScan reads every row with the SIMD parser. Each worker filters and
+// aggregates the rows of one chunk of the file, and the chunks are merged in
+// file order, so OFFSET and LIMIT see rows in the same order as a sequential
+// scan would. Matching rows are written as they are found for the first
+// chunk not yet finished, and as soon as the chunks before them are for the
+// others, which hold back at most heldRowsPerChunk rows each.
+func (e *Executor) runFullScan(req types.QueryConfig, where *types.Condition, plan *Plan, rw ResultWriter) error {
+	data, release, err := e.Resources.MapFile(req.CsvPath)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	rows := newRowSource(data, e.sep, e.Updates)
+	scanner, err := parser.NewSIMDParserFromData(data, string(e.sep))
+	if err != nil {
+		return err
+	}
+	defer scanner.Close()
+	if e.scanWorkers > 0 {
+		scanner.SetWorkers(e.scanWorkers)
+	}
+
+	var sorter *externalSort
+	var sortMu sync.Mutex
+	if plan.Sort == SortExternal {
+		if sorter, err = newExternalSort(req, rows.column); err != nil {
+			return err
+		}
+		defer sorter.Close()
+	}
+
+	proj, err := newProjection(req.Select, rows.column)
+	if err != nil {
+		return err
+	}
+
+	groupIdx, aggIdx := -1, -1
+	if req.GroupBy != "" {
+		groupIdx = rows.column(req.GroupBy)
+		if req.AggCol != "" {
+			aggIdx = rows.column(req.AggCol)
+		}
+	}
+
+	// Without a sort or an aggregation, OFFSET + LIMIT rows are enough, and
+	// once one chunk holds that many, the chunks after it are not needed.
+	need := int64(-1)
+	if req.Limit > 0 && sorter == nil && req.GroupBy == "" {
+		need = int64(req.Offset + req.Limit)
+	}
+
+	stream := sorter == nil && req.GroupBy == "" && !req.CountOnly
+	chunks := make([]scanChunk, scanner.Workers())
+	for i := range chunks {
+		chunks[i].row = make(map[string]string)
+		if req.GroupBy != "" {
+			chunks[i].agg = NewStreamAggregator(req)
+		}
+		if stream {
+			chunks[i].out = make(chan scanMatch, heldRowsPerChunk)
+		}
+	}
+	// quit stops the workers once the writer needs no more rows
+	quit := make(chan struct{})
+	var lastChunk atomic.Int64
+	lastChunk.Store(int64(len(chunks)))
+	stopAfter := func(w int64) {
+		for {
+			cur := lastChunk.Load()
+			if w >= cur || lastChunk.CompareAndSwap(cur, w) {
+				return
+			}
+		}
+	}
+
+	t := e.analysis.timer.start()
+	scanned := make(chan error, 1)
+	go func() {
+		scanned <- scanner.ScanRecords(func(w int, fields [][]byte, offset, line int64) bool {
+			if int64(w) > lastChunk.Load() {
+				return false
+			}
+			c := &chunks[w]
+			c.scanned++
+			if e.Updates.IsDeleted(line) {
+				return true
+			}
+
+			c.cols = c.cols[:0]
+			for _, f := range fields {
+				c.cols = append(c.cols, string(f))
+			}
+			e.Updates.apply(c.cols, rows.headerMap, line)
+
+			if where != nil {
+				fillRow(c.row, rows.headerMap, c.cols)
+				if !Evaluate(where, c.row) {
+					c.rejected++
+					return true
+				}
+			}
+
+			if c.agg != nil {
+				if groupIdx >= 0 && groupIdx < len(c.cols) {
+					var val float64
+					if aggIdx >= 0 && aggIdx < len(c.cols) {
+						val, _ = strconv.ParseFloat(c.cols[aggIdx], 64)
+					}
+					c.agg.Add(c.cols[groupIdx], val)
+				}
+				return true
+			}
+
+			if sorter != nil {
+				sortMu.Lock()
+				err := sorter.Add(c.cols, offset, line)
+				sortMu.Unlock()
+				if err != nil {
+					c.err = err
+					stopAfter(-1)
+					return false
+				}
+				return true
+			}
+
+			c.count++
+			if stream {
+				select {
+				case c.out <- scanMatch{offset: offset, line: line, picked: proj.pick(c.cols)}:
+				case <-quit:
+					return false
+				}
+			}
+			if c.count == need {
+				stopAfter(int64(w))
+				return false
+			}
+			return true
+		}, func(w int) {
+			if stream {
+				close(chunks[w].out)
+			}
+		})
+	}()
+
+	var writeErr error
+	if stream {
+		writeErr = e.writeChunks(req, chunks, proj, rw)
+	}
+	close(quit)
+	err = <-scanned
+	e.analysis.timer.stop(phaseFetch, t)
+	if err != nil {
+		return err
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+
+	for i := range chunks {
+		c := &chunks[i]
+		if c.err != nil {
+			return c.err
+		}
+		e.analysis.RowsScanned += c.scanned
+		e.analysis.RowsFetched += c.scanned
+		e.analysis.RowsRejected += c.rejected
+	}
+
+	if req.GroupBy != "" {
+		t := e.analysis.timer.start()
+		agg := chunks[0].agg
+		for i := 1; i < len(chunks); i++ {
+			agg.Merge(chunks[i].agg)
+		}
+		e.analysis.timer.stop(phaseAggregate, t)
+		return rw.Groups(agg.Result())
+	}
+
+	if sorter != nil {
+		return e.emitSorted(req, sorter, rows, proj, rw)
+	}
+
+	if !req.CountOnly {
+		return nil
+	}
+	var total int64
+	for i := range chunks {
+		total += chunks[i].count
+	}
+	return rw.Count(total)
+}
+
+// writeChunks writes the matching rows of the chunks in file order, after
+// OFFSET and up to LIMIT, as the workers send them. It returns once every
+// chunk is written or LIMIT is reached.
+func (e *Executor) writeChunks(req types.QueryConfig, chunks []scanChunk, proj *projection, rw ResultWriter) error {
+	count := int64(0)
+	skipped := 0
+	for i := range chunks {
+		for m := range chunks[i].out {
+			if skipped < req.Offset {
+				skipped++
+				continue
+			}
+			count++
+			if err := rw.Row(m.offset, m.line, proj.typed(m.picked)); err != nil {
+				return err
+			}
+			if req.Limit > 0 && count >= int64(req.Limit) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/types"
+)
+
+func TestFullScanOrder(t *testing.T) {
+	const rows = 10000
+	dir := t.TempDir()
+	var b strings.Builder
+	b.WriteString("id,mod\n")
+	for i := 0; i < rows; i++ {
+		fmt.Fprintf(&b, "%d,%d\n", i, i%3)
+	}
+	csvPath := writeCSV(t, dir, "data.csv", b.String())
+	// A third of the rows match, one every 3 lines
+	const where = `{"operator":"=","column":"mod","value":"0"}`
+	var matching []int64
+	for i := int64(0); i < rows; i += 3 {
+		matching = append(matching, i+2)
+	}
+
+	tests := []struct {
+		limit, offset int
+	}{
+		{limit: 10},
+		{limit: 10, offset: 5},
+		// Across the first chunk boundary, with 4 chunks of 2500 rows
+		{limit: 20, offset: 825},
+		{limit: 2000, offset: 100},
+		{offset: 3000},
+		{limit: 100, offset: 3300},
+		{limit: 100, offset: 4000},
+		{},
+	}
+
+	for _, workers := range []int{1, 4, 7} {
+		for _, tt := range tests {
+			req := types.QueryConfig{CsvPath: csvPath, Select: []string{"id"}, Limit: tt.limit, Offset: tt.offset}
+			updates, err := LoadUpdates(csvPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e := NewExecutor("", updates)
+			e.scanWorkers = workers
+			c := &collector{}
+			if err := e.Run(req, parseWhere(t, where), c); err != nil {
+				t.Fatalf("query failed: %v", err)
+			}
+
+			want := matching[min(tt.offset, len(matching)):]
+			if tt.limit > 0 {
+				want = want[:min(tt.limit, len(want))]
+			}
+			if got := c.lines(); fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("%d workers, limit %d, offset %d: %d lines %v..., want %d lines %v...",
+					workers, tt.limit, tt.offset, len(got), got[:min(len(got), 5)], len(want), want[:min(len(want), 5)])
+			}
+			for i, row := range c.rows {
+				if id := fmt.Sprint(c.lines()[i] - 2); row.values[0] != id {
+					t.Fatalf("line %d has id %s", row.line, row.values[0])
+				}
+			}
+		}
+	}
+}
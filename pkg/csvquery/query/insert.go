@@ -0,0 +1,195 @@
+package query
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/index"
+	"github.com/csvquery/csvquery/pkg/csvquery/storage"
+	"github.com/csvquery/csvquery/pkg/csvquery/types"
+)
+
+// Insert appends rows, given as column values keyed by lower-cased column
+// name, to the CSV and adds their records to the deltas of its indexes in
+// indexDir, so that index scans return them until the indexes are built
+// again. Columns a row leaves out are empty.
+// It returns the number of rows inserted.
+//
+// Insert holds the exclusive lock of the CSV, so requests never see the new
+// rows without their index records.
+func Insert(csvPath, indexDir string, rows []map[string]string) (int64, error) {
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	lock, err := storage.LockExclusive(csvPath)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Unlock()
+
+	if indexDir == "" {
+		indexDir = filepath.Dir(csvPath)
+	}
+	meta, _ := index.LoadMeta(indexDir, csvPath)
+	sep := meta.CsvSeparator()
+	headerMap, err := readHeader(csvPath, sep[0])
+	if err != nil {
+		return 0, err
+	}
+	if len(headerMap) == 0 {
+		return 0, fmt.Errorf("csv has no header: %s", csvPath)
+	}
+	records := make([][]string, len(rows))
+	for i, row := range rows {
+		record := make([]string, len(headerMap))
+		for col, val := range row {
+			pos, ok := headerMap[col]
+			if !ok {
+				return 0, fmt.Errorf("column not found: %s", col)
+			}
+			record[pos] = val
+		}
+		records[i] = record
+	}
+
+	stat, err := os.Stat(csvPath)
+	if err != nil {
+		return 0, err
+	}
+	start, end, err := storage.NewCsvWriter(storage.WriterConfig{CsvPath: csvPath, Separator: sep}).Append(nil, records)
+	if err != nil {
+		return 0, err
+	}
+	if err := indexAppended(csvPath, indexDir, meta, headerMap, stat.Size(), start, end); err != nil {
+		return 0, fmt.Errorf("rows inserted, but indexing them failed: %w", err)
+	}
+	return int64(len(rows)), nil
+}
+
+// readHeader maps the lower-cased columns of the CSV's header, split on
+// sep, to their positions.
+func readHeader(csvPath string, sep byte) (map[string]int, error) {
+	f, err := os.Open(csvPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := storage.MmapFile(f)
+	if err != nil {
+		return nil, err
+	}
+	defer storage.MunmapFile(data)
+	headerMap := make(map[string]int)
+	parseHeader(data, sep, headerMap)
+	return headerMap, nil
+}
+
+// indexAppended adds the rows between the offsets start and end of the CSV
+// to the deltas of its indexes in indexDir, which meta describes. The CSV
+// ended at from before, which is start unless a line break was added first.
+func indexAppended(csvPath, indexDir string, meta *types.IndexMeta, headerMap map[string]int, from, start, end int64) error {
+	csvName := strings.TrimSuffix(filepath.Base(csvPath), filepath.Ext(csvPath))
+	paths, _ := filepath.Glob(filepath.Join(indexDir, csvName+"_*.cidx"))
+	sort.Strings(paths)
+
+	type target struct {
+		path    string
+		keyType types.ColumnSpec
+		cols    []int
+		records []types.IndexRecord
+	}
+	var targets []*target
+	for _, path := range paths {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), csvName+"_"), ".cidx")
+		cols := indexDefinition(name, meta, headerMap)
+		if cols == nil {
+			// The index of another CSV whose name starts like this one
+			continue
+		}
+		t := &target{path: path, cols: make([]int, len(cols))}
+		for i, col := range cols {
+			t.cols[i] = headerMap[col]
+		}
+		idx, err := index.OpenDiskIndex(path)
+		if err != nil {
+			return err
+		}
+		t.keyType = idx.KeyType()
+		idx.Close()
+		targets = append(targets, t)
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+
+	f, err := os.Open(csvPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data, err := storage.MmapFile(f)
+	if err != nil {
+		return err
+	}
+	defer storage.MunmapFile(data)
+	if end > int64(len(data)) {
+		return fmt.Errorf("csv is shorter than the inserted rows")
+	}
+
+	line, err := firstAppendedLine(data, from, meta, targets[0].path, targets[0].keyType)
+	if err != nil {
+		return err
+	}
+	var fields []string
+	for offset := start; offset < end; {
+		next := min(recordEnd(data, offset)+1, end)
+		if record := recordAt(data, offset); len(record) > 0 {
+			fields = splitFields(record, meta.CsvSeparator()[0], fields[:0])
+			for _, t := range targets {
+				rec := types.IndexRecord{Offset: offset, Line: line}
+				index.EncodeKey(&rec.Key, t.keyType, indexKey(fields, t.cols))
+				t.records = append(t.records, rec)
+			}
+			line++
+		}
+		offset = next
+	}
+
+	for _, t := range targets {
+		if err := index.AppendDelta(t.path, from, end, line, t.records); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// firstAppendedLine returns the line number of the first row appended at
+// offset start, where the CSV ended. The delta of the index at indexPath or the
+// index metadata know it if the CSV ended where they say it did; otherwise
+// the rows before start are counted.
+func firstAppendedLine(data []byte, start int64, meta *types.IndexMeta, indexPath string, keyType types.ColumnSpec) (int64, error) {
+	delta, err := index.LoadDelta(indexPath, keyType)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case delta != nil && delta.CsvEnd == start:
+		return delta.NextLine, nil
+	case delta == nil && meta != nil && meta.CsvSize == start:
+		return meta.TotalRows + 2, nil
+	}
+
+	// Records are numbered like the SIMD parser does, see lineOffsets
+	line := int64(2)
+	for offset := recordEnd(data, 0) + 1; offset < start; {
+		end := recordEnd(data, offset)
+		if len(recordAt(data, offset)) > 0 {
+			line++
+		}
+		offset = end + 1
+	}
+	return line, nil
+}
@@ -0,0 +1,110 @@
+package query
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/index"
+	"github.com/csvquery/csvquery/pkg/csvquery/types"
+)
+
+func TestInsertIndexed(t *testing.T) {
+	// Enough rows for lookups of one id to use the index
+	const rows = 5000
+	quoted := `o"brien, "jr"`
+	tests := []struct {
+		name, lineBreak string
+		trailing        bool
+	}{
+		{"trailing newline", "\n", true},
+		{"no trailing newline", "\n", false},
+		{"crlf without a trailing newline", "\r\n", false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			var b strings.Builder
+			b.WriteString("id,name,city")
+			for i := 1; i <= rows; i++ {
+				fmt.Fprintf(&b, "%s%d,name%d,city%d", tt.lineBreak, i, i, i%10)
+			}
+			if tt.trailing {
+				b.WriteString(tt.lineBreak)
+			}
+			csvPath := writeCSV(t, dir, "data.csv", b.String())
+			buildIndexes(t, csvPath, dir, `["id","name"]`, nil)
+
+			n, err := Insert(csvPath, dir, []map[string]string{
+				{"id": "5001", "name": quoted, "city": "oslo"},
+				{"id": "5002", "name": "dave"},
+			})
+			if err != nil {
+				t.Fatalf("Insert: %v", err)
+			}
+			if n != 2 {
+				t.Fatalf("inserted %d rows, want 2", n)
+			}
+
+			req := types.QueryConfig{CsvPath: csvPath, Select: []string{"id", "name", "city"}}
+			check := func(when string, deltas bool) {
+				t.Helper()
+				lookups := []struct {
+					where string
+					line  int64
+					want  string
+				}{
+					{`{"operator":"=","column":"id","value":"5000"}`, 5001, "5000,name5000,city0"},
+					{`{"operator":"=","column":"id","value":"5001"}`, 5002, "5001," + quoted + ",oslo"},
+					{`{"operator":"=","column":"name","value":"o\"brien, \"jr\""}`, 5002, "5001," + quoted + ",oslo"},
+					{`{"operator":"=","column":"id","value":"5002"}`, 5003, "5002,dave,<nil>"},
+				}
+				for _, l := range lookups {
+					explain := req
+					explain.Explain = true
+					plan := runQuery(t, dir, explain, l.where).plan
+					if plan.Strategy != StrategyIndexScan {
+						t.Fatalf("%s: %s runs as %s, want an index scan", when, l.where, plan.Strategy)
+					}
+					if got := plan.DeltaRecords > 0; got != deltas && l.line > rows+1 {
+						t.Fatalf("%s: %s merges %d delta records", when, l.where, plan.DeltaRecords)
+					}
+					rows := runQuery(t, dir, req, l.where)
+					if got := rows.values(); !reflect.DeepEqual(got, []string{l.want}) {
+						t.Fatalf("%s: %s returned %q, want %q", when, l.where, got, l.want)
+					}
+					if got := rows.lines(); got[0] != l.line {
+						t.Fatalf("%s: %s returned line %d, want %d", when, l.where, got[0], l.line)
+					}
+				}
+
+				// The last rows of a full scan
+				scan := req
+				scan.Offset = rows - 1
+				all := runQuery(t, "", scan, "")
+				want := []string{"5000,name5000,city0", "5001," + quoted + ",oslo", "5002,dave,<nil>"}
+				if got := all.values(); !reflect.DeepEqual(got, want) {
+					t.Fatalf("%s: full scan returned %q, want %q", when, got, want)
+				}
+				if got := all.lines(); !reflect.DeepEqual(got, []int64{5001, 5002, 5003}) {
+					t.Fatalf("%s: full scan returned lines %v", when, got)
+				}
+			}
+
+			check("before the rebuild", true)
+			manager := index.NewIndexManager(index.IndexerConfig{
+				InputFile: csvPath,
+				OutputDir: dir,
+				Columns:   `["id","name"]`,
+				Full:      true,
+			})
+			if err := manager.Run(); err != nil {
+				t.Fatalf("rebuild: %v", err)
+			}
+			check("after the rebuild", false)
+		})
+	}
+}
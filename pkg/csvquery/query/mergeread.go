@@ -0,0 +1,150 @@
+package query
+
+import (
+	"bytes"
+	"maps"
+	"sort"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/index"
+	"github.com/csvquery/csvquery/pkg/csvquery/types"
+)
+
+// mergeUpdates merges the rows in plan.updatedLines into the records of iter.
+// Their index records hold the values from before the update, so they are
+// dropped; each of those rows is checked against where with its updates
+// applied instead, and the ones that match are merged into the stream in the
+// iterator's order under the key of their updated values.
+func (e *Executor) mergeUpdates(req types.QueryConfig, iter index.Iterator, plan *Plan, where *types.Condition) (index.Iterator, error) {
+	data, release, err := e.Resources.MapFile(req.CsvPath)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	rows := newRowSource(data, e.sep, e.Updates)
+
+	keyCols := make([]int, len(plan.indexCols))
+	for i, col := range plan.indexCols {
+		keyCols[i] = rows.column(col)
+	}
+
+	m := &updateMergeIterator{
+		iter:  iter,
+		stale: make(map[int64]bool, len(plan.updatedLines)),
+		less:  lessByKey,
+	}
+	switch {
+	case plan.Strategy == StrategyIndexInList, plan.Strategy == StrategyIndexIntersect, plan.Strategy == StrategyIndexUnion:
+		m.less = lessByOffset
+	case plan.reverse:
+		m.less = func(a, b *types.IndexRecord) bool { return lessByKey(b, a) }
+	}
+
+	// Deleted rows are only dropped; the updated ones are read again
+	var updated []int64
+	for _, line := range plan.updatedLines {
+		m.stale[line] = true
+		if !e.Updates.IsDeleted(line) {
+			updated = append(updated, line)
+		}
+	}
+	offsets, unknown := e.Updates.rowOffsets(updated)
+	if len(unknown) > 0 {
+		// Updates logged before offsets were recorded are found by line number
+		maps.Copy(offsets, rows.lineOffsets(unknown))
+	}
+	for _, line := range updated {
+		offset, ok := offsets[line]
+		if !ok {
+			continue
+		}
+		row, ok := rows.rowAt(offset, line)
+		if !ok || where != nil && !Evaluate(where, row) {
+			continue
+		}
+		rec := types.IndexRecord{Offset: offset, Line: line}
+		index.EncodeKey(&rec.Key, plan.keyType, indexKey(rows.fields, keyCols))
+		m.extra = append(m.extra, rec)
+	}
+	sort.Slice(m.extra, func(i, j int) bool { return m.less(&m.extra[i], &m.extra[j]) })
+	return m, nil
+}
+
+// indexKey builds the key the indexer stores for a row: the value of a
+// single column, or the values of several as a JSON-like array.
+func indexKey(fields []string, cols []int) []byte {
+	value := func(col int) string {
+		if col >= 0 && col < len(fields) {
+			return fields[col]
+		}
+		return ""
+	}
+	if len(cols) == 1 {
+		return []byte(value(cols[0]))
+	}
+	key := []byte{'['}
+	for i, col := range cols {
+		if i > 0 {
+			key = append(key, ',')
+		}
+		key = append(key, '"')
+		key = append(key, value(col)...)
+		key = append(key, '"')
+	}
+	return append(key, ']')
+}
+
+func lessByKey(a, b *types.IndexRecord) bool {
+	if cmp := bytes.Compare(a.Key[:], b.Key[:]); cmp != 0 {
+		return cmp < 0
+	}
+	return a.Offset < b.Offset
+}
+
+func lessByOffset(a, b *types.IndexRecord) bool {
+	return a.Offset < b.Offset
+}
+
+// updateMergeIterator drops the stale records of iter and merges in extra,
+// which is sorted by less like the records of iter are.
+type updateMergeIterator struct {
+	iter  index.Iterator
+	stale map[int64]bool
+	extra []types.IndexRecord
+	less  func(a, b *types.IndexRecord) bool
+
+	head    types.IndexRecord // next record of iter, if hasHead
+	hasHead bool
+	done    bool
+	current types.IndexRecord
+}
+
+func (m *updateMergeIterator) Next() bool {
+	for !m.hasHead && !m.done {
+		if !m.iter.Next() {
+			m.done = true
+		} else if rec := m.iter.Record(); !m.stale[rec.Line] {
+			m.head, m.hasHead = rec, true
+		}
+	}
+	switch {
+	case m.hasHead && (len(m.extra) == 0 || !m.less(&m.extra[0], &m.head)):
+		m.current, m.hasHead = m.head, false
+	case len(m.extra) > 0 && m.iter.Error() == nil:
+		m.current, m.extra = m.extra[0], m.extra[1:]
+	default:
+		return false
+	}
+	return true
+}
+
+func (m *updateMergeIterator) Record() types.IndexRecord {
+	return m.current
+}
+
+func (m *updateMergeIterator) Close() {
+	m.iter.Close()
+}
+
+func (m *updateMergeIterator) Error() error {
+	return m.iter.Error()
+}
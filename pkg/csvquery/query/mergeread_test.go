@@ -0,0 +1,203 @@
+package query
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/types"
+)
+
+// TestIndexReadsMergeUpdates checks that index reads drop the records of
+// deleted and updated rows and merge the updated rows back in under their
+// new keys, in key order or offset order as the strategy reads them.
+func TestIndexReadsMergeUpdates(t *testing.T) {
+	csvPath, indexDir := indexedCSV(t, 5000)
+	req := types.QueryConfig{CsvPath: csvPath}
+	modify(t, indexDir, req, `{"operator":"=","column":"id","value":"995"}`, map[string]string{"price": "10"})
+	modify(t, indexDir, req, `{"operator":"=","column":"id","value":"3"}`, map[string]string{"price": "997"})
+	modify(t, indexDir, req, `{"operator":"=","column":"id","value":"4"}`, map[string]string{"price": "1000"})
+	modify(t, indexDir, req, `{"operator":"=","column":"id","value":"5"}`, map[string]string{"price": "999"})
+	modify(t, indexDir, req, `{"operator":"=","column":"id","value":"1996"}`, nil)
+
+	tests := []struct {
+		name     string
+		where    string
+		order    []types.OrderColumn
+		limit    int
+		strategy string
+		want     []string
+	}{
+		{
+			name:     "range in key order",
+			where:    `{"operator":">=","column":"price","value":996}`,
+			strategy: StrategyIndexRange,
+			want: []string{
+				"996,996", "2996,996", "3996,996", "4996,996",
+				"3,997", "997,997", "1997,997", "2997,997", "3997,997", "4997,997",
+				"998,998", "1998,998", "2998,998", "3998,998", "4998,998",
+				"5,999", "999,999", "1999,999", "2999,999", "3999,999", "4999,999",
+				"4,1000",
+			},
+		},
+		{
+			name:     "descending index order",
+			order:    []types.OrderColumn{{Column: "price", Desc: true}},
+			limit:    8,
+			strategy: StrategyIndexOrder,
+			want:     []string{"4,1000", "4999,999", "3999,999", "2999,999", "1999,999", "999,999", "5,999", "4998,998"},
+		},
+		{
+			name:     "lookup of a moved key",
+			where:    `{"operator":"=","column":"price","value":"10"}`,
+			strategy: StrategyIndexScan,
+			want:     []string{"10,10", "995,10", "1010,10", "2010,10", "3010,10", "4010,10"},
+		},
+		{
+			name:     "IN list in offset order",
+			where:    `{"operator":"IN","column":"id","value":["4000","1996","995","3"]}`,
+			strategy: StrategyIndexInList,
+			want:     []string{"3,997", "995,10", "4000,0"},
+		},
+		{
+			name:     "union in offset order",
+			where:    `{"operator":"OR","children":[{"operator":"=","column":"id","value":"3"},{"operator":">=","column":"price","value":999}]}`,
+			strategy: StrategyIndexUnion,
+			want:     []string{"3,997", "4,1000", "5,999", "999,999", "1999,999", "2999,999", "3999,999", "4999,999"},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			req := types.QueryConfig{CsvPath: csvPath, Select: []string{"id", "price"}, OrderBy: tt.order, Limit: tt.limit}
+			explain := req
+			explain.Explain = true
+			if plan := runQuery(t, indexDir, explain, tt.where).plan; plan.Strategy != tt.strategy || plan.MergedUpdates == 0 {
+				t.Fatalf("strategy = %s merging %d updates, want %s merging some", plan.Strategy, plan.MergedUpdates, tt.strategy)
+			}
+			if got := runQuery(t, indexDir, req, tt.where).values(); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("rows = %q\nwant %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// sliceIterator iterates over records in the order given.
+type sliceIterator struct {
+	records []types.IndexRecord
+	current types.IndexRecord
+}
+
+func (it *sliceIterator) Next() bool {
+	if len(it.records) == 0 {
+		return false
+	}
+	it.current, it.records = it.records[0], it.records[1:]
+	return true
+}
+
+func (it *sliceIterator) Record() types.IndexRecord { return it.current }
+func (it *sliceIterator) Close()                    {}
+func (it *sliceIterator) Error() error              { return nil }
+
+func TestUpdateMergeIterator(t *testing.T) {
+	// rec makes a record of line, at offset 10 times line, with key
+	rec := func(key string, line int64) types.IndexRecord {
+		r := types.IndexRecord{Offset: line * 10, Line: line}
+		copy(r.Key[:], key)
+		return r
+	}
+	tests := []struct {
+		name    string
+		byKey   bool
+		records []types.IndexRecord
+		stale   []int64
+		extra   []types.IndexRecord
+		want    []string
+	}{
+		{
+			name:    "key moved forward",
+			byKey:   true,
+			records: []types.IndexRecord{rec("a", 1), rec("b", 2), rec("c", 3)},
+			stale:   []int64{1},
+			extra:   []types.IndexRecord{rec("d", 1)},
+			want:    []string{"b@2", "c@3", "d@1"},
+		},
+		{
+			name:    "key moved back",
+			byKey:   true,
+			records: []types.IndexRecord{rec("b", 1), rec("c", 2), rec("d", 3)},
+			stale:   []int64{3},
+			extra:   []types.IndexRecord{rec("a", 3)},
+			want:    []string{"a@3", "b@1", "c@2"},
+		},
+		{
+			name:    "equal keys by offset",
+			byKey:   true,
+			records: []types.IndexRecord{rec("a", 1), rec("b", 2), rec("b", 4)},
+			stale:   []int64{1},
+			extra:   []types.IndexRecord{rec("b", 1), rec("b", 3), rec("b", 5)},
+			want:    []string{"b@1", "b@2", "b@3", "b@4", "b@5"},
+		},
+		{
+			name:    "deleted rows",
+			byKey:   true,
+			records: []types.IndexRecord{rec("a", 1), rec("b", 2), rec("c", 3)},
+			stale:   []int64{1, 3},
+			want:    []string{"b@2"},
+		},
+		{
+			name:    "everything deleted",
+			byKey:   true,
+			records: []types.IndexRecord{rec("a", 1), rec("b", 2)},
+			stale:   []int64{1, 2},
+		},
+		{
+			name:  "only updated rows",
+			byKey: true,
+			extra: []types.IndexRecord{rec("a", 2), rec("b", 1)},
+			want:  []string{"a@2", "b@1"},
+		},
+		{
+			name:    "offset order",
+			records: []types.IndexRecord{rec("z", 1), rec("a", 3), rec("m", 5)},
+			stale:   []int64{3},
+			extra:   []types.IndexRecord{rec("x", 2), rec("b", 3), rec("a", 6)},
+			want:    []string{"z@1", "x@2", "b@3", "m@5", "a@6"},
+		},
+		{
+			name:    "offset order with a deleted row",
+			records: []types.IndexRecord{rec("a", 1), rec("a", 2), rec("a", 3)},
+			stale:   []int64{2, 3},
+			extra:   []types.IndexRecord{rec("b", 3)},
+			want:    []string{"a@1", "b@3"},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			m := &updateMergeIterator{
+				iter:  &sliceIterator{records: tt.records},
+				stale: make(map[int64]bool),
+				extra: tt.extra,
+				less:  lessByOffset,
+			}
+			if tt.byKey {
+				m.less = lessByKey
+			}
+			for _, line := range tt.stale {
+				m.stale[line] = true
+			}
+			var got []string
+			for m.Next() {
+				r := m.Record()
+				got = append(got, fmt.Sprintf("%s@%d", r.Key[:1], r.Line))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("records = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
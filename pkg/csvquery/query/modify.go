@@ -0,0 +1,108 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/types"
+)
+
+// Update sets columns of every row matching where, on top of earlier
+// updates, and saves the updates file. It returns the number of rows
+// updated.
+func (e *Executor) Update(req types.QueryConfig, where *types.Condition, set map[string]string) (int64, error) {
+	if len(set) == 0 {
+		return 0, fmt.Errorf("update requires at least one column to set")
+	}
+	if e.Updates == nil {
+		return 0, fmt.Errorf("update requires an updates file")
+	}
+	values := make(map[string]string, len(set))
+	for col, val := range set {
+		values[strings.ToLower(col)] = val
+	}
+	if err := e.checkColumns(req, values); err != nil {
+		return 0, err
+	}
+
+	lines, offsets, err := e.matchingLines(req, where)
+	if err != nil {
+		return 0, err
+	}
+	for i, line := range lines {
+		e.Updates.Set(line, offsets[i], values)
+	}
+	return int64(len(lines)), e.save(lines)
+}
+
+// Delete records a tombstone for every row matching where and saves the
+// updates file. It returns the number of rows deleted.
+func (e *Executor) Delete(req types.QueryConfig, where *types.Condition) (int64, error) {
+	if e.Updates == nil {
+		return 0, fmt.Errorf("delete requires an updates file")
+	}
+	lines, _, err := e.matchingLines(req, where)
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range lines {
+		e.Updates.Delete(line)
+	}
+	return int64(len(lines)), e.save(lines)
+}
+
+func (e *Executor) save(lines []int64) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	return e.Updates.Save()
+}
+
+// checkColumns fails if values sets a column the CSV header does not have.
+func (e *Executor) checkColumns(req types.QueryConfig, values map[string]string) error {
+	data, release, err := e.Resources.MapFile(req.CsvPath)
+	if err != nil {
+		return err
+	}
+	defer release()
+	rows := newRowSource(data, e.separator(req.CsvPath), nil)
+	for col := range values {
+		if rows.column(col) < 0 {
+			return fmt.Errorf("column not found: %s", col)
+		}
+	}
+	return nil
+}
+
+// matchingLines runs where as a plain row query, with pending updates
+// applied and deleted rows skipped, and returns the lines it matches and
+// their offsets.
+func (e *Executor) matchingLines(req types.QueryConfig, where *types.Condition) ([]int64, []int64, error) {
+	req.Select, req.OrderBy = nil, nil
+	req.GroupBy, req.AggCol, req.AggFunc = "", "", ""
+	req.CountOnly, req.Explain, req.Analyze = false, false, false
+	req.Limit, req.Offset = 0, 0
+
+	lc := &lineCollector{}
+	if err := e.Run(req, where, lc); err != nil {
+		return nil, nil, err
+	}
+	return lc.lines, lc.offsets, nil
+}
+
+// lineCollector is a ResultWriter that keeps the lines and offsets of the
+// rows a query returns.
+type lineCollector struct {
+	lines, offsets []int64
+}
+
+func (c *lineCollector) Row(offset, line int64, values []interface{}) error {
+	c.lines = append(c.lines, line)
+	c.offsets = append(c.offsets, offset)
+	return nil
+}
+
+func (c *lineCollector) Count(n int64) error                    { return nil }
+func (c *lineCollector) Groups(groups map[string]float64) error { return nil }
+func (c *lineCollector) Plan(plan interface{}) error            { return nil }
+func (c *lineCollector) Finish(err error) error                 { return err }
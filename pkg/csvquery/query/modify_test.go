@@ -0,0 +1,94 @@
+package query
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/types"
+)
+
+// TestPendingChangesVisible checks that every way of answering a query
+// applies the pending deletes and updates of the CSV.
+func TestPendingChangesVisible(t *testing.T) {
+	const rows = 5000
+	csvPath, indexDir := indexedCSV(t, rows)
+	req := types.QueryConfig{CsvPath: csvPath}
+
+	// Rows of C4 are all active
+	if n := modify(t, indexDir, req, `{"operator":"=","column":"country","value":"C4"}`, nil); n != rows/50 {
+		t.Fatalf("deleted %d rows, want %d", n, rows/50)
+	}
+	if n := modify(t, indexDir, req, `{"operator":"=","column":"id","value":"10"}`, map[string]string{"status": "archived"}); n != 1 {
+		t.Fatalf("updated %d rows, want 1", n)
+	}
+
+	counts := []struct {
+		where string
+		want  int64
+	}{
+		{"", rows - rows/50},
+		{`{"operator":"=","column":"status","value":"active"}`, rows/2 - rows/50 - 1},
+		{`{"operator":"=","column":"status","value":"inactive"}`, rows / 2},
+		{`{"operator":"=","column":"status","value":"archived"}`, 1},
+		{`{"operator":"=","column":"country","value":"C4"}`, 0},
+		{`{"operator":"=","column":"id","value":"4"}`, 0},
+		{`{"operator":">=","column":"price","value":950}`, 250 - 5},
+	}
+	for _, c := range counts {
+		countReq := types.QueryConfig{CsvPath: csvPath, CountOnly: true}
+		if got := runQuery(t, indexDir, countReq, c.where).count; got != c.want {
+			t.Errorf("count where %s = %d, want %d", c.where, got, c.want)
+		}
+	}
+
+	lookups := []struct {
+		where string
+		want  []string
+	}{
+		{`{"operator":"=","column":"id","value":"4"}`, nil},
+		{`{"operator":"=","column":"id","value":"10"}`, []string{"10,archived,C10"}},
+		{`{"operator":"IN","column":"id","value":["3","4","10","54"]}`, []string{"3,inactive,C3", "10,archived,C10"}},
+		{`{"operator":"=","column":"status","value":"archived"}`, []string{"10,archived,C10"}},
+	}
+	for _, l := range lookups {
+		lookupReq := types.QueryConfig{CsvPath: csvPath, Select: []string{"id", "status", "country"}}
+		explain := lookupReq
+		explain.Explain = true
+		if plan := runQuery(t, indexDir, explain, l.where).plan; plan.Strategy == StrategyFullScan {
+			t.Fatalf("%s runs as a full scan", l.where)
+		}
+		if got := runQuery(t, indexDir, lookupReq, l.where).values(); !reflect.DeepEqual(got, l.want) {
+			t.Errorf("%s returned %q, want %q", l.where, got, l.want)
+		}
+	}
+
+	scan := runQuery(t, "", types.QueryConfig{CsvPath: csvPath, Select: []string{"id", "status", "country"}}, "")
+	if len(scan.rows) != rows-rows/50 {
+		t.Fatalf("full scan returned %d rows, want %d", len(scan.rows), rows-rows/50)
+	}
+	for _, row := range scan.values() {
+		if strings.HasSuffix(row, ",C4") || strings.HasPrefix(row, "10,") && row != "10,archived,C10" {
+			t.Fatalf("full scan returned %q", row)
+		}
+	}
+
+	groups := []struct {
+		where string
+		want  map[string]float64
+	}{
+		{"", map[string]float64{"active": rows/2 - rows/50 - 1, "inactive": rows / 2, "archived": 1}},
+		{`{"operator":"IN","column":"country","value":["C4","C10","C11"]}`, map[string]float64{"active": rows/50 - 1, "inactive": rows / 50, "archived": 1}},
+	}
+	for _, g := range groups {
+		groupReq := types.QueryConfig{CsvPath: csvPath, GroupBy: "status", AggFunc: "count"}
+		explain := groupReq
+		explain.Explain = true
+		if plan := runQuery(t, indexDir, explain, g.where).plan; g.where != "" && plan.Strategy == StrategyFullScan {
+			t.Fatalf("group by where %s runs as a full scan", g.where)
+		}
+		if got := runQuery(t, indexDir, groupReq, g.where).groups; !reflect.DeepEqual(got, g.want) {
+			t.Errorf("groups where %s = %v, want %v", g.where, got, g.want)
+		}
+	}
+}
@@ -0,0 +1,1081 @@
+package query
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/index"
+	"github.com/csvquery/csvquery/pkg/csvquery/types"
+)
+
+// Strategies reported in Plan.Strategy
+const (
+	StrategyCount          = "Count"
+	StrategyFullScan       = "Full Scan"
+	StrategyIndexScan      = "Index Scan"
+	StrategyGroupByIndex   = "GroupBy Index Scan"
+	StrategyIndexOrder     = "Index Order Scan"
+	StrategyIndexInList    = "Index Multi-Key Lookup"
+	StrategyIndexRange     = "Index Range Scan"
+	StrategyIndexIntersect = "Index Intersection"
+	StrategyIndexUnion     = "Index Union"
+)
+
+// rejectedFullScan is why an index that costs more than a full scan is not
+// used
+const rejectedFullScan = "a full scan is cheaper"
+
+// maxSubsetColumns is the most equality columns whose every subset is
+// looked up as an index name
+const maxSubsetColumns = 8
+
+// How a plan satisfies ORDER BY, reported in Plan.Sort
+const (
+	SortIndexOrder = "Index Order"
+	SortExternal   = "External Sort"
+)
+
+// Plan describes how a query is executed. It is what EXPLAIN returns.
+type Plan struct {
+	Strategy           string           `json:"strategy"`
+	Index              string           `json:"index,omitempty"`
+	SearchKey          string           `json:"searchKey,omitempty"`
+	SearchKeys         []string         `json:"searchKeys,omitempty"`
+	Range              string           `json:"range,omitempty"`
+	KeyType            string           `json:"keyType,omitempty"`
+	Parts              []IndexLookup    `json:"parts,omitempty"`    // lookups of an Index Intersection
+	Branches           []IndexLookup    `json:"branches,omitempty"` // lookups of an Index Union
+	Candidates         []IndexCandidate `json:"candidates"`
+	CoveredPredicates  []string         `json:"coveredPredicates"`
+	ResidualPredicates []string         `json:"residualPredicates"`
+	EstimatedRows      int64            `json:"estimatedRows"`
+	TotalRows          int64            `json:"totalRows,omitempty"`
+	Cost               float64          `json:"cost"`
+	FullScan           *CostEstimate    `json:"fullScan,omitempty"` // the plan without indexes, for comparison
+	MergedUpdates      int              `json:"mergedUpdates,omitempty"`
+	DeltaRecords       int              `json:"deltaRecords,omitempty"`
+	OrderBy            string           `json:"orderBy,omitempty"`
+	Sort               string           `json:"sort,omitempty"`
+	Staleness          *Staleness       `json:"staleness,omitempty"`
+	Tree               *PlanNode        `json:"tree"`
+	Analysis           *Analysis        `json:"analysis,omitempty"`
+
+	indexPath    string
+	hasSearchKey bool
+	reverse      bool // scan the index in descending key order
+	coveredCols  map[string]string
+	inColumn     string // column of the IN list answered by SearchKeys
+	keyRange     *KeyRange
+	read         indexRead        // what the access path reads from its indexes
+	union        *types.Condition // the OR an Index Union reads the rows of
+	unionCovered bool             // every branch of union is answered by its lookup
+	matches      int64            // estimated rows left after the residual filter
+	sortCost     float64          // part of Cost spent on the external sort
+	keyType      types.ColumnSpec // key type of the chosen index
+	rangeColumn  string
+	residual     *types.Condition
+	indexCols    []string        // columns of the chosen index, in key order
+	updatedLines []int64         // lines whose pending updates change indexed columns
+	delta        *index.MemIndex // records of rows inserted since the index was built
+	deltaErr     error
+}
+
+// IndexCandidate is an index the planner looked at.
+type IndexCandidate struct {
+	Index    string        `json:"index"`
+	Exists   bool          `json:"exists"`
+	Chosen   bool          `json:"chosen"`
+	Rejected string        `json:"rejected,omitempty"`
+	Estimate *CostEstimate `json:"estimate,omitempty"`
+}
+
+// IndexLookup is one lookup of an Index Intersection or one branch of an
+// Index Union, which may itself be an intersection or a union.
+type IndexLookup struct {
+	Strategy      string        `json:"strategy"`
+	Index         string        `json:"index,omitempty"`
+	SearchKey     string        `json:"searchKey,omitempty"`
+	SearchKeys    []string      `json:"searchKeys,omitempty"`
+	Range         string        `json:"range,omitempty"`
+	KeyType       string        `json:"keyType,omitempty"`
+	Parts         []IndexLookup `json:"parts,omitempty"`
+	Branches      []IndexLookup `json:"branches,omitempty"`
+	Predicates    []string      `json:"residualPredicates,omitempty"` // checked per row, for a branch
+	EstimatedRows int64         `json:"estimatedRows"`
+
+	plan   *Plan // the lookup, planned as if it ran alone
+	actual int64 // records it returned, for EXPLAIN ANALYZE
+}
+
+// newLookup describes the lookup planned by p, which produces rows rows.
+func newLookup(p *Plan, rows int64) IndexLookup {
+	return IndexLookup{
+		Strategy:      p.Strategy,
+		Index:         p.Index,
+		SearchKey:     p.SearchKey,
+		SearchKeys:    p.SearchKeys,
+		Range:         p.Range,
+		KeyType:       p.KeyType,
+		Parts:         p.Parts,
+		Branches:      p.Branches,
+		EstimatedRows: rows,
+		plan:          p,
+	}
+}
+
+// name names the indexes of the lookup, like a condition.
+func (l *IndexLookup) name() string {
+	var names []string
+	switch {
+	case len(l.Parts) > 0:
+		for i := range l.Parts {
+			names = append(names, l.Parts[i].name())
+		}
+		return strings.Join(names, " & ")
+	case len(l.Branches) > 0:
+		for i := range l.Branches {
+			names = append(names, l.Branches[i].name())
+		}
+		return "(" + strings.Join(names, " | ") + ")"
+	}
+	return l.Index
+}
+
+// accessPath is one way of reading the rows of a query through an index.
+type accessPath struct {
+	cand     int    // position in Plan.Candidates
+	label    string // names the path when others are rejected for it
+	read     indexRead
+	estimate CostEstimate
+	apply    func(plan *Plan)
+}
+
+// PlanNode is one operator of the plan tree. Rows flow from the leaves up.
+type PlanNode struct {
+	Operation     string      `json:"operation"`
+	Index         string      `json:"index,omitempty"`
+	Key           string      `json:"key,omitempty"`
+	Predicates    []string    `json:"predicates,omitempty"`
+	EstimatedRows int64       `json:"estimatedRows"`
+	ActualRows    *int64      `json:"actualRows,omitempty"`
+	Children      []*PlanNode `json:"children,omitempty"`
+}
+
+func (e *Executor) buildPlan(req types.QueryConfig, where *types.Condition) *Plan {
+	plan := &Plan{
+		Strategy:           StrategyFullScan,
+		Candidates:         []IndexCandidate{},
+		CoveredPredicates:  []string{},
+		ResidualPredicates: []string{},
+		residual:           where,
+	}
+
+	var meta *types.IndexMeta
+	e.stale = nil
+	if e.IndexDir != "" {
+		meta, _ = index.LoadMeta(e.IndexDir, req.CsvPath)
+		plan.Staleness, meta = e.checkStaleness(req, meta)
+	}
+	if meta != nil {
+		plan.TotalRows = meta.TotalRows
+	}
+
+	if req.CountOnly && where == nil && req.GroupBy == "" {
+		plan.Strategy = StrategyCount
+		plan.EstimatedRows = plan.TotalRows
+		plan.Tree = &PlanNode{Operation: StrategyCount, EstimatedRows: plan.TotalRows}
+		return plan
+	}
+
+	m := newCostModel(req, where, meta)
+	e.findBestIndex(req, where, plan, m)
+	if plan.indexPath != "" {
+		plan.keyType = e.indexKeyType(plan.indexPath)
+		if !plan.keyType.IsString() {
+			plan.KeyType = plan.keyType.String()
+		}
+	}
+	for i := range plan.Parts {
+		plan.DeltaRecords += e.prepareLookup(&plan.Parts[i], nil)
+	}
+
+	if len(req.OrderBy) > 0 && req.GroupBy == "" && !req.CountOnly {
+		e.planOrder(req, plan, m)
+	}
+
+	if plan.indexPath != "" {
+		if plan.delta, plan.deltaErr = index.LoadDelta(plan.indexPath, plan.keyType); plan.delta != nil {
+			plan.DeltaRecords = plan.delta.Len()
+		}
+	}
+
+	// Index records of rows whose indexed columns have pending updates are
+	// stale; those rows are merged in at read time
+	if plan.indexPath != "" || len(plan.Parts) > 0 || len(plan.Branches) > 0 {
+		plan.updatedLines = e.Updates.linesTouching(plan.indexCols)
+		plan.MergedUpdates = len(plan.updatedLines)
+	}
+
+	var covered []types.Condition
+	switch plan.Strategy {
+	case StrategyIndexScan, StrategyIndexInList, StrategyIndexRange, StrategyIndexIntersect, StrategyIndexUnion:
+		covered, plan.residual = splitCovered(where, plan.covers)
+	}
+	if covered != nil {
+		for i := range covered {
+			plan.CoveredPredicates = append(plan.CoveredPredicates, FormatCondition(&covered[i]))
+		}
+	}
+	if plan.residual != nil {
+		plan.ResidualPredicates = append(plan.ResidualPredicates, FormatCondition(plan.residual))
+	}
+
+	plan.Tree = plan.buildTree(req)
+	return plan
+}
+
+// prepareLookup completes the lookup l, planned by findBestIndex, with the
+// key types and deltas of its indexes and, given the condition it was
+// planned for, the predicates it leaves to be checked per row. It returns
+// the number of delta records the lookup reads.
+func (e *Executor) prepareLookup(l *IndexLookup, where *types.Condition) int {
+	p := l.plan
+	deltas := 0
+	if p.indexPath != "" {
+		p.keyType = e.indexKeyType(p.indexPath)
+		if !p.keyType.IsString() {
+			p.KeyType = p.keyType.String()
+			l.KeyType = p.KeyType
+		}
+		if p.delta, p.deltaErr = index.LoadDelta(p.indexPath, p.keyType); p.delta != nil {
+			deltas = p.delta.Len()
+		}
+	}
+	for i := range p.Parts {
+		deltas += e.prepareLookup(&p.Parts[i], nil)
+	}
+	if where != nil {
+		_, p.residual = splitCovered(where, p.covers)
+		if p.residual != nil {
+			l.Predicates = []string{FormatCondition(p.residual)}
+		}
+	}
+	return deltas
+}
+
+// findBestIndex fills in the index part of plan with the cheapest way to run
+// the query: one of the indexes that answer its predicates, or a full scan.
+// Every index it looked at is recorded with its estimate and why it was not
+// used.
+func (e *Executor) findBestIndex(req types.QueryConfig, where *types.Condition, plan *Plan, m *costModel) {
+	csvName := strings.TrimSuffix(filepath.Base(req.CsvPath), filepath.Ext(req.CsvPath))
+	seen := make(map[string]bool)
+	var paths []accessPath
+
+	consider := func(indexName string) (string, bool) {
+		indexPath := filepath.Join(e.IndexDir, csvName+"_"+indexName+".cidx")
+		_, err := os.Stat(indexPath)
+		exists := err == nil
+		seen[indexName] = true
+		cand := IndexCandidate{Index: indexName, Exists: exists}
+		if !exists {
+			cand.Rejected = "index file not found"
+		}
+		plan.Candidates = append(plan.Candidates, cand)
+		return indexPath, exists
+	}
+	add := func(read indexRead, ok bool, apply func(plan *Plan)) {
+		cand := len(plan.Candidates) - 1
+		if !ok {
+			plan.Candidates[cand].Rejected = "index cannot be opened"
+			return
+		}
+		paths = append(paths, accessPath{cand: cand, label: "index " + plan.Candidates[cand].Index, read: read, apply: apply})
+	}
+	// lookupKey looks up the values of conds on cols, in key order, in an index
+	lookupKey := func(indexName, indexPath string, cols []string, conds map[string]string) {
+		searchKey := compositeSearchKey(cols, conds)
+		read, ok := e.costLookup(m, indexPath, indexName, []string{searchKey}, cols)
+		add(read, ok, func(plan *Plan) {
+			plan.Strategy = StrategyIndexScan
+			plan.Index = indexName
+			plan.indexPath = indexPath
+			plan.hasSearchKey = true
+			plan.SearchKey = searchKey
+			plan.indexCols = cols
+			plan.coveredCols = make(map[string]string, len(cols))
+			for _, col := range cols {
+				plan.coveredCols[col] = conds[col]
+			}
+		})
+	}
+
+	if where != nil {
+		conds := ExtractIndexConditions(where)
+		if len(conds) > 0 {
+			var cols []string
+			for col := range conds {
+				cols = append(cols, col)
+			}
+			sort.Strings(cols)
+
+			// Indexes on any subset of the equality columns, widest first.
+			// Missing indexes are only reported for the prefixes.
+			for _, currentCols := range columnSubsets(cols) {
+				currentCols := currentCols
+				indexName := strings.Join(currentCols, "_")
+				if !slices.Equal(currentCols, cols[:len(currentCols)]) {
+					if _, err := os.Stat(filepath.Join(e.IndexDir, csvName+"_"+indexName+".cidx")); err != nil {
+						continue
+					}
+				}
+				if indexPath, ok := consider(indexName); ok {
+					lookupKey(indexName, indexPath, currentCols, conds)
+				}
+			}
+		}
+	}
+
+	// Composite indexes recorded in _meta.json with their columns answer
+	// equality on any leftmost prefix of them, narrowed by a range on the
+	// column after it, whatever order the columns are in
+	if where != nil && m.meta != nil {
+		conds := ExtractIndexConditions(where)
+		ranges := ExtractRangeConditions(where)
+		var names []string
+		for name, stats := range m.meta.Indexes {
+			if len(stats.Columns) > 1 && !seen[name] {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			name := name
+			def := m.meta.Indexes[name].Columns
+			// The equality columns of the query that lead the index, and their values
+			var prefix, vals []string
+			for _, col := range def {
+				queryCol, ok := findColumn(conds, col)
+				if !ok {
+					break
+				}
+				prefix = append(prefix, queryCol)
+				vals = append(vals, conds[queryCol])
+			}
+			if len(prefix) == len(def) {
+				if indexPath, ok := consider(name); ok {
+					lookupKey(name, indexPath, prefix, conds)
+				}
+				continue
+			}
+			var next *KeyRange
+			if col, ok := findColumn(ranges, def[len(prefix)]); ok && ranges[col].Type.IsString() {
+				r := ranges[col]
+				next = &r
+			}
+			if len(prefix) == 0 && next == nil {
+				continue
+			}
+			indexPath, ok := consider(name)
+			if !ok {
+				continue
+			}
+			if len(compositePrefix(vals)) >= types.KeySize {
+				// Keys cut short may hold other values of the prefix
+				prefix = nil
+			}
+			r := compositeRange(vals, next)
+			read, ok := e.costRange(m, indexPath, r, prefix)
+			add(read, ok, func(plan *Plan) {
+				plan.Strategy = StrategyIndexRange
+				plan.Index = name
+				plan.indexPath = indexPath
+				plan.keyRange = &r
+				plan.indexCols = def
+				plan.Range = r.String()
+				plan.coveredCols = make(map[string]string, len(prefix))
+				for _, col := range prefix {
+					plan.coveredCols[col] = conds[col]
+				}
+			})
+		}
+	}
+
+	// An IN list on an indexed column becomes one lookup per key
+	if where != nil {
+		lists := ExtractInConditions(where)
+		var cols []string
+		for col := range lists {
+			cols = append(cols, col)
+		}
+		sort.Strings(cols)
+		for _, col := range cols {
+			col := col
+			if seen[col] {
+				continue
+			}
+			indexPath, ok := consider(col)
+			if !ok {
+				continue
+			}
+			read, ok := e.costLookup(m, indexPath, col, lists[col], []string{col})
+			add(read, ok, func(plan *Plan) {
+				plan.Strategy = StrategyIndexInList
+				plan.Index = col
+				plan.indexPath = indexPath
+				plan.inColumn = col
+				plan.indexCols = []string{col}
+				plan.SearchKeys = lists[col]
+			})
+		}
+	}
+
+	// A range predicate on an indexed column scans just that key range
+	if where != nil {
+		ranges := ExtractRangeConditions(where)
+		var cols []string
+		for col := range ranges {
+			cols = append(cols, col)
+		}
+		sort.Strings(cols)
+		for _, col := range cols {
+			col := col
+			if seen[col] {
+				continue
+			}
+			indexPath, ok := consider(col)
+			if !ok {
+				continue
+			}
+			r := ranges[col]
+			if keyType := e.indexKeyType(indexPath); !keyType.SameAs(r.Type) {
+				plan.Candidates[len(plan.Candidates)-1].Rejected = "index keys compare as " + keyType.String() + ", the range as " + r.Type.String()
+				continue
+			}
+			read, ok := e.costRange(m, indexPath, r, []string{col})
+			if ok {
+				m.known[col] = read.rows
+			}
+			add(read, ok, func(plan *Plan) {
+				plan.Strategy = StrategyIndexRange
+				plan.Index = col
+				plan.indexPath = indexPath
+				plan.keyRange = &r
+				plan.rangeColumn = col
+				plan.indexCols = []string{col}
+				plan.Range = r.String()
+			})
+		}
+	}
+
+	// An OR whose branches can all use indexes reads the union of their rows
+	if where != nil {
+		for _, c := range conjuncts(where) {
+			if c.Operator == "OR" {
+				e.planUnion(req, c, plan, m, func(read indexRead, used []string, apply func(plan *Plan)) {
+					for _, name := range used {
+						seen[name] = true
+					}
+					cand := len(plan.Candidates) - 1
+					paths = append(paths, accessPath{cand: cand, label: "the union " + plan.Candidates[cand].Index, read: read, apply: apply})
+				})
+			}
+		}
+	}
+
+	if groupName := strings.ReplaceAll(req.GroupBy, ",", "_"); req.GroupBy != "" && !seen[groupName] {
+		if indexPath, ok := consider(groupName); ok {
+			read, ok := e.costWalk(m, indexPath, false)
+			add(read, ok, func(plan *Plan) {
+				plan.Strategy = StrategyGroupByIndex
+				plan.Index = groupName
+				plan.indexPath = indexPath
+				plan.indexCols = strings.Split(strings.ToLower(req.GroupBy), ",")
+			})
+		}
+	}
+
+	// Costs are estimated once every index has told the model what it knows
+	// about the rows of the CSV and the predicates on its column
+	for i := range paths {
+		est := m.indexScan(paths[i].read)
+		paths[i].estimate = est
+		plan.Candidates[paths[i].cand].Estimate = &est
+	}
+	full := m.fullScan()
+	plan.FullScan = &full
+	plan.Cost = full.Cost
+	plan.EstimatedRows = full.Rows
+	plan.matches = full.Matches
+	plan.sortCost = full.sort
+
+	// Cheapest first; on a tie the wider index, which was considered first
+	sort.SliceStable(paths, func(i, j int) bool {
+		return paths[i].estimate.Cost < paths[j].estimate.Cost
+	})
+	var single *accessPath
+	for i := range paths {
+		if _, stale := e.stale[plan.Candidates[paths[i].cand].Index]; !stale && paths[i].estimate.Cost <= full.Cost {
+			single = &paths[i]
+			break
+		}
+	}
+	parts, inter := e.bestIntersection(m, paths, plan)
+	useInter := parts != nil && inter.Cost < full.Cost && (single == nil || inter.Cost < single.estimate.Cost)
+
+	best, winner := full.Cost, ""
+	switch {
+	case useInter:
+		plan.Strategy = StrategyIndexIntersect
+		reads := make([]indexRead, len(parts))
+		names := make([]string, len(parts))
+		for i, p := range parts {
+			part := &Plan{}
+			paths[p].apply(part)
+			plan.Parts = append(plan.Parts, newLookup(part, paths[p].estimate.Rows))
+			plan.indexCols = append(plan.indexCols, part.indexCols...)
+			reads[i] = paths[p].read
+			names[i] = plan.Parts[i].name()
+		}
+		best, winner = inter.Cost, "the intersection of "+strings.Join(names, ", ")
+		plan.read = m.intersectRead(reads)
+		plan.Cost = inter.Cost
+		plan.EstimatedRows = inter.Rows
+		plan.matches = inter.Matches
+		plan.sortCost = inter.sort
+	case single != nil:
+		best, winner = single.estimate.Cost, single.label
+		single.apply(plan)
+		plan.read = single.read
+		plan.Cost = single.estimate.Cost
+		plan.EstimatedRows = single.estimate.Rows
+		plan.matches = single.estimate.Matches
+		plan.sortCost = single.estimate.sort
+	}
+
+	for i := range paths {
+		p := &paths[i]
+		cand := &plan.Candidates[p.cand]
+		reason, stale := e.stale[cand.Index]
+		switch {
+		case stale:
+			cand.Rejected = "index is stale: " + reason
+			// Only stale indexes the plan would have used matter to the policy
+			if p.estimate.Cost < best || p.estimate.Cost == best && winner == "" {
+				plan.Staleness.skip(cand.Index)
+			}
+		case useInter && slices.Contains(parts, i), !useInter && p == single:
+			cand.Chosen = true
+		case p.estimate.Cost > full.Cost:
+			cand.Rejected = rejectedFullScan
+		default:
+			cand.Rejected = winner + " is cheaper"
+		}
+	}
+
+	// Report the remaining indexes on disk so EXPLAIN shows the full picture.
+	if e.IndexDir != "" {
+		matches, _ := filepath.Glob(filepath.Join(e.IndexDir, csvName+"_*.cidx"))
+		for _, m := range matches {
+			name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(m), csvName+"_"), ".cidx")
+			if seen[name] {
+				continue
+			}
+			plan.Candidates = append(plan.Candidates, IndexCandidate{
+				Index:    name,
+				Exists:   true,
+				Rejected: "columns do not match any equality, IN or range predicate",
+			})
+		}
+	}
+}
+
+// planUnion plans the OR c as the union of the rows of its branches, each
+// planned like a where of its own, and passes the union to add with the
+// candidate added for it and the indexes its branches use. It gives up if a branch cannot use an index, as
+// reading the rows of the others would save nothing over a full scan then.
+func (e *Executor) planUnion(req types.QueryConfig, c *types.Condition, plan *Plan, m *costModel, add func(read indexRead, used []string, apply func(plan *Plan))) {
+	// LIMIT, ORDER BY and the output apply to the union, not to a branch
+	branchReq := req
+	branchReq.Limit, branchReq.Offset, branchReq.OrderBy, branchReq.GroupBy, branchReq.Select = 0, 0, nil, "", nil
+
+	var branches []IndexLookup
+	var reads []indexRead
+	var indexCols, used, skipped []string
+	covered := true
+	deltas := 0
+	for i := range c.Children {
+		branch := &c.Children[i]
+		sub := &Plan{Strategy: StrategyFullScan, residual: branch}
+		if plan.Staleness != nil {
+			sub.Staleness = &Staleness{Policy: plan.Staleness.Policy, Stale: plan.Staleness.Stale}
+		}
+		e.findBestIndex(branchReq, branch, sub, newCostModel(branchReq, branch, m.meta))
+		if sub.Strategy == StrategyFullScan {
+			return
+		}
+		lookup := newLookup(sub, sub.EstimatedRows)
+		deltas += e.prepareLookup(&lookup, branch)
+		branches = append(branches, lookup)
+		reads = append(reads, sub.read)
+		indexCols = append(indexCols, sub.indexCols...)
+		covered = covered && sub.residual == nil
+		for _, cand := range sub.Candidates {
+			if cand.Chosen {
+				used = append(used, cand.Index)
+			}
+		}
+		if sub.Staleness != nil {
+			skipped = append(skipped, sub.Staleness.Skipped...)
+		}
+	}
+
+	read := m.unionRead(reads)
+	if covered {
+		read.conds = []*types.Condition{c}
+	}
+	names := IndexLookup{Branches: branches}
+	plan.Candidates = append(plan.Candidates, IndexCandidate{Index: names.name(), Exists: true})
+	add(read, used, func(plan *Plan) {
+		plan.Strategy = StrategyIndexUnion
+		plan.Branches = branches
+		plan.indexCols = indexCols
+		plan.union = c
+		plan.unionCovered = covered
+		plan.DeltaRecords = deltas
+		for _, name := range skipped {
+			plan.Staleness.skip(name)
+		}
+	})
+}
+
+// bestIntersection picks the indexes whose intersection is cheapest, if
+// intersecting two or more of them beats reading one alone. Starting from
+// the one expected to return the fewest rows, it adds the others on other
+// columns while that lowers the cost. It returns their positions in paths,
+// in the order to read them, and the estimate.
+func (e *Executor) bestIntersection(m *costModel, paths []accessPath, plan *Plan) ([]int, CostEstimate) {
+	var order []int
+	for i, p := range paths {
+		if _, stale := e.stale[plan.Candidates[p.cand].Index]; !stale && len(p.read.cols) > 0 {
+			order = append(order, i)
+		}
+	}
+	if len(order) < 2 {
+		return nil, CostEstimate{}
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return paths[order[i]].read.rows < paths[order[j]].read.rows
+	})
+
+	parts := order[:1:1]
+	reads := []indexRead{paths[order[0]].read}
+	cols := slices.Clone(paths[order[0]].read.cols)
+	best := paths[order[0]].estimate
+	for _, i := range order[1:] {
+		if slices.ContainsFunc(paths[i].read.cols, func(col string) bool { return slices.Contains(cols, col) }) {
+			continue
+		}
+		est := m.intersection(append(reads, paths[i].read))
+		if est.Cost >= best.Cost {
+			continue
+		}
+		parts = append(parts, i)
+		reads = append(reads, paths[i].read)
+		cols = append(cols, paths[i].read.cols...)
+		best = est
+	}
+	if len(parts) < 2 {
+		return nil, CostEstimate{}
+	}
+	return parts, best
+}
+
+// columnSubsets returns the non-empty subsets of cols, largest first, each
+// in the order of cols. Past maxSubsetColumns columns only the prefixes of
+// cols are returned.
+func columnSubsets(cols []string) [][]string {
+	if len(cols) > maxSubsetColumns {
+		res := make([][]string, 0, len(cols))
+		for i := len(cols); i >= 1; i-- {
+			res = append(res, cols[:i])
+		}
+		return res
+	}
+	var res [][]string
+	for mask := 1; mask < 1<<len(cols); mask++ {
+		var set []string
+		for i, col := range cols {
+			if mask&(1<<i) != 0 {
+				set = append(set, col)
+			}
+		}
+		res = append(res, set)
+	}
+	// Stable, so that among subsets of a size the prefix of cols comes first
+	sort.SliceStable(res, func(i, j int) bool { return len(res[i]) > len(res[j]) })
+	return res
+}
+
+// planOrder decides how ORDER BY is satisfied. An equality lookup already
+// returns rows in order when every ORDER BY column is one of its keys, and a
+// range scan does when ordering ascending by its column. A query that would
+// otherwise scan the whole file walks a single-column index instead when
+// that costs less than the scan and the sort. Everything else is sorted after
+// filtering.
+func (e *Executor) planOrder(req types.QueryConfig, plan *Plan, m *costModel) {
+	plan.OrderBy = FormatOrder(req.OrderBy)
+	plan.Sort = SortExternal
+
+	switch plan.Strategy {
+	case StrategyIndexScan:
+		if !plan.keyType.IsString() {
+			return
+		}
+		for _, o := range req.OrderBy {
+			if _, ok := plan.coveredCols[o.Column]; !ok {
+				return
+			}
+		}
+		plan.Sort = SortIndexOrder
+		plan.Cost -= plan.sortCost
+
+	case StrategyIndexRange:
+		o := req.OrderBy[0]
+		if len(req.OrderBy) == 1 && o.Column == plan.rangeColumn && !o.Desc && req.Types[o.Column].SameAs(plan.keyType) {
+			plan.Sort = SortIndexOrder
+			plan.Cost -= plan.sortCost
+		}
+
+	case StrategyFullScan:
+		if len(req.OrderBy) != 1 || e.IndexDir == "" {
+			return
+		}
+		csvName := strings.TrimSuffix(filepath.Base(req.CsvPath), filepath.Ext(req.CsvPath))
+		name := req.OrderBy[0].Column
+		indexPath := filepath.Join(e.IndexDir, csvName+"_"+name+".cidx")
+		if _, err := os.Stat(indexPath); err != nil {
+			return
+		}
+		keyType := e.indexKeyType(indexPath)
+		if !keyType.SameAs(req.Types[name]) {
+			// The index orders by another type than the query
+			return
+		}
+		read, ok := e.costWalk(m, indexPath, true)
+		if !ok {
+			return
+		}
+		est := m.indexScan(read)
+
+		var cand *IndexCandidate
+		for i := range plan.Candidates {
+			if plan.Candidates[i].Index == name {
+				cand = &plan.Candidates[i]
+			}
+		}
+		if cand == nil {
+			plan.Candidates = append(plan.Candidates, IndexCandidate{Index: name, Exists: true})
+			cand = &plan.Candidates[len(plan.Candidates)-1]
+		}
+		cand.Estimate = &est
+		if est.Cost > plan.Cost {
+			cand.Rejected = "a full scan and sort is cheaper"
+			return
+		}
+		if reason, stale := e.stale[name]; stale {
+			cand.Rejected = "index is stale: " + reason
+			plan.Staleness.skip(name)
+			return
+		}
+
+		plan.Strategy = StrategyIndexOrder
+		plan.Index = name
+		plan.indexPath = indexPath
+		plan.indexCols = []string{name}
+		plan.reverse = req.OrderBy[0].Desc
+		plan.Sort = SortIndexOrder
+		plan.keyType = keyType
+		if !keyType.IsString() {
+			plan.KeyType = keyType.String()
+		}
+		plan.Cost = est.Cost
+		plan.EstimatedRows = est.Rows
+		plan.matches = est.Matches
+		for i := range plan.Candidates {
+			if plan.Candidates[i].Rejected == rejectedFullScan {
+				plan.Candidates[i].Rejected = "index " + name + " is cheaper"
+			}
+		}
+		cand.Chosen = true
+		cand.Rejected = ""
+	}
+}
+
+// indexKeyType returns the key type of an index, or the text type if the
+// index cannot be opened.
+func (e *Executor) indexKeyType(indexPath string) types.ColumnSpec {
+	idx, release, err := e.Resources.OpenIndex(indexPath)
+	if err != nil {
+		return types.ColumnSpec{}
+	}
+	defer release()
+	return idx.KeyType()
+}
+
+func compositeSearchKey(cols []string, conds map[string]string) string {
+	if len(cols) == 1 {
+		return conds[cols[0]]
+	}
+	var b strings.Builder
+	b.WriteByte('[')
+	for k, col := range cols {
+		if k > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteByte('"')
+		b.WriteString(conds[col])
+		b.WriteByte('"')
+	}
+	b.WriteByte(']')
+	return b.String()
+}
+
+// compositeRange returns the key range of a composite index holding the
+// keys whose leading columns have the values vals and, if r is not nil,
+// whose next column falls in r. Keys quote their values, so a value with a
+// byte that sorts before the closing quote may sort after longer values;
+// the bounds of r are widened to take those in, and r is left to be checked
+// per row.
+func compositeRange(vals []string, r *KeyRange) KeyRange {
+	prefix := compositePrefix(vals)
+	res := KeyRange{Lower: &index.Bound{Key: cutKey(prefix), Inclusive: true}, Upper: prefixEnd(cutKey(prefix))}
+	if r != nil && r.Lower != nil {
+		res.Lower = &index.Bound{Key: cutKey(prefix + r.Lower.Key), Inclusive: true}
+	}
+	if r != nil && r.Upper != nil {
+		upper := r.Upper.Key
+		if i := strings.IndexFunc(upper, func(c rune) bool { return c <= '"' }); i >= 0 {
+			upper = upper[:i]
+		}
+		res.Upper = prefixEnd(cutKey(prefix + upper))
+	}
+	return res
+}
+
+// compositePrefix returns the start of the composite keys whose leading
+// columns have the values vals.
+func compositePrefix(vals []string) string {
+	var b strings.Builder
+	b.WriteByte('[')
+	for _, val := range vals {
+		b.WriteString(`"` + val + `",`)
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// findColumn returns the key of m naming the column col, whatever its case.
+func findColumn[V any](m map[string]V, col string) (string, bool) {
+	for key := range m {
+		if strings.EqualFold(key, col) {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// cutKey cuts key to the length of an index key.
+func cutKey(key string) string {
+	if len(key) > types.KeySize {
+		return key[:types.KeySize]
+	}
+	return key
+}
+
+// covers reports whether the index lookup of the plan enforces c, so that c
+// need not be evaluated per row. A typed index matches keys by value, so
+// equality and IN lookups may return rows whose text differs; those
+// predicates stay residual.
+func (p *Plan) covers(c *types.Condition) bool {
+	switch p.Strategy {
+	case StrategyIndexScan:
+		return p.coversKey(c)
+	case StrategyIndexInList:
+		return p.keyType.IsString() && c.Operator == types.OpIn && c.Column == p.inColumn && slices.Equal(c.ResolvedTargets, p.SearchKeys)
+	case StrategyIndexRange:
+		// Every predicate that went into the range is enforced by it, as is
+		// equality on the leading columns of a composite index
+		if p.coversKey(c) {
+			return true
+		}
+		if c.Column != p.rangeColumn {
+			return false
+		}
+		if isCoveredLike(c) {
+			return p.keyRange.Type.IsString()
+		}
+		return isIndexableRange(c) && c.ResolvedType.SameAs(p.keyRange.Type)
+	case StrategyIndexIntersect:
+		for _, part := range p.Parts {
+			if part.plan.covers(c) {
+				return true
+			}
+		}
+	case StrategyIndexUnion:
+		return p.unionCovered && c == p.union
+	}
+	return false
+}
+
+// coversKey reports whether c is an equality the key of the index lookup
+// holds.
+func (p *Plan) coversKey(c *types.Condition) bool {
+	if !p.keyType.IsString() || c.Operator != types.OpEq {
+		return false
+	}
+	for col, val := range p.coveredCols {
+		if strings.EqualFold(col, c.Column) && val == c.ResolvedTarget {
+			return true
+		}
+	}
+	return false
+}
+
+// splitCovered separates the predicates answered by the index from the
+// residual condition that still has to be evaluated per row.
+func splitCovered(where *types.Condition, isCovered func(c *types.Condition) bool) ([]types.Condition, *types.Condition) {
+	if where == nil {
+		return nil, nil
+	}
+
+	if where.Operator != "AND" {
+		if isCovered(where) {
+			return []types.Condition{*where}, nil
+		}
+		return nil, where
+	}
+
+	var coveredConds, rest []types.Condition
+	for i := range where.Children {
+		if isCovered(&where.Children[i]) {
+			coveredConds = append(coveredConds, where.Children[i])
+		} else {
+			rest = append(rest, where.Children[i])
+		}
+	}
+	switch len(rest) {
+	case 0:
+		return coveredConds, nil
+	case 1:
+		return coveredConds, &rest[0]
+	}
+	return coveredConds, &types.Condition{Operator: "AND", Children: rest}
+}
+
+// lookupNodes returns the plan tree nodes of the lookups of an Index
+// Intersection or an Index Union.
+func lookupNodes(lookups []IndexLookup) []*PlanNode {
+	var nodes []*PlanNode
+	for _, l := range lookups {
+		node := &PlanNode{
+			Operation:     l.Strategy,
+			Index:         l.Index,
+			Key:           l.SearchKey,
+			EstimatedRows: l.EstimatedRows,
+			Children:      lookupNodes(append(l.Parts, l.Branches...)),
+		}
+		if l.Range != "" {
+			node.Key = l.Range
+		}
+		if len(l.Predicates) > 0 {
+			node = &PlanNode{
+				Operation:     "Filter",
+				Predicates:    l.Predicates,
+				EstimatedRows: node.EstimatedRows,
+				Children:      []*PlanNode{node},
+			}
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+func (p *Plan) buildTree(req types.QueryConfig) *PlanNode {
+	node := &PlanNode{
+		Operation:     p.Strategy,
+		Index:         p.Index,
+		Key:           p.SearchKey,
+		Predicates:    p.CoveredPredicates,
+		EstimatedRows: p.EstimatedRows,
+	}
+	if p.keyRange != nil {
+		node.Key = p.Range
+	}
+	if p.Strategy == StrategyFullScan {
+		node.Predicates = nil
+	}
+	node.Children = lookupNodes(p.Parts)
+	if p.Strategy == StrategyIndexUnion {
+		node.Children = lookupNodes(p.Branches)
+	}
+
+	if p.residual != nil {
+		node = &PlanNode{
+			Operation:     "Filter",
+			Predicates:    p.ResidualPredicates,
+			EstimatedRows: p.matches,
+			Children:      []*PlanNode{node},
+		}
+	}
+
+	if p.Sort == SortExternal {
+		node = &PlanNode{
+			Operation:     "Sort",
+			Key:           p.OrderBy,
+			EstimatedRows: node.EstimatedRows,
+			Children:      []*PlanNode{node},
+		}
+	}
+
+	if req.GroupBy != "" {
+		op := "Aggregate"
+		if req.AggFunc != "" {
+			op += " " + strings.ToUpper(req.AggFunc)
+		}
+		return &PlanNode{
+			Operation:     op,
+			Key:           req.GroupBy,
+			EstimatedRows: node.EstimatedRows,
+			Children:      []*PlanNode{node},
+		}
+	}
+
+	if req.CountOnly {
+		return &PlanNode{Operation: StrategyCount, EstimatedRows: node.EstimatedRows, Children: []*PlanNode{node}}
+	}
+
+	if req.Limit > 0 || req.Offset > 0 {
+		est := node.EstimatedRows - int64(req.Offset)
+		if est < 0 {
+			est = 0
+		}
+		if req.Limit > 0 && est > int64(req.Limit) {
+			est = int64(req.Limit)
+		}
+		node = &PlanNode{Operation: "Limit", EstimatedRows: est, Children: []*PlanNode{node}}
+	}
+
+	if len(req.Select) > 0 {
+		node = &PlanNode{
+			Operation:     "Project",
+			Key:           strings.Join(req.Select, ", "),
+			EstimatedRows: node.EstimatedRows,
+			Children:      []*PlanNode{node},
+		}
+	}
+	return node
+}
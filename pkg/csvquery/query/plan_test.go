@@ -0,0 +1,99 @@
+package query
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/types"
+)
+
+func TestCompositePrefix(t *testing.T) {
+	dir := t.TempDir()
+	var b strings.Builder
+	b.WriteString("id,country,city\n")
+	for i := 0; i < 20000; i++ {
+		fmt.Fprintf(&b, "%d,C%d,T%d\n", i, i%200, i%1000)
+	}
+	csvPath := writeCSV(t, dir, "data.csv", b.String())
+	indexDir := filepath.Join(dir, "indexes")
+	buildIndexes(t, csvPath, indexDir, `[["country","city","id"]]`, nil)
+
+	tests := []struct {
+		name     string
+		where    string
+		strategy string
+		rows     int
+	}{
+		{
+			name:     "leading column",
+			where:    `{"operator":"=","column":"country","value":"C7"}`,
+			strategy: StrategyIndexRange,
+			rows:     100,
+		},
+		{
+			name:     "two leading columns in another order",
+			where:    `{"operator":"AND","children":[{"operator":"=","column":"city","value":"T207"},{"operator":"=","column":"country","value":"C7"}]}`,
+			strategy: StrategyIndexRange,
+			rows:     20,
+		},
+		{
+			name:     "every column",
+			where:    `{"operator":"AND","children":[{"operator":"=","column":"country","value":"C7"},{"operator":"=","column":"city","value":"T207"},{"operator":"=","column":"id","value":"1207"}]}`,
+			strategy: StrategyIndexScan,
+			rows:     1,
+		},
+		{
+			name:     "leading column and a range on the next",
+			where:    `{"operator":"AND","children":[{"operator":"=","column":"country","value":"C7"},{"operator":"<","column":"city","value":"T5"}]}`,
+			strategy: StrategyIndexRange,
+			rows:     40,
+		},
+		{
+			name:     "second column alone",
+			where:    `{"operator":"=","column":"city","value":"T207"}`,
+			strategy: StrategyFullScan,
+			rows:     20,
+		},
+		{
+			name:     "last column alone",
+			where:    `{"operator":"=","column":"id","value":"1207"}`,
+			strategy: StrategyFullScan,
+			rows:     1,
+		},
+		{
+			name:     "columns after a gap",
+			where:    `{"operator":"AND","children":[{"operator":"=","column":"city","value":"T207"},{"operator":"=","column":"id","value":"1207"}]}`,
+			strategy: StrategyFullScan,
+			rows:     1,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			req := types.QueryConfig{CsvPath: csvPath, Select: []string{"id", "country", "city"}}
+			explain := req
+			explain.Explain = true
+			plan := runQuery(t, indexDir, explain, tt.where).plan
+			if plan.Strategy != tt.strategy {
+				t.Fatalf("strategy = %s, want %s", plan.Strategy, tt.strategy)
+			}
+			if tt.strategy != StrategyFullScan && plan.Index != "country_city_id" {
+				t.Fatalf("index = %s, want the composite index", plan.Index)
+			}
+
+			// Index scans return rows in key order
+			got := runQuery(t, indexDir, req, tt.where).values()
+			want := runQuery(t, "", req, tt.where).values()
+			sort.Strings(got)
+			sort.Strings(want)
+			if len(got) != tt.rows || !reflect.DeepEqual(got, want) {
+				t.Fatalf("rows = %q, want the %d rows of a full scan %q", got, tt.rows, want)
+			}
+		})
+	}
+}
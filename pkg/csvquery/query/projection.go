@@ -0,0 +1,115 @@
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// projection extracts the select list from the fields of a row.
+type projection struct {
+	cols   []int
+	values []interface{}
+}
+
+// newProjection resolves columns with column, which maps a column name to
+// its field position or -1. It returns nil for an empty select list.
+func newProjection(columns []string, column func(string) int) (*projection, error) {
+	if len(columns) == 0 {
+		return nil, nil
+	}
+	p := &projection{
+		cols:   make([]int, len(columns)),
+		values: make([]interface{}, len(columns)),
+	}
+	for i, name := range columns {
+		if p.cols[i] = column(name); p.cols[i] < 0 {
+			return nil, fmt.Errorf("select column not found: %s", name)
+		}
+	}
+	return p, nil
+}
+
+// extract returns the typed values of the selected columns. The slice is
+// reused by the next call. A nil projection extracts nothing.
+func (p *projection) extract(fields []string) []interface{} {
+	if p == nil {
+		return nil
+	}
+	for i, col := range p.cols {
+		if col < len(fields) {
+			p.values[i] = typedValue(fields[col])
+		} else {
+			p.values[i] = nil
+		}
+	}
+	return p.values
+}
+
+// pick copies the selected fields of a row, to be turned into values by
+// typed once the row is emitted. It is safe for concurrent use.
+func (p *projection) pick(fields []string) []string {
+	if p == nil {
+		return nil
+	}
+	picked := make([]string, len(p.cols))
+	for i, col := range p.cols {
+		if col < len(fields) {
+			picked[i] = fields[col]
+		}
+	}
+	return picked
+}
+
+// typed returns the typed values of fields picked by pick. The slice is
+// reused by the next call.
+func (p *projection) typed(picked []string) []interface{} {
+	if p == nil {
+		return nil
+	}
+	for i, v := range picked {
+		p.values[i] = typedValue(v)
+	}
+	return p.values
+}
+
+// typedValue converts a CSV field to the JSON type it holds. Empty fields
+// and NULL become null, like IS NULL treats them, and numbers in canonical
+// form become JSON numbers with their text kept exactly. Anything else,
+// including numbers with leading zeros such as postal codes, stays a string.
+func typedValue(s string) interface{} {
+	if s == "" || s == "NULL" {
+		return nil
+	}
+	if isCanonicalNumber(s) {
+		return json.Number(s)
+	}
+	return s
+}
+
+func isCanonicalNumber(s string) bool {
+	i := 0
+	if s[0] == '-' {
+		i++
+	}
+	digits := i
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	switch {
+	case i == digits:
+		return false
+	case s[digits] == '0' && i-digits > 1:
+		return false
+	}
+	if i < len(s) && s[i] == '.' {
+		i++
+		frac := i
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			i++
+		}
+		if i == frac {
+			return false
+		}
+	}
+	return i == len(s)
+}
@@ -0,0 +1,174 @@
+package query
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/types"
+)
+
+// ResultWriter receives everything a query produces. The executor never
+// formats output itself, so the same execution paths serve both the legacy
+// text output and the NDJSON protocol.
+type ResultWriter interface {
+	// Row reports a matching row. values holds the select list, or is nil
+	// when the query has none; it is only valid during the call.
+	Row(offset, line int64, values []interface{}) error
+	Count(n int64) error
+	Groups(groups map[string]float64) error
+	Plan(plan interface{}) error
+
+	// Finish flushes the response. It is always called exactly once, with
+	// the error the query failed with (or nil), and returns the error the
+	// caller should report.
+	Finish(err error) error
+}
+
+// ReportedError wraps an error that has already been written to the client
+// as part of the response, so callers must not print it a second time.
+type ReportedError struct {
+	Err error
+}
+
+func (e *ReportedError) Error() string { return e.Err.Error() }
+func (e *ReportedError) Unwrap() error { return e.Err }
+
+// NewResultWriter returns the writer for the protocol requested in req.
+func NewResultWriter(req types.QueryConfig, w io.Writer) (ResultWriter, error) {
+	switch req.Protocol {
+	case 0:
+		return &textResultWriter{w: bufio.NewWriter(w), columns: req.SelectNames()}, nil
+	case 1:
+		action := "query"
+		if req.CountOnly {
+			action = "count"
+		}
+		rw := &ndjsonResultWriter{
+			w:       bufio.NewWriter(w),
+			start:   time.Now(),
+			columns: req.SelectNames(),
+		}
+		rw.enc = json.NewEncoder(rw.w)
+		rw.enc.SetEscapeHTML(false)
+		header := types.HeaderFrame{Type: types.FrameHeader, Version: req.Protocol, Action: action, Columns: req.SelectNames()}
+		if err := rw.enc.Encode(header); err != nil {
+			return nil, err
+		}
+		return rw, nil
+	default:
+		return nil, fmt.Errorf("unsupported protocol version: %d", req.Protocol)
+	}
+}
+
+// textResultWriter produces the original output: "offset,line" lines, a bare
+// count, a bare JSON map for aggregations and a bare JSON plan. Rows of a
+// query with a select list are written as one JSON object per line instead.
+type textResultWriter struct {
+	w       *bufio.Writer
+	columns []string
+	enc     *json.Encoder
+}
+
+func (t *textResultWriter) Row(offset, line int64, values []interface{}) error {
+	if values != nil {
+		if t.enc == nil {
+			t.enc = json.NewEncoder(t.w)
+			t.enc.SetEscapeHTML(false)
+		}
+		return t.enc.Encode(types.Record{Columns: t.columns, Values: values})
+	}
+	_, err := fmt.Fprintf(t.w, "%d,%d\n", offset, line)
+	return err
+}
+
+func (t *textResultWriter) Count(n int64) error {
+	_, err := fmt.Fprintln(t.w, n)
+	return err
+}
+
+func (t *textResultWriter) Groups(groups map[string]float64) error {
+	return json.NewEncoder(t.w).Encode(groups)
+}
+
+func (t *textResultWriter) Plan(plan interface{}) error {
+	enc := json.NewEncoder(t.w)
+	enc.SetEscapeHTML(false)
+	return enc.Encode(plan)
+}
+
+func (t *textResultWriter) Finish(err error) error {
+	if flushErr := t.w.Flush(); err == nil {
+		err = flushErr
+	}
+	return err
+}
+
+// ndjsonResultWriter frames every response as header, body frames and a
+// trailer carrying the status, counts and timing.
+type ndjsonResultWriter struct {
+	w        *bufio.Writer
+	enc      *json.Encoder
+	start    time.Time
+	fetching time.Duration
+	result   types.QueryResult
+	columns  []string
+}
+
+func (n *ndjsonResultWriter) Row(offset, line int64, values []interface{}) error {
+	t := time.Now()
+	n.result.Count++
+	frame := types.RowFrame{
+		Type:      types.FrameRow,
+		RowOffset: types.RowOffset{Offset: offset, Line: line},
+	}
+	if values != nil {
+		frame.Values = &types.Record{Columns: n.columns, Values: values}
+	}
+	err := n.enc.Encode(frame)
+	n.fetching += time.Since(t)
+	return err
+}
+
+func (n *ndjsonResultWriter) Count(c int64) error {
+	n.result.Count = int(c)
+	return nil
+}
+
+func (n *ndjsonResultWriter) Groups(groups map[string]float64) error {
+	t := time.Now()
+	n.result.Count = len(groups)
+	err := n.enc.Encode(types.AggregationFrame{Type: types.FrameAggregation, Groups: groups})
+	n.fetching += time.Since(t)
+	return err
+}
+
+func (n *ndjsonResultWriter) Plan(plan interface{}) error {
+	return n.enc.Encode(types.PlanFrame{Type: types.FramePlan, Plan: plan})
+}
+
+func (n *ndjsonResultWriter) Finish(err error) error {
+	total := time.Since(n.start)
+	n.result.Status = "ok"
+	if err != nil {
+		n.result.Status = "error"
+		n.result.Error = err.Error()
+	}
+	n.result.Stats = types.QueryStats{
+		ExecutionTime: (total - n.fetching).String(),
+		FetchingTime:  n.fetching.String(),
+		TotalTime:     total.String(),
+	}
+
+	encErr := n.enc.Encode(types.TrailerFrame{Type: types.FrameTrailer, QueryResult: n.result})
+	flushErr := n.w.Flush()
+	if err != nil {
+		return &ReportedError{Err: err}
+	}
+	if encErr != nil {
+		return encErr
+	}
+	return flushErr
+}
@@ -0,0 +1,44 @@
+package query
+
+import (
+	"os"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/index"
+	"github.com/csvquery/csvquery/pkg/csvquery/storage"
+)
+
+// Resources hands out index handles and CSV mappings to the executor.
+// Every successful call returns a release func that must be called once
+// the caller no longer touches the returned value.
+type Resources interface {
+	OpenIndex(path string) (*index.DiskIndex, func(), error)
+	MapFile(path string) ([]byte, func(), error)
+}
+
+// directResources opens and closes everything per call. It is the default
+// for one-shot CLI invocations.
+type directResources struct{}
+
+func (directResources) OpenIndex(path string) (*index.DiskIndex, func(), error) {
+	idx, err := index.OpenDiskIndex(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return idx, func() { idx.Close() }, nil
+}
+
+func (directResources) MapFile(path string) ([]byte, func(), error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := storage.MmapFile(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return data, func() {
+		storage.MunmapFile(data)
+		f.Close()
+	}, nil
+}
@@ -0,0 +1,157 @@
+package query
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/parser"
+)
+
+// rowSource reads single rows of a mmapped CSV by the byte offset stored in
+// index records. Fields are split the same way the SIMD parser splits them
+// when building indexes, on the separator recorded in _meta.json, so values
+// compare equal to index keys, and pending updates are applied by line
+// number.
+type rowSource struct {
+	data      []byte
+	sep       byte
+	headerMap map[string]int // lower-cased column name -> field position
+	updates   *UpdateManager
+	fields    []string
+	row       map[string]string
+}
+
+func newRowSource(data []byte, sep byte, updates *UpdateManager) *rowSource {
+	s := &rowSource{
+		data:      data,
+		sep:       sep,
+		headerMap: make(map[string]int),
+		updates:   updates,
+		row:       make(map[string]string),
+	}
+	parseHeader(data, sep, s.headerMap)
+	return s
+}
+
+// parseHeader maps the lower-cased column names of the header record at the
+// start of data to their field positions.
+func parseHeader(data []byte, sep byte, headerMap map[string]int) {
+	if len(data) >= 3 && data[0] == 0xEF && data[1] == 0xBB && data[2] == 0xBF {
+		data = data[3:]
+	}
+	for i, name := range splitFields(recordAt(data, 0), sep, nil) {
+		headerMap[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+}
+
+// column returns the field position of a column, or -1.
+func (s *rowSource) column(name string) int {
+	if i, ok := s.headerMap[strings.ToLower(name)]; ok {
+		return i
+	}
+	return -1
+}
+
+// fieldsAt returns the fields of the row starting at offset, which is the
+// given line of the file, or false for deleted rows. The slice is reused by
+// the next call.
+func (s *rowSource) fieldsAt(offset, line int64) ([]string, bool) {
+	if offset < 0 || offset >= int64(len(s.data)) || s.updates.IsDeleted(line) {
+		return nil, false
+	}
+	s.fields = splitFields(recordAt(s.data, offset), s.sep, s.fields[:0])
+	s.updates.apply(s.fields, s.headerMap, line)
+	return s.fields, true
+}
+
+// rowAt returns the row starting at offset keyed by lower-cased column name,
+// as Evaluate expects. The map is reused by the next call.
+func (s *rowSource) rowAt(offset, line int64) (map[string]string, bool) {
+	fields, ok := s.fieldsAt(offset, line)
+	if !ok {
+		return nil, false
+	}
+	fillRow(s.row, s.headerMap, fields)
+	return s.row, true
+}
+
+func fillRow(row map[string]string, headerMap map[string]int, fields []string) {
+	for name, i := range headerMap {
+		if i < len(fields) {
+			row[name] = fields[i]
+		} else {
+			delete(row, name)
+		}
+	}
+}
+
+// lineOffsets returns the offsets of the given lines, which must be sorted.
+// It walks the records from the start of the file and numbers them like the
+// SIMD parser does: the header is line 1 and empty lines are not counted.
+func (s *rowSource) lineOffsets(lines []int64) map[int64]int64 {
+	res := make(map[int64]int64, len(lines))
+	offset := recordEnd(s.data, 0) + 1
+	line := int64(2)
+	for i := 0; i < len(lines) && offset < int64(len(s.data)); {
+		end := recordEnd(s.data, offset)
+		if len(bytes.TrimSuffix(s.data[offset:end], []byte{'\r'})) > 0 {
+			for i < len(lines) && lines[i] < line {
+				i++
+			}
+			if i < len(lines) && lines[i] == line {
+				res[line] = offset
+				i++
+			}
+			line++
+		}
+		offset = end + 1
+	}
+	return res
+}
+
+// recordAt returns the record starting at offset, without its line ending.
+func recordAt(data []byte, offset int64) []byte {
+	return bytes.TrimSuffix(data[offset:recordEnd(data, offset)], []byte{'\r'})
+}
+
+// recordEnd returns the position of the newline that ends the record
+// starting at offset, or the length of data for the last record. Newlines
+// inside quoted fields do not end the record.
+func recordEnd(data []byte, offset int64) int64 {
+	rest := data[offset:]
+	inQuote := false
+	for i := 0; i < len(rest); i++ {
+		next := bytes.IndexAny(rest[i:], "\"\n")
+		if next < 0 {
+			break
+		}
+		i += next
+		if rest[i] == '"' {
+			inQuote = !inQuote
+		} else if !inQuote {
+			return offset + int64(i)
+		}
+	}
+	return int64(len(data))
+}
+
+// splitFields splits a record on the separator outside quotes and unquotes
+// the fields like parser.UnquoteField, appending them to dst.
+func splitFields(record []byte, sep byte, dst []string) []string {
+	inQuote := false
+	start := 0
+	for i := 0; i <= len(record); i++ {
+		if i < len(record) {
+			if record[i] == '"' {
+				inQuote = !inQuote
+				continue
+			}
+			if record[i] != sep || inQuote {
+				continue
+			}
+		}
+		dst = append(dst, string(parser.UnquoteField(record[start:i])))
+		start = i + 1
+	}
+	return dst
+}
@@ -0,0 +1,205 @@
+package query
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/index"
+	"github.com/csvquery/csvquery/pkg/csvquery/types"
+)
+
+// externalSort orders rows for ORDER BY when no index supplies the order.
+// Each row becomes an index record whose key encodes its ORDER BY values,
+// and index.Sorter sorts those in memory-sized chunks that spill to disk and
+// are merged into a temporary index file, which is then read back in order.
+type externalSort struct {
+	order  []types.OrderColumn
+	specs  []types.ColumnSpec
+	cols   []int
+	dir    string
+	path   string
+	sorter *index.Sorter
+	added  int64
+	buf    []byte
+}
+
+// newExternalSort prepares a sort for req.OrderBy. column maps a column name
+// to its field position, or -1 if the CSV has no such column.
+func newExternalSort(req types.QueryConfig, column func(string) int) (*externalSort, error) {
+	cols := make([]int, len(req.OrderBy))
+	specs := make([]types.ColumnSpec, len(req.OrderBy))
+	for i, o := range req.OrderBy {
+		if cols[i] = column(o.Column); cols[i] < 0 {
+			return nil, fmt.Errorf("order by column not found: %s", o.Column)
+		}
+		specs[i] = req.Types[o.Column]
+	}
+
+	dir, err := os.MkdirTemp("", "csvquery-sort-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sort directory: %w", err)
+	}
+
+	memMB := req.SortMemMB
+	if memMB <= 0 {
+		memMB = types.DefaultSortMemoryMB
+	}
+	path := filepath.Join(dir, "sorted.cidx")
+	return &externalSort{
+		order:  req.OrderBy,
+		specs:  specs,
+		cols:   cols,
+		dir:    dir,
+		path:   path,
+		sorter: index.NewSorter("order", path, dir, memMB*1024*1024, nil),
+	}, nil
+}
+
+func (s *externalSort) Add(fields []string, offset, line int64) error {
+	rec := types.IndexRecord{Offset: offset, Line: line}
+	s.buf = encodeOrderKey(s.buf[:0], s.order, s.specs, s.cols, fields)
+	// The last key byte flags keys that did not fit
+	if n := copy(rec.Key[:types.KeySize-1], s.buf); n < len(s.buf) {
+		rec.Key[types.KeySize-1] = 1
+	}
+	s.added++
+	return s.sorter.Add(rec)
+}
+
+// Drain sorts everything added so far and calls emit for each row in order
+// until emit returns false. Keys that did not fit in a record were cut off,
+// so rows whose truncated keys tie are re-read from rows and compared in full.
+func (s *externalSort) Drain(rows *rowSource, emit func(offset, line int64) (bool, error)) error {
+	if s.added == 0 {
+		return nil
+	}
+	if _, err := s.sorter.Finalize(); err != nil {
+		return err
+	}
+
+	idx, err := index.OpenDiskIndex(s.path)
+	if err != nil {
+		return err
+	}
+	defer idx.Close()
+	iter, err := idx.Scan()
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+
+	var run []types.IndexRecord
+	flush := func() (bool, error) {
+		if len(run) > 1 && run[0].Key[types.KeySize-1] != 0 {
+			s.sortRun(run, rows)
+		}
+		for _, rec := range run {
+			if more, err := emit(rec.Offset, rec.Line); err != nil || !more {
+				return false, err
+			}
+		}
+		run = run[:0]
+		return true, nil
+	}
+
+	for iter.Next() {
+		rec := iter.Record()
+		if len(run) > 0 && rec.Key != run[0].Key {
+			if more, err := flush(); err != nil || !more {
+				return err
+			}
+		}
+		run = append(run, rec)
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	_, err = flush()
+	return err
+}
+
+func (s *externalSort) sortRun(run []types.IndexRecord, rows *rowSource) {
+	keys := make([][]byte, len(run))
+	for i, rec := range run {
+		fields, _ := rows.fieldsAt(rec.Offset, rec.Line)
+		keys[i] = encodeOrderKey(nil, s.order, s.specs, s.cols, fields)
+	}
+	sort.Stable(&keyedRun{run: run, keys: keys})
+}
+
+// Close removes the spilled chunks and the sorted file.
+func (s *externalSort) Close() {
+	s.sorter.Cleanup()
+	os.RemoveAll(s.dir)
+}
+
+type keyedRun struct {
+	run  []types.IndexRecord
+	keys [][]byte
+}
+
+func (k *keyedRun) Len() int           { return len(k.run) }
+func (k *keyedRun) Less(i, j int) bool { return bytes.Compare(k.keys[i], k.keys[j]) < 0 }
+func (k *keyedRun) Swap(i, j int) {
+	k.run[i], k.run[j] = k.run[j], k.run[i]
+	k.keys[i], k.keys[j] = k.keys[j], k.keys[i]
+}
+
+// encodeOrderKey appends a key that sorts bytewise in ORDER BY order. Each
+// value has its zero bytes escaped as 00 FF and is terminated by 00 01, so a
+// value sorts before any longer value it is a prefix of; descending columns
+// have all their bytes inverted. Values of typed columns are their type's
+// comparison key behind a 02 byte; values that are not of the type sort first,
+// as strings behind a 01 byte.
+func encodeOrderKey(dst []byte, order []types.OrderColumn, specs []types.ColumnSpec, cols []int, fields []string) []byte {
+	for i, o := range order {
+		var v string
+		if cols[i] < len(fields) {
+			v = fields[cols[i]]
+		}
+		start := len(dst)
+		if !specs[i].IsString() {
+			if key, ok := specs[i].AppendKey(append(dst, 2), v); ok {
+				// Type keys are prefix-free, so they need no terminator
+				dst = key
+			} else {
+				dst = appendOrderString(append(dst[:start], 1), v)
+			}
+		} else {
+			dst = appendOrderString(dst, v)
+		}
+		if o.Desc {
+			for j := start; j < len(dst); j++ {
+				dst[j] = ^dst[j]
+			}
+		}
+	}
+	return dst
+}
+
+func appendOrderString(dst []byte, v string) []byte {
+	for j := 0; j < len(v); j++ {
+		if v[j] == 0 {
+			dst = append(dst, 0, 0xFF)
+		} else {
+			dst = append(dst, v[j])
+		}
+	}
+	return append(dst, 0, 1)
+}
+
+// FormatOrder renders an ORDER BY list for plans.
+func FormatOrder(order []types.OrderColumn) string {
+	parts := make([]string, len(order))
+	for i, o := range order {
+		parts[i] = o.Column
+		if o.Desc {
+			parts[i] += " DESC"
+		}
+	}
+	return strings.Join(parts, ", ")
+}
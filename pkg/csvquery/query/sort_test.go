@@ -0,0 +1,86 @@
+package query
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/types"
+)
+
+func TestOrderKey(t *testing.T) {
+	intSpec := types.ColumnSpec{Type: types.TypeInt}
+	tests := []struct {
+		name  string
+		order []types.OrderColumn
+		specs []types.ColumnSpec
+		rows  []string
+		want  []string
+	}{
+		{
+			name:  "strings sort lexicographically",
+			order: []types.OrderColumn{{Column: "a"}},
+			specs: []types.ColumnSpec{{}},
+			rows:  []string{"9", "10", "", "abc", "ab", "a\x00", "a"},
+			want:  []string{"", "10", "9", "a", "a\x00", "ab", "abc"},
+		},
+		{
+			name:  "ints sort numerically after the values that are not ints",
+			order: []types.OrderColumn{{Column: "a"}},
+			specs: []types.ColumnSpec{intSpec},
+			rows:  []string{"10", "9", "-1", "abc", "", "2", "-10", "1.5"},
+			want:  []string{"", "1.5", "abc", "-10", "-1", "2", "9", "10"},
+		},
+		{
+			name:  "descending ints",
+			order: []types.OrderColumn{{Column: "a", Desc: true}},
+			specs: []types.ColumnSpec{intSpec},
+			rows:  []string{"10", "9", "-1", "abc", "", "2"},
+			want:  []string{"10", "9", "2", "-1", "abc", ""},
+		},
+		{
+			name:  "decimals compare by value and keep the order of equal ones",
+			order: []types.OrderColumn{{Column: "a"}},
+			specs: []types.ColumnSpec{{Type: types.TypeDecimal}},
+			rows:  []string{"1.50", "x", "0.1", "-0", "1.5", "-2", "10", "0"},
+			want:  []string{"x", "-2", "-0", "0", "0.1", "1.50", "1.5", "10"},
+		},
+		{
+			name:  "dates",
+			order: []types.OrderColumn{{Column: "a"}},
+			specs: []types.ColumnSpec{{Type: types.TypeDate, Format: "02/01/2006"}},
+			rows:  []string{"01/02/2024", "31/01/2024", "", "01/01/2025"},
+			want:  []string{"", "31/01/2024", "01/02/2024", "01/01/2025"},
+		},
+		{
+			name:  "typed then string descending",
+			order: []types.OrderColumn{{Column: "a"}, {Column: "b", Desc: true}},
+			specs: []types.ColumnSpec{intSpec, {}},
+			rows:  []string{"10|a", "9|a", "9|b", "10|ab", "x|", "x|z", "9"},
+			want:  []string{"x|z", "x|", "9|b", "9|a", "9", "10|ab", "10|a"},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			cols := make([]int, len(tt.order))
+			for i := range cols {
+				cols[i] = i
+			}
+			rows := append([]string(nil), tt.rows...)
+			keys := make(map[string][]byte)
+			for _, row := range rows {
+				keys[row] = encodeOrderKey(nil, tt.order, tt.specs, cols, strings.Split(row, "|"))
+			}
+			sort.SliceStable(rows, func(i, j int) bool {
+				return bytes.Compare(keys[rows[i]], keys[rows[j]]) < 0
+			})
+			if !reflect.DeepEqual(rows, tt.want) {
+				t.Fatalf("order = %q, want %q", rows, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/index"
+	"github.com/csvquery/csvquery/pkg/csvquery/types"
+)
+
+// What the stale policy did, reported in Staleness.Decision
+const (
+	StaleDecisionFresh   = "fresh"   // every index matches the CSV
+	StaleDecisionSkipped = "skipped" // stale indexes were planned around
+	StaleDecisionFailed  = "failed"  // the query needed a stale index
+	StaleDecisionRebuilt = "rebuilt" // stale indexes were rebuilt first
+)
+
+// Staleness is what EXPLAIN reports about indexes that no longer match the
+// CSV they were built from.
+type Staleness struct {
+	Policy   string            `json:"policy"`
+	Decision string            `json:"decision"`
+	Stale    map[string]string `json:"stale,omitempty"`   // index => why it is stale
+	Rebuilt  []string          `json:"rebuilt,omitempty"` // indexes rebuilt by the query
+	Skipped  []string          `json:"skipped,omitempty"` // stale indexes the plan would have used
+
+	err error
+}
+
+// skip records that the plan would have used the stale index name.
+func (s *Staleness) skip(name string) {
+	s.Skipped = append(s.Skipped, name)
+	if s.Policy == types.StaleFail {
+		s.Decision = StaleDecisionFailed
+		if s.err == nil {
+			s.err = fmt.Errorf("index %s is stale: %s", name, s.Stale[name])
+		}
+	}
+}
+
+// checkStaleness compares the indexes of the CSV with the CSV and applies
+// the stale policy of the request, or else of the dataset, which defaults to
+// falling back. It returns the metadata to plan with, reloaded if indexes
+// were rebuilt, and leaves the stale indexes in e.stale for the planner to
+// skip.
+func (e *Executor) checkStaleness(req types.QueryConfig, meta *types.IndexMeta) (*Staleness, *types.IndexMeta) {
+	policy := req.OnStale
+	if policy == "" && meta != nil {
+		policy = meta.StalePolicy
+	}
+	if policy == "" {
+		policy = types.StaleFallback
+	}
+	s := &Staleness{Policy: policy, Decision: StaleDecisionFresh}
+
+	e.stale = e.staleIndexes(req, meta)
+	if len(e.stale) == 0 {
+		return s, meta
+	}
+	s.Stale = e.stale
+	s.Decision = StaleDecisionSkipped
+	if policy != types.StaleRebuild {
+		return s, meta
+	}
+
+	if e.Lock != nil {
+		upgraded, err := e.Lock.Upgrade()
+		if err != nil {
+			s.Decision = StaleDecisionFailed
+			s.err = fmt.Errorf("failed to rebuild stale indexes: %w", err)
+			return s, meta
+		}
+		if upgraded {
+			// The lock was released for a moment, in which the CSV may have
+			// been compacted or the indexes rebuilt
+			updates, err := LoadUpdates(req.CsvPath)
+			if err != nil {
+				s.Decision = StaleDecisionFailed
+				s.err = err
+				return s, meta
+			}
+			e.Updates = updates
+			meta, _ = index.LoadMeta(e.IndexDir, req.CsvPath)
+			if e.stale = e.staleIndexes(req, meta); len(e.stale) == 0 {
+				s.Stale, s.Decision = nil, StaleDecisionFresh
+				return s, meta
+			}
+			s.Stale = e.stale
+		}
+	}
+	rebuilt, err := e.rebuildIndexes(req, meta)
+	if err != nil {
+		s.Decision = StaleDecisionFailed
+		s.err = fmt.Errorf("failed to rebuild stale indexes: %w", err)
+		return s, meta
+	}
+	meta, _ = index.LoadMeta(e.IndexDir, req.CsvPath)
+	e.stale = e.staleIndexes(req, meta)
+	s.Rebuilt = rebuilt
+	s.Decision = StaleDecisionRebuilt
+	return s, meta
+}
+
+// staleIndexes returns the indexes of the CSV in e.IndexDir that do not
+// match it, with the reason. An index matches if it is listed in meta, the
+// part of the CSV meta describes is unchanged, and the rows appended after
+// that part, if any, are all in the index's delta.
+func (e *Executor) staleIndexes(req types.QueryConfig, meta *types.IndexMeta) map[string]string {
+	csvName := strings.TrimSuffix(filepath.Base(req.CsvPath), filepath.Ext(req.CsvPath))
+	paths, _ := filepath.Glob(filepath.Join(e.IndexDir, csvName+"_*.cidx"))
+	if len(paths) == 0 {
+		return nil
+	}
+
+	var size int64
+	var csvReason string
+	if meta != nil {
+		size, csvReason = index.CheckCsv(req.CsvPath, meta)
+	}
+	stale := make(map[string]string)
+	for _, path := range paths {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), csvName+"_"), ".cidx")
+		stats, listed := types.IndexStats{}, false
+		if meta != nil {
+			stats, listed = meta.Indexes[name]
+		}
+		switch {
+		case meta == nil:
+			stale[name] = "no _meta.json describes the index"
+		case !listed:
+			stale[name] = "the index is not listed in _meta.json"
+		case csvReason != "":
+			stale[name] = csvReason
+		case size > meta.CsvSize:
+			var keyType types.ColumnSpec
+			if stats.Type != nil {
+				keyType = *stats.Type
+			}
+			delta, err := index.LoadDelta(path, keyType)
+			if err != nil || delta == nil || delta.CsvStart != meta.CsvSize || delta.CsvEnd != size {
+				stale[name] = "rows were appended to the csv since the index was built"
+			}
+		}
+	}
+	return stale
+}
+
+// rebuildIndexes builds the stale indexes again, refreshing them if the
+// CSV only grew, with the separator recorded in meta and their key types,
+// column order and bloom filter rates. The caller holds the exclusive lock
+// of the CSV, so no insert or compaction runs meanwhile.
+func (e *Executor) rebuildIndexes(req types.QueryConfig, meta *types.IndexMeta) ([]string, error) {
+	headerMap, err := readHeader(req.CsvPath, meta.CsvSeparator()[0])
+	if err != nil {
+		return nil, err
+	}
+	csvName := strings.TrimSuffix(filepath.Base(req.CsvPath), filepath.Ext(req.CsvPath))
+	names := make([]string, 0, len(e.stale))
+	for name := range e.stale {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// One build per bloom filter rate, as a build has a single one
+	var rebuilt []string
+	var rates []float64
+	colDefs := make(map[float64][][]string)
+	colTypes := make(map[float64]map[string]types.ColumnSpec)
+	for _, name := range names {
+		cols := indexDefinition(name, meta, headerMap)
+		if cols == nil {
+			// Not an index of this CSV, or of columns it no longer has
+			continue
+		}
+		var rate float64
+		if meta != nil {
+			rate = meta.Indexes[name].BloomRate
+		}
+		if _, ok := colDefs[rate]; !ok {
+			rates = append(rates, rate)
+			colTypes[rate] = make(map[string]types.ColumnSpec)
+		}
+		rebuilt = append(rebuilt, name)
+		colDefs[rate] = append(colDefs[rate], cols)
+		keyType := e.indexKeyType(filepath.Join(e.IndexDir, csvName+"_"+name+".cidx"))
+		if !keyType.IsString() && len(cols) == 1 {
+			colTypes[rate][cols[0]] = keyType
+		}
+	}
+
+	for _, rate := range rates {
+		columns, err := json.Marshal(colDefs[rate])
+		if err != nil {
+			return nil, err
+		}
+		manager := index.NewIndexManager(index.IndexerConfig{
+			InputFile:   req.CsvPath,
+			OutputDir:   e.IndexDir,
+			Columns:     string(columns),
+			Separator:   meta.CsvSeparator(),
+			BloomFPRate: rate,
+			Types:       colTypes[rate],
+		})
+		if err := manager.Run(); err != nil {
+			return nil, err
+		}
+	}
+	return rebuilt, nil
+}
@@ -0,0 +1,107 @@
+package query
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/types"
+)
+
+func TestStalePolicies(t *testing.T) {
+	const where = `{"operator":"=","column":"id","value":"42"}`
+	tests := []struct {
+		policy   string
+		strategy string
+		decision string
+		fails    bool
+	}{
+		{policy: types.StaleFail, fails: true},
+		{policy: types.StaleFallback, strategy: StrategyFullScan, decision: StaleDecisionSkipped},
+		{policy: types.StaleRebuild, strategy: StrategyIndexScan, decision: StaleDecisionRebuilt},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.policy, func(t *testing.T) {
+			csvPath, indexDir := indexedCSV(t, 5000)
+			req := types.QueryConfig{CsvPath: csvPath, Select: []string{"id", "price"}, OnStale: tt.policy}
+			explain := req
+			explain.Explain = true
+			if plan := runQuery(t, indexDir, explain, where).plan; plan.Strategy != StrategyIndexScan || plan.Staleness.Decision != StaleDecisionFresh {
+				t.Fatalf("before the change: %s, %s", plan.Strategy, plan.Staleness.Decision)
+			}
+
+			// Rows after the changed one move, so the index offsets are wrong
+			data, err := os.ReadFile(csvPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			changed := strings.Replace(string(data), "\n42,active,C42,42\n", "\n42,active,C42,4200\n", 1)
+			if changed == string(data) {
+				t.Fatal("row 42 not found")
+			}
+			if err := os.WriteFile(csvPath, []byte(changed), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			rows, err := tryQuery(indexDir, req, parseWhere(t, where))
+			if tt.fails {
+				if err == nil || !strings.Contains(err.Error(), "index id is stale") {
+					t.Fatalf("query error = %v, want the stale index reported", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("query failed: %v", err)
+			}
+			if got := rows.values(); !reflect.DeepEqual(got, []string{"42,4200"}) {
+				t.Fatalf("rows = %q, want the changed row", got)
+			}
+
+			// The rebuild ran with the query above, so EXPLAIN finds the
+			// indexes fresh
+			plan := runQuery(t, indexDir, explain, where).plan
+			decision := tt.decision
+			if tt.policy == types.StaleRebuild {
+				decision = StaleDecisionFresh
+			}
+			if plan.Strategy != tt.strategy || plan.Staleness.Decision != decision {
+				t.Fatalf("plan: %s, %s; want %s, %s", plan.Strategy, plan.Staleness.Decision, tt.strategy, decision)
+			}
+			if tt.policy == types.StaleFallback && !reflect.DeepEqual(plan.Staleness.Skipped, []string{"id"}) {
+				t.Fatalf("skipped %v, want the id index", plan.Staleness.Skipped)
+			}
+		})
+	}
+}
+
+// A rebuild reports the indexes it rebuilt.
+func TestStaleRebuildExplain(t *testing.T) {
+	csvPath, indexDir := indexedCSV(t, 5000)
+	f, err := os.OpenFile(csvPath, os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Same size, but the hash differs
+	_, err = f.WriteAt([]byte("ID"), 0)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := types.QueryConfig{CsvPath: csvPath, Select: []string{"id"}, OnStale: types.StaleRebuild, Explain: true}
+	plan := runQuery(t, indexDir, req, `{"operator":"=","column":"country","value":"C7"}`).plan
+	s := plan.Staleness
+	if s.Decision != StaleDecisionRebuilt || len(s.Stale) != 4 {
+		t.Fatalf("staleness = %+v, want the 4 indexes rebuilt", s)
+	}
+	want := []string{"country", "id", "price", "status"}
+	if !reflect.DeepEqual(s.Rebuilt, want) {
+		t.Fatalf("rebuilt %v, want %v", s.Rebuilt, want)
+	}
+	if plan.Strategy != StrategyIndexScan {
+		t.Fatalf("strategy = %s after the rebuild", plan.Strategy)
+	}
+}
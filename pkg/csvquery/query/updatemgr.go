@@ -3,59 +3,359 @@ package query
 import (
 	"encoding/json"
 	"fmt"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"sync"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/index"
+	"github.com/csvquery/csvquery/pkg/csvquery/storage"
+	"github.com/csvquery/csvquery/pkg/csvquery/types"
 )
 
+// checkpointSize is the size of the update log past which Save folds it
+// into the updates file.
+const checkpointSize = 1 << 20
+
+// UpdateManager holds the pending changes to a CSV file: column overrides
+// and deleted rows. Both are keyed by line number, as index records and the
+// SIMD parser count lines (the header is line 1), written in decimal. The
+// byte offset of each updated row is kept too, so that index queries can
+// read the row without numbering the lines of the file.
+//
+// Changes are appended to the update log, <csv>_updates.log, which is
+// replayed on load on top of the last checkpoint, <csv>_updates.json. The
+// checkpoint records the version of the CSV its lines refer to, and is
+// ignored once the CSV no longer starts with it, as after a compaction that
+// died before removing it.
 type UpdateManager struct {
 	csvPath    string
 	schemaPath string
+	log        *storage.Log
+	pending    []logEntry
 	mu         sync.RWMutex
 	Overrides  map[string]map[string]string `json:"rows"`
+	Offsets    map[string]int64             `json:"offsets,omitempty"`
+	Deleted    map[string]bool              `json:"deleted,omitempty"`
+	Csv        *types.CsvVersion            `json:"csv,omitempty"`
+}
+
+// logEntry is a change recorded in the update log: new values for columns
+// of some lines, at the byte offsets in Offsets, or their deletion. Each
+// record of the log holds the entries of one Save.
+type logEntry struct {
+	Lines   []int64           `json:"lines"`
+	Offsets []int64           `json:"offsets,omitempty"`
+	Set     map[string]string `json:"set,omitempty"`
+	Delete  bool              `json:"delete,omitempty"`
 }
 
 func LoadUpdates(csvPath string) (*UpdateManager, error) {
+	um, _, err := loadUpdates(csvPath)
+	return um, err
+}
+
+// loadUpdates is LoadUpdates that also returns the contents of the updates
+// file followed by the records of the log, which change whenever the
+// pending changes do.
+func loadUpdates(csvPath string) (*UpdateManager, []byte, error) {
 	absPath, err := filepath.Abs(csvPath)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	schemaPath := absPath + "_updates.json"
-	um := &UpdateManager{
+	um := newUpdateManager(absPath)
+	var snapshot []byte
+	err = um.log.Read(func(records [][]byte) error {
+		data, err := um.readCheckpoint()
+		if err != nil {
+			return err
+		}
+		snapshot = data
+		for _, rec := range records {
+			if err := um.replay(rec); err != nil {
+				return err
+			}
+			snapshot = append(snapshot, rec...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return um, snapshot, nil
+}
+
+func newUpdateManager(absPath string) *UpdateManager {
+	return &UpdateManager{
 		csvPath:    absPath,
-		schemaPath: schemaPath,
+		schemaPath: absPath + "_updates.json",
+		log:        storage.NewLog(absPath + "_updates.log"),
 		Overrides:  make(map[string]map[string]string),
+		Offsets:    make(map[string]int64),
+		Deleted:    make(map[string]bool),
+	}
+}
+
+// readCheckpoint loads the updates file, if there is one, and returns its
+// contents.
+func (um *UpdateManager) readCheckpoint() ([]byte, error) {
+	data, err := os.ReadFile(um.schemaPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read updates file: %v", err)
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, um); err != nil {
+			return nil, fmt.Errorf("failed to parse updates file: %v", err)
+		}
 	}
-	if _, err := os.Stat(schemaPath); err == nil {
-		data, err := os.ReadFile(schemaPath)
+	if um.Csv != nil {
+		current, err := index.CsvContinues(um.csvPath, *um.Csv)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read updates file: %v", err)
+			return nil, fmt.Errorf("failed to check updates file: %v", err)
 		}
-		if len(data) > 0 {
-			if err := json.Unmarshal(data, um); err != nil {
-				return nil, fmt.Errorf("failed to parse updates file: %v", err)
+		if !current {
+			// The lines it refers to are gone
+			um.Overrides, um.Offsets, um.Deleted, um.Csv = nil, nil, nil, nil
+		}
+	}
+	if um.Overrides == nil {
+		um.Overrides = make(map[string]map[string]string)
+	}
+	if um.Offsets == nil {
+		um.Offsets = make(map[string]int64)
+	}
+	if um.Deleted == nil {
+		um.Deleted = make(map[string]bool)
+	}
+	return data, nil
+}
+
+// replay applies the entries of a record of the update log.
+func (um *UpdateManager) replay(record []byte) error {
+	var entries []logEntry
+	if err := json.Unmarshal(record, &entries); err != nil {
+		return fmt.Errorf("failed to parse update log: %v", err)
+	}
+	for _, entry := range entries {
+		for i, line := range entry.Lines {
+			switch {
+			case entry.Delete:
+				um.delete(line)
+			case len(entry.Offsets) == len(entry.Lines):
+				um.set(line, entry.Offsets[i], entry.Set)
+			default:
+				// Logged before offsets were recorded
+				um.set(line, -1, entry.Set)
 			}
 		}
 	}
-	return um, nil
+	return nil
 }
 
+// Save appends the changes made since the last Save to the update log, as
+// one record, and folds the log into the updates file once it has grown
+// past checkpointSize.
 func (um *UpdateManager) Save() error {
-	um.mu.RLock()
-	defer um.mu.RUnlock()
-	data, err := json.MarshalIndent(um, "", "  ")
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	if len(um.pending) == 0 {
+		return nil
+	}
+	payload, err := json.Marshal(um.pending)
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(um.schemaPath, data, 0644)
+	size, err := um.log.Append(payload)
+	if err != nil {
+		return err
+	}
+	um.pending = nil
+	if size >= checkpointSize {
+		return um.checkpoint()
+	}
+	return nil
+}
+
+// checkpoint writes the updates file with the records of the log applied
+// and empties the log. Other processes may have appended to the log, so
+// the state is read again from disk rather than taken from um.
+func (um *UpdateManager) checkpoint() error {
+	return um.log.Checkpoint(func(records [][]byte) error {
+		state := newUpdateManager(um.csvPath)
+		if _, err := state.readCheckpoint(); err != nil {
+			return err
+		}
+		for _, rec := range records {
+			if err := state.replay(rec); err != nil {
+				return err
+			}
+		}
+		version, err := index.CsvVersion(um.csvPath)
+		if err != nil {
+			return err
+		}
+		state.Csv = &version
+		data, err := json.MarshalIndent(state, "", "  ")
+		if err != nil {
+			return err
+		}
+		return storage.WriteFileAtomic(um.schemaPath, data)
+	})
+}
+
+// remove deletes the update log and then the updates file, which holds
+// the only changes once checkpoint has emptied the log.
+func (um *UpdateManager) remove() error {
+	for _, path := range []string{um.log.Path(), um.schemaPath} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove updates: %v", err)
+		}
+	}
+	return nil
 }
 
-func (um *UpdateManager) GetRow(offset int64) map[string]string {
+func lineKey(line int64) string {
+	return strconv.FormatInt(line, 10)
+}
+
+// Set records new values for columns of the row starting at offset, on top
+// of earlier updates.
+func (um *UpdateManager) Set(line, offset int64, values map[string]string) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	um.set(line, offset, values)
+	if n := len(um.pending); n > 0 && !um.pending[n-1].Delete && maps.Equal(um.pending[n-1].Set, values) {
+		um.pending[n-1].Lines = append(um.pending[n-1].Lines, line)
+		um.pending[n-1].Offsets = append(um.pending[n-1].Offsets, offset)
+	} else {
+		um.pending = append(um.pending, logEntry{Lines: []int64{line}, Offsets: []int64{offset}, Set: maps.Clone(values)})
+	}
+}
+
+// Delete records a tombstone for a row, dropping its pending updates.
+func (um *UpdateManager) Delete(line int64) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	um.delete(line)
+	if n := len(um.pending); n > 0 && um.pending[n-1].Delete {
+		um.pending[n-1].Lines = append(um.pending[n-1].Lines, line)
+	} else {
+		um.pending = append(um.pending, logEntry{Lines: []int64{line}, Delete: true})
+	}
+}
+
+// set applies an update; an offset below 0 is unknown.
+func (um *UpdateManager) set(line, offset int64, values map[string]string) {
+	key := lineKey(line)
+	if offset >= 0 {
+		um.Offsets[key] = offset
+	}
+	row := um.Overrides[key]
+	if row == nil {
+		row = make(map[string]string, len(values))
+		um.Overrides[key] = row
+	}
+	for col, val := range values {
+		row[col] = val
+	}
+}
+
+func (um *UpdateManager) delete(line int64) {
+	key := lineKey(line)
+	delete(um.Overrides, key)
+	delete(um.Offsets, key)
+	um.Deleted[key] = true
+}
+
+// IsDeleted reports whether a row has been deleted. A nil manager has no
+// deleted rows.
+func (um *UpdateManager) IsDeleted(line int64) bool {
+	if um == nil {
+		return false
+	}
 	um.mu.RLock()
 	defer um.mu.RUnlock()
-	key := fmt.Sprintf("%d", offset)
-	if row, ok := um.Overrides[key]; ok {
-		return row
+	return len(um.Deleted) > 0 && um.Deleted[lineKey(line)]
+}
+
+// deletedCount returns the number of deleted rows.
+func (um *UpdateManager) deletedCount() int64 {
+	if um == nil {
+		return 0
 	}
-	return nil
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+	return int64(len(um.Deleted))
+}
+
+// apply overwrites the fields of a row with its pending updates. A nil
+// manager has none.
+func (um *UpdateManager) apply(fields []string, headerMap map[string]int, lineNum int64) {
+	if um == nil {
+		return
+	}
+	for col, val := range um.GetRow(lineNum) {
+		if idx, ok := headerMap[col]; ok && idx < len(fields) {
+			fields[idx] = val
+		}
+	}
+}
+
+// linesTouching returns, in ascending order, the lines that were deleted or
+// whose pending updates set any of cols.
+func (um *UpdateManager) linesTouching(cols []string) []int64 {
+	if um == nil {
+		return nil
+	}
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+	var lines []int64
+	for key := range um.Deleted {
+		if line, err := strconv.ParseInt(key, 10, 64); err == nil {
+			lines = append(lines, line)
+		}
+	}
+	for key, row := range um.Overrides {
+		line, err := strconv.ParseInt(key, 10, 64)
+		if err != nil {
+			continue
+		}
+		for _, col := range cols {
+			if _, ok := row[col]; ok {
+				lines = append(lines, line)
+				break
+			}
+		}
+	}
+	slices.Sort(lines)
+	return lines
+}
+
+// rowOffsets returns the offsets of those of lines whose updates recorded
+// them, and the other lines.
+func (um *UpdateManager) rowOffsets(lines []int64) (map[int64]int64, []int64) {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+	offsets := make(map[int64]int64, len(lines))
+	var unknown []int64
+	for _, line := range lines {
+		if offset, ok := um.Offsets[lineKey(line)]; ok {
+			offsets[line] = offset
+		} else {
+			unknown = append(unknown, line)
+		}
+	}
+	return offsets, unknown
+}
+
+// GetRow returns the pending column updates of a line, or nil.
+func (um *UpdateManager) GetRow(line int64) map[string]string {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+	if len(um.Overrides) == 0 {
+		return nil
+	}
+	return um.Overrides[lineKey(line)]
 }
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/index"
+	"github.com/csvquery/csvquery/pkg/csvquery/storage"
+)
+
+// Cache keeps DiskIndex handles and CSV mmaps open between requests.
+// Entries are validated against the file on every acquire; when a file is
+// replaced or modified the old entry is retired and closed as soon as the
+// last in-flight request releases it.
+type Cache struct {
+	mu      sync.Mutex
+	indexes map[string]*cacheEntry
+	files   map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	infos   []os.FileInfo
+	refs    int
+	retired bool
+	idx     *index.DiskIndex
+	file    *os.File
+	data    []byte
+}
+
+func NewCache() *Cache {
+	return &Cache{
+		indexes: make(map[string]*cacheEntry),
+		files:   make(map[string]*cacheEntry),
+	}
+}
+
+// OpenIndex returns a shared DiskIndex for path. The bloom filter sidecar is
+// part of the validity check, since it is rewritten after the index itself.
+func (c *Cache) OpenIndex(path string) (*index.DiskIndex, func(), error) {
+	entry, err := c.acquire(c.indexes, path, []string{"", ".bloom"}, func(key string) (*cacheEntry, error) {
+		idx, err := index.OpenDiskIndex(key)
+		if err != nil {
+			return nil, err
+		}
+		return &cacheEntry{idx: idx}, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return entry.idx, c.releaser(entry), nil
+}
+
+// MapFile returns a shared read-only mapping of path.
+func (c *Cache) MapFile(path string) ([]byte, func(), error) {
+	entry, err := c.acquire(c.files, path, []string{""}, func(key string) (*cacheEntry, error) {
+		f, err := os.Open(key)
+		if err != nil {
+			return nil, err
+		}
+		data, err := storage.MmapFile(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &cacheEntry{file: f, data: data}, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return entry.data, c.releaser(entry), nil
+}
+
+// Close retires every entry. Entries still in use are closed on release.
+func (c *Cache) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, m := range []map[string]*cacheEntry{c.indexes, c.files} {
+		for key, entry := range m {
+			c.retire(m, key, entry)
+		}
+	}
+}
+
+// acquire returns the cached entry for path, reopening it when the file (or
+// any of the sidecar files named by suffixes) changed since it was cached.
+// The first suffix must name a file that exists; the others are optional.
+func (c *Cache) acquire(m map[string]*cacheEntry, path string, suffixes []string, open func(string) (*cacheEntry, error)) (*cacheEntry, error) {
+	key, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, len(suffixes))
+	for i, suffix := range suffixes {
+		info, err := os.Stat(key + suffix)
+		if err != nil {
+			if i == 0 || !os.IsNotExist(err) {
+				return nil, err
+			}
+			continue
+		}
+		infos[i] = info
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry, ok := m[key]; ok {
+		if sameFiles(entry.infos, infos) {
+			entry.refs++
+			return entry, nil
+		}
+		c.retire(m, key, entry)
+	}
+
+	entry, err := open(key)
+	if err != nil {
+		return nil, err
+	}
+	entry.infos = infos
+	entry.refs = 1
+	m[key] = entry
+	return entry, nil
+}
+
+func (c *Cache) releaser(entry *cacheEntry) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			entry.refs--
+			if entry.retired && entry.refs == 0 {
+				entry.close()
+			}
+		})
+	}
+}
+
+// retire must be called with c.mu held.
+func (c *Cache) retire(m map[string]*cacheEntry, key string, entry *cacheEntry) {
+	delete(m, key)
+	entry.retired = true
+	if entry.refs == 0 {
+		entry.close()
+	}
+}
+
+func (e *cacheEntry) close() {
+	if e.idx != nil {
+		e.idx.Close()
+	}
+	if e.file != nil {
+		storage.MunmapFile(e.data)
+		e.file.Close()
+	}
+}
+
+func sameFiles(a, b []os.FileInfo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] == nil || b[i] == nil {
+			if a[i] != b[i] {
+				return false
+			}
+			continue
+		}
+		if !os.SameFile(a[i], b[i]) || a[i].Size() != b[i].Size() || !a[i].ModTime().Equal(b[i].ModTime()) {
+			return false
+		}
+	}
+	return true
+}
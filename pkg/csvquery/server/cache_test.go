@@ -0,0 +1,127 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/index"
+)
+
+// lookup returns the lines of the records of key in idx.
+func lookup(t *testing.T, idx *index.DiskIndex, key string) []int64 {
+	t.Helper()
+	it, err := idx.Search(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	var lines []int64
+	for it.Next() {
+		lines = append(lines, it.Record().Line)
+	}
+	if err := it.Error(); err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+func buildIndex(t *testing.T, csvPath, content string) {
+	t.Helper()
+	if err := os.WriteFile(csvPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	manager := index.NewIndexManager(index.IndexerConfig{
+		InputFile: csvPath,
+		OutputDir: filepath.Dir(csvPath),
+		Columns:   `["name"]`,
+		Full:      true,
+	})
+	if err := manager.Run(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCacheRebuildWhileHeld(t *testing.T) {
+	dir := t.TempDir()
+	csvPath := filepath.Join(dir, "data.csv")
+	indexPath := filepath.Join(dir, "data_name.cidx")
+	buildIndex(t, csvPath, "id,name\n1,a\n2,b\n")
+
+	c := NewCache()
+	defer c.Close()
+	old, releaseOld, err := c.OpenIndex(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	same, releaseSame, err := c.OpenIndex(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseSame()
+	if same != old {
+		t.Fatal("an unchanged index was opened again")
+	}
+
+	buildIndex(t, csvPath, "id,name\n1,b\n2,b\n3,a\n4,c\n")
+
+	// The held handle keeps reading the index it opened
+	if got := lookup(t, old, "b"); len(got) != 1 || got[0] != 3 {
+		t.Fatalf("old index lookup = %v, want [3]", got)
+	}
+
+	idx, release, err := c.OpenIndex(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx == old {
+		t.Fatal("the rebuilt index was not opened again")
+	}
+	if got := lookup(t, idx, "b"); len(got) != 2 || got[0] != 2 || got[1] != 3 {
+		t.Fatalf("new index lookup = %v, want [2 3]", got)
+	}
+	release()
+
+	// Releasing twice closes the old index once
+	releaseOld()
+	releaseOld()
+	if got := lookup(t, idx, "a"); len(got) != 1 || got[0] != 4 {
+		t.Fatalf("new index lookup after the old one was released = %v, want [4]", got)
+	}
+}
+
+func TestCacheReplacedFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.csv")
+	if err := os.WriteFile(path, []byte("id\n1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCache()
+	defer c.Close()
+	old, releaseOld, err := c.MapFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmp := filepath.Join(dir, "data.csv.tmp")
+	if err := os.WriteFile(tmp, []byte("id\n1\n2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+
+	data, release, err := c.MapFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if string(data) != "id\n1\n2\n" {
+		t.Fatalf("mapped %q after the file was replaced", data)
+	}
+	if string(old) != "id\n1\n" {
+		t.Fatalf("old mapping reads %q", old)
+	}
+	releaseOld()
+}
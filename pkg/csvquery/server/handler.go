@@ -0,0 +1,518 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/index"
+	"github.com/csvquery/csvquery/pkg/csvquery/query"
+	"github.com/csvquery/csvquery/pkg/csvquery/sql"
+	"github.com/csvquery/csvquery/pkg/csvquery/storage"
+	"github.com/csvquery/csvquery/pkg/csvquery/types"
+)
+
+// Handler dispatches decoded JSON requests to the indexer and the query engine.
+// It is shared by the one-shot CLI and the daemon.
+type Handler struct {
+	Resources query.Resources
+}
+
+// NewHandler creates a handler. A nil resources value makes every request
+// open and close its own index handles and mmaps.
+func NewHandler(resources query.Resources) *Handler {
+	return &Handler{Resources: resources}
+}
+
+// Handle executes a single request and writes its response to w.
+func (h *Handler) Handle(req map[string]interface{}, w io.Writer) error {
+	action, ok := req["action"].(string)
+	if !ok {
+		return fmt.Errorf("Action required")
+	}
+
+	switch action {
+	case "index":
+		return h.handleIndex(req, w)
+	case "query", "count":
+		return h.handleQuery(req, w)
+	case "update", "delete":
+		return h.handleModify(req, w)
+	case "insert":
+		return h.handleInsert(req, w)
+	case "compact":
+		return h.handleCompact(req, w)
+	default:
+		return fmt.Errorf("Unknown action: %s", action)
+	}
+}
+
+func (h *Handler) handleIndex(req map[string]interface{}, w io.Writer) error {
+	cfg := index.IndexerConfig{
+		InputFile:   getString(req, "csv"),
+		OutputDir:   getString(req, "out"),
+		Columns:     getString(req, "cols"), // JSON string
+		Separator:   getString(req, "sep"),
+		Workers:     getInt(req, "workers"),
+		MemoryMB:    getInt(req, "memory"),
+		BloomFPRate: getFloat(req, "bloom_rate"),
+		Verbose:     getBool(req, "verbose"),
+		Full:        getBool(req, "full"),
+		StalePolicy: getString(req, "stalePolicy"),
+	}
+
+	if cfg.Separator == "" {
+		cfg.Separator = ","
+	}
+	if !types.ValidStalePolicy(cfg.StalePolicy) {
+		return fmt.Errorf("Invalid stalePolicy: %s", cfg.StalePolicy)
+	}
+
+	var err error
+	if cfg.Types, err = getTypes(req, "types"); err != nil {
+		return err
+	}
+
+	// The shared lock lets queries run during the build, while inserts,
+	// updates and compactions, which take it exclusively, wait for the
+	// build to finish, so no inserted row is left out of both the new index
+	// and its delta
+	lock, err := lockCSV(cfg.InputFile)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	manager := index.NewIndexManager(cfg)
+	if err := manager.Run(); err != nil {
+		return err
+	}
+
+	response := map[string]string{"status": "ok", "mode": manager.Mode()}
+	return json.NewEncoder(w).Encode(response)
+}
+
+func (h *Handler) handleQuery(req map[string]interface{}, w io.Writer) error {
+	cfg := types.QueryConfig{
+		CsvPath:   getString(req, "csv"),
+		IndexDir:  getString(req, "indexDir"),
+		GroupBy:   getString(req, "groupBy"),
+		AggCol:    getString(req, "aggCol"),
+		AggFunc:   getString(req, "aggFunc"),
+		CountOnly: getString(req, "action") == "count" || getBool(req, "countOnly"),
+		Limit:     getInt(req, "limit"),
+		Offset:    getInt(req, "offset"),
+		SortMemMB: getInt(req, "sortMemory"),
+		Explain:   getBool(req, "explain"),
+		Analyze:   getBool(req, "analyze"),
+		Protocol:  getInt(req, "protocol"),
+		OnStale:   getString(req, "onStale"),
+	}
+
+	// The statement is compiled before the result writer exists because it
+	// decides between a count and a row query, which the NDJSON header reports.
+	var where *types.Condition
+	var reqErr error
+	cfg.OrderBy, reqErr = getOrderBy(req, "orderBy")
+	if reqErr == nil {
+		cfg.Select, reqErr = getColumns(req, "select")
+	}
+	if reqErr == nil {
+		cfg.Types, reqErr = getTypes(req, "types")
+	}
+	if text := getString(req, "sql"); text != "" && reqErr == nil {
+		where, reqErr = compileSQL(text, req, &cfg)
+	}
+	if cfg.IndexDir == "" && cfg.CsvPath != "" {
+		// Indexes are written next to the CSV unless told otherwise
+		cfg.IndexDir = filepath.Dir(cfg.CsvPath)
+	}
+
+	rw, err := query.NewResultWriter(cfg, w)
+	if err != nil {
+		return err
+	}
+	if reqErr != nil {
+		return rw.Finish(reqErr)
+	}
+	return rw.Finish(h.runQuery(req, cfg, where, rw))
+}
+
+func compileSQL(text string, req map[string]interface{}, cfg *types.QueryConfig) (*types.Condition, error) {
+	if _, ok := req["where"]; ok {
+		return nil, fmt.Errorf("sql and where cannot be combined")
+	}
+	if len(cfg.OrderBy) > 0 || len(cfg.Select) > 0 {
+		return nil, fmt.Errorf("sql cannot be combined with orderBy or select")
+	}
+	where, err := sql.Compile(text, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid sql: %s", err.Error())
+	}
+	return where, nil
+}
+
+func (h *Handler) runQuery(req map[string]interface{}, cfg types.QueryConfig, where *types.Condition, rw query.ResultWriter) error {
+	if whereData, ok := req["where"]; ok {
+		// ParseCondition works on raw JSON, so re-marshal the decoded value.
+		bytes, _ := json.Marshal(whereData)
+		var err error
+		where, err = query.ParseCondition(bytes)
+		if err != nil {
+			return fmt.Errorf("Invalid where condition: %s", err.Error())
+		}
+	}
+
+	lock, err := lockCSV(cfg.CsvPath)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	// Without its pending updates a query would return deleted rows and old
+	// values, so an updates file that cannot be read fails it
+	updates, err := query.LoadUpdates(cfg.CsvPath)
+	if err != nil {
+		return err
+	}
+
+	executor := query.NewExecutor(cfg.IndexDir, updates)
+	executor.Lock = lock
+	if h.Resources != nil {
+		executor.Resources = h.Resources
+	}
+	return executor.Run(cfg, where, rw)
+}
+
+// handleModify records updates or deletions for the rows matching where,
+// which is required so that a forgotten condition cannot change every row;
+// {} matches all of them.
+func (h *Handler) handleModify(req map[string]interface{}, w io.Writer) error {
+	action := getString(req, "action")
+	cfg := types.QueryConfig{
+		CsvPath:   getString(req, "csv"),
+		IndexDir:  getString(req, "indexDir"),
+		SortMemMB: getInt(req, "sortMemory"),
+		OnStale:   getString(req, "onStale"),
+	}
+
+	if cfg.CsvPath == "" {
+		return fmt.Errorf("csv path required")
+	}
+	if cfg.IndexDir == "" {
+		cfg.IndexDir = filepath.Dir(cfg.CsvPath)
+	}
+	whereData, ok := req["where"]
+	if !ok {
+		return fmt.Errorf("%s requires where", action)
+	}
+	bytes, _ := json.Marshal(whereData)
+	where, err := query.ParseCondition(bytes)
+	if err != nil {
+		return fmt.Errorf("Invalid where condition: %s", err.Error())
+	}
+	if cfg.Types, err = getTypes(req, "types"); err != nil {
+		return err
+	}
+
+	// The rows are matched and their changes logged under the exclusive
+	// lock, so no insert or compaction moves them in between
+	lock, err := storage.LockExclusive(cfg.CsvPath)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	updates, err := query.LoadUpdates(cfg.CsvPath)
+	if err != nil {
+		return err
+	}
+	executor := query.NewExecutor(cfg.IndexDir, updates)
+	executor.Lock = lock
+	if h.Resources != nil {
+		executor.Resources = h.Resources
+	}
+
+	var affected int64
+	if action == "update" {
+		set, err := getAssignments(req, "set")
+		if err != nil {
+			return err
+		}
+		affected, err = executor.Update(cfg, where, set)
+		if err != nil {
+			return err
+		}
+	} else if affected, err = executor.Delete(cfg, where); err != nil {
+		return err
+	}
+
+	response := map[string]interface{}{"status": "ok", "affected": affected}
+	return json.NewEncoder(w).Encode(response)
+}
+
+// handleInsert appends rows to the CSV and to the deltas of its indexes,
+// which are looked for next to the CSV unless indexDir is set.
+func (h *Handler) handleInsert(req map[string]interface{}, w io.Writer) error {
+	csvPath := getString(req, "csv")
+	if csvPath == "" {
+		return fmt.Errorf("csv path required")
+	}
+	indexDir := getString(req, "indexDir")
+	if indexDir == "" {
+		indexDir = filepath.Dir(csvPath)
+	}
+	rows, err := getRows(req, "rows")
+	if err != nil {
+		return err
+	}
+	affected, err := query.Insert(csvPath, indexDir, rows)
+	if err != nil {
+		return err
+	}
+
+	response := map[string]interface{}{"status": "ok", "affected": affected}
+	return json.NewEncoder(w).Encode(response)
+}
+
+// handleCompact rewrites the CSV with its pending updates and rebuilds its
+// indexes, which are looked for next to the CSV unless indexDir is set.
+func (h *Handler) handleCompact(req map[string]interface{}, w io.Writer) error {
+	csvPath := getString(req, "csv")
+	if csvPath == "" {
+		return fmt.Errorf("csv path required")
+	}
+	indexDir := getString(req, "indexDir")
+	if indexDir == "" {
+		indexDir = filepath.Dir(csvPath)
+	}
+	res, err := query.Compact(csvPath, indexDir, query.CompactOptions{
+		Workers:     getInt(req, "workers"),
+		MemoryMB:    getInt(req, "memory"),
+		BloomFPRate: getFloat(req, "bloom_rate"),
+	})
+	if err != nil {
+		return err
+	}
+
+	response := map[string]interface{}{
+		"status":  "ok",
+		"rows":    res.Rows,
+		"updated": res.Updated,
+		"deleted": res.Deleted,
+		"indexes": res.Indexes,
+	}
+	return json.NewEncoder(w).Encode(response)
+}
+
+// lockCSV takes the shared lock of the CSV a request reads, so that a
+// compaction cannot replace the CSV, its indexes or its updates while the
+// request uses them.
+func lockCSV(csvPath string) (*storage.FileLock, error) {
+	if csvPath == "" {
+		return &storage.FileLock{}, nil
+	}
+	return storage.LockShared(csvPath)
+}
+
+// getColumns accepts a list of column names or a comma separated string.
+// Names are lower-cased like the columns of conditions.
+func getColumns(m map[string]interface{}, key string) ([]string, error) {
+	var names []string
+	switch v := m[key].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		names = strings.Split(v, ",")
+	case []interface{}:
+		for _, item := range v {
+			name, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("Invalid %s: expected column names", key)
+			}
+			names = append(names, name)
+		}
+	default:
+		return nil, fmt.Errorf("Invalid %s: expected a string or a list", key)
+	}
+
+	columns := make([]string, 0, len(names))
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			return nil, fmt.Errorf("Invalid %s: empty column name", key)
+		}
+		columns = append(columns, name)
+	}
+	return columns, nil
+}
+
+// getOrderBy accepts either "col [ASC|DESC], ..." or a list whose items are
+// such strings or {"column": ..., "desc": ...} objects.
+func getOrderBy(m map[string]interface{}, key string) ([]types.OrderColumn, error) {
+	var items []interface{}
+	switch v := m[key].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		for _, part := range strings.Split(v, ",") {
+			items = append(items, part)
+		}
+	case []interface{}:
+		items = v
+	default:
+		return nil, fmt.Errorf("Invalid orderBy: expected a string or a list")
+	}
+
+	var order []types.OrderColumn
+	for _, item := range items {
+		var col types.OrderColumn
+		switch v := item.(type) {
+		case string:
+			fields := strings.Fields(v)
+			if len(fields) == 0 || len(fields) > 2 {
+				return nil, fmt.Errorf("Invalid orderBy: %q", v)
+			}
+			col.Column = fields[0]
+			if len(fields) == 2 {
+				switch strings.ToUpper(fields[1]) {
+				case "ASC":
+				case "DESC":
+					col.Desc = true
+				default:
+					return nil, fmt.Errorf("Invalid orderBy direction: %q", fields[1])
+				}
+			}
+		case map[string]interface{}:
+			col.Column = getString(v, "column")
+			col.Desc = getBool(v, "desc")
+			if col.Column == "" {
+				return nil, fmt.Errorf("Invalid orderBy: column required")
+			}
+		default:
+			return nil, fmt.Errorf("Invalid orderBy: unexpected %v", item)
+		}
+		col.Column = strings.ToLower(col.Column)
+		order = append(order, col)
+	}
+	return order, nil
+}
+
+// getTypes accepts an object mapping column names to a type name or to a
+// {"type": ..., "format": ...} object.
+func getTypes(m map[string]interface{}, key string) (map[string]types.ColumnSpec, error) {
+	var decl map[string]interface{}
+	switch v := m[key].(type) {
+	case nil:
+		return nil, nil
+	case map[string]interface{}:
+		decl = v
+	default:
+		return nil, fmt.Errorf("Invalid %s: expected an object", key)
+	}
+
+	specs := make(map[string]types.ColumnSpec, len(decl))
+	for col, item := range decl {
+		var typ, format string
+		switch v := item.(type) {
+		case string:
+			typ = v
+		case map[string]interface{}:
+			typ = getString(v, "type")
+			format = getString(v, "format")
+		default:
+			return nil, fmt.Errorf("Invalid %s for %s: expected a type name or an object", key, col)
+		}
+		spec, err := types.ParseColumnSpec(typ, format)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s for %s: %s", key, col, err.Error())
+		}
+		specs[strings.ToLower(strings.TrimSpace(col))] = spec
+	}
+	return specs, nil
+}
+
+// getAssignments accepts an object mapping column names to new values.
+// Numbers and booleans are written as text and null as an empty field.
+func getAssignments(m map[string]interface{}, key string) (map[string]string, error) {
+	decl, ok := m[key].(map[string]interface{})
+	if !ok || len(decl) == 0 {
+		return nil, fmt.Errorf("Invalid %s: expected an object of column values", key)
+	}
+	return parseAssignments(decl, key)
+}
+
+// getRows accepts a list of objects mapping column names to values, which
+// are converted like those of getAssignments.
+func getRows(m map[string]interface{}, key string) ([]map[string]string, error) {
+	decl, ok := m[key].([]interface{})
+	if !ok || len(decl) == 0 {
+		return nil, fmt.Errorf("Invalid %s: expected a list of rows", key)
+	}
+	rows := make([]map[string]string, len(decl))
+	for i, item := range decl {
+		row, ok := item.(map[string]interface{})
+		if !ok || len(row) == 0 {
+			return nil, fmt.Errorf("Invalid %s: expected an object of column values", key)
+		}
+		var err error
+		if rows[i], err = parseAssignments(row, key); err != nil {
+			return nil, err
+		}
+	}
+	return rows, nil
+}
+
+func parseAssignments(decl map[string]interface{}, key string) (map[string]string, error) {
+	set := make(map[string]string, len(decl))
+	for col, item := range decl {
+		var val string
+		switch v := item.(type) {
+		case nil:
+		case string:
+			val = v
+		case float64:
+			val = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			val = strconv.FormatBool(v)
+		default:
+			return nil, fmt.Errorf("Invalid %s for %s: expected a scalar", key, col)
+		}
+		set[strings.ToLower(strings.TrimSpace(col))] = val
+	}
+	return set, nil
+}
+
+func getString(m map[string]interface{}, key string) string {
+	if v, ok := m[key].(string); ok {
+		return v
+	}
+	return ""
+}
+
+func getInt(m map[string]interface{}, key string) int {
+	if v, ok := m[key].(float64); ok {
+		return int(v)
+	}
+	if v, ok := m[key].(int); ok {
+		return v
+	}
+	return 0
+}
+
+func getFloat(m map[string]interface{}, key string) float64 {
+	if v, ok := m[key].(float64); ok {
+		return v
+	}
+	return 0
+}
+
+func getBool(m map[string]interface{}, key string) bool {
+	if v, ok := m[key].(bool); ok {
+		return v
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/index"
+	"github.com/csvquery/csvquery/pkg/csvquery/types"
+)
+
+// handle runs the request, given as JSON, and returns the response.
+func handle(t *testing.T, request string) string {
+	t.Helper()
+	var req map[string]interface{}
+	if err := json.Unmarshal([]byte(request), &req); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := NewHandler(nil).Handle(req, &out); err != nil {
+		t.Fatalf("%s: %v", request, err)
+	}
+	return out.String()
+}
+
+// Requests without indexDir use the indexes next to the CSV.
+func TestIndexDirDefault(t *testing.T) {
+	dir := t.TempDir()
+	csvPath := filepath.Join(dir, "data.csv")
+	var b strings.Builder
+	b.WriteString("id,price\n")
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&b, "%d,%d\n", i, i%20)
+	}
+	if err := os.WriteFile(csvPath, []byte(b.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	manager := index.NewIndexManager(index.IndexerConfig{
+		InputFile: csvPath,
+		OutputDir: dir,
+		Columns:   `["id","price"]`,
+		Types:     map[string]types.ColumnSpec{"price": {Type: types.TypeInt}},
+	})
+	if err := manager.Run(); err != nil {
+		t.Fatal(err)
+	}
+	csv, _ := json.Marshal(csvPath)
+
+	for _, request := range []string{
+		`{"action":"query","csv":` + string(csv) + `,"where":{"id":"42"},"explain":true}`,
+		`{"action":"query","csv":` + string(csv) + `,"sql":"SELECT * FROM data WHERE id = '42'","explain":true}`,
+	} {
+		var plan struct{ Strategy string }
+		if err := json.Unmarshal([]byte(handle(t, request)), &plan); err != nil {
+			t.Fatal(err)
+		}
+		if plan.Strategy != "Index Scan" {
+			t.Errorf("%s runs as %s, want an index scan", request, plan.Strategy)
+		}
+	}
+
+	// The key type of the price index makes "9" compare as a number
+	out := handle(t, `{"action":"update","csv":`+string(csv)+`,"where":{"operator":">","column":"price","value":"9"},"set":{"id":"x"}}`)
+	if want := `{"affected":2500,"status":"ok"}`; strings.TrimSpace(out) != want {
+		t.Fatalf("update responded %s, want %s", out, want)
+	}
+}
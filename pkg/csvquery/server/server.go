@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/query"
+	"github.com/csvquery/csvquery/pkg/csvquery/utils"
+)
+
+// Server is a long-running daemon that accepts newline-delimited JSON
+// requests on a Unix domain socket. Each response is followed by an empty
+// line so clients can pipeline several requests over one connection.
+type Server struct {
+	SocketPath string
+
+	handler  *Handler
+	cache    *Cache
+	logger   utils.Logger
+	listener net.Listener
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	wg     sync.WaitGroup
+	closed bool
+}
+
+func NewServer(socketPath string, logger utils.Logger) *Server {
+	cache := NewCache()
+	return &Server{
+		SocketPath: socketPath,
+		handler:    NewHandler(cache),
+		cache:      cache,
+		logger:     logger,
+		conns:      make(map[net.Conn]struct{}),
+	}
+}
+
+// ListenAndServe binds the socket and serves clients until Close is called.
+func (s *Server) ListenAndServe() error {
+	if err := removeStaleSocket(s.SocketPath); err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("unix", s.SocketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.SocketPath, err)
+	}
+	s.mu.Lock()
+	s.listener = ln
+	s.mu.Unlock()
+	s.logger.Info("listening on %s", s.SocketPath)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops accepting clients, drops open connections once their current
+// request finishes, and releases cached resources.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		// Unblock idle readers; in-flight requests still finish writing.
+		if uc, ok := conn.(*net.UnixConn); ok {
+			uc.CloseRead()
+		} else {
+			conn.Close()
+		}
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	s.cache.Close()
+	os.Remove(s.SocketPath)
+	return err
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			s.serveRequest(line, writer)
+			if flushErr := writer.Flush(); flushErr != nil {
+				s.logger.Debug("write failed: %v", flushErr)
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				s.logger.Debug("read failed: %v", err)
+			}
+			return
+		}
+	}
+}
+
+func (s *Server) serveRequest(line []byte, w *bufio.Writer) {
+	defer w.WriteByte('\n')
+	defer func() {
+		if r := recover(); r != nil {
+			s.logger.Error("request panicked: %v", r)
+			writeError(w, fmt.Sprintf("internal error: %v", r))
+		}
+	}()
+
+	var req map[string]interface{}
+	if err := json.Unmarshal(line, &req); err != nil {
+		writeError(w, "Invalid JSON request: "+err.Error())
+		return
+	}
+	if err := s.handler.Handle(req, w); err != nil {
+		var reported *query.ReportedError
+		if !errors.As(err, &reported) {
+			writeError(w, err.Error())
+		}
+	}
+}
+
+func writeError(w io.Writer, msg string) {
+	resp := map[string]string{"status": "error", "error": msg}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// removeStaleSocket deletes a socket file left behind by a daemon that is no
+// longer running. A socket that still accepts connections is an error.
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("another daemon is already listening on %s", path)
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,129 @@
+package sql
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/query"
+	"github.com/csvquery/csvquery/pkg/csvquery/types"
+)
+
+// Compile parses text and fills cfg with the equivalent query
+// configuration. It returns the WHERE condition, or nil if there is none.
+// The FROM clause only sets cfg.CsvPath if the caller left it empty.
+func Compile(text string, cfg *types.QueryConfig) (*types.Condition, error) {
+	stmt, err := Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if err := stmt.apply(cfg); err != nil {
+		return nil, err
+	}
+	return stmt.Where, nil
+}
+
+func (s *Statement) apply(cfg *types.QueryConfig) error {
+	if cfg.CsvPath == "" {
+		cfg.CsvPath = s.From
+	}
+
+	if len(s.GroupBy) > 1 {
+		return fmt.Errorf("GROUP BY supports a single column")
+	}
+	if len(s.GroupBy) == 1 {
+		cfg.GroupBy = s.GroupBy[0]
+	}
+
+	var agg *SelectItem
+	aliased := make(map[string]string) // lower-cased alias -> column
+	for i := range s.Columns {
+		item := &s.Columns[i]
+		if item.Alias != "" && (item.Func != "" || cfg.GroupBy != "") {
+			return fmt.Errorf("AS %s: aliases are only supported on the columns of a row query", item.Alias)
+		}
+		switch {
+		case item.Func != "":
+			if agg != nil {
+				return fmt.Errorf("only one aggregate per query is supported")
+			}
+			if item.Distinct {
+				return fmt.Errorf("%s(DISTINCT ...) is not supported", strings.ToUpper(item.Func))
+			}
+			agg = item
+		case item.Star:
+			if cfg.GroupBy != "" {
+				return fmt.Errorf("SELECT * cannot be combined with GROUP BY")
+			}
+			if len(s.Columns) > 1 {
+				return fmt.Errorf("SELECT * cannot be combined with other columns")
+			}
+		case cfg.GroupBy == "":
+			name := item.Column
+			if item.Alias != "" {
+				name = item.Alias
+				if _, dup := aliased[strings.ToLower(name)]; dup {
+					return fmt.Errorf("alias %s is used twice", name)
+				}
+				aliased[strings.ToLower(name)] = item.Column
+			}
+			cfg.Select = append(cfg.Select, item.Column)
+			cfg.Names = append(cfg.Names, name)
+		case item.Column != cfg.GroupBy:
+			return fmt.Errorf("column %q must appear in GROUP BY or be used in an aggregate", item.Column)
+		}
+	}
+
+	switch {
+	case agg != nil && cfg.GroupBy != "":
+		cfg.AggFunc = agg.Func
+		cfg.AggCol = agg.Column
+	case agg != nil:
+		if agg.Func != "count" {
+			return fmt.Errorf("%s without GROUP BY is not supported", strings.ToUpper(agg.Func))
+		}
+		if len(s.Columns) > 1 {
+			return fmt.Errorf("COUNT cannot be combined with other columns without GROUP BY")
+		}
+		cfg.Select, cfg.Names = nil, nil
+		if agg.Column != "" {
+			// COUNT(col) only counts rows where col is set
+			notNull := &types.Condition{Operator: types.OpIsNotNull, Column: agg.Column}
+			if s.Where == nil {
+				s.Where = notNull
+			} else {
+				s.Where = combine("AND", s.Where, notNull)
+			}
+		}
+		cfg.CountOnly = true
+	case cfg.GroupBy != "":
+		// SELECT col ... GROUP BY col lists the distinct values with their counts
+		cfg.AggFunc = "count"
+	}
+
+	if len(aliased) == 0 {
+		cfg.Names = nil
+	}
+	for _, o := range s.OrderBy {
+		// ORDER BY may name a column by its alias
+		col := o.Column
+		if aliasOf, ok := aliased[col]; ok {
+			col = aliasOf
+		}
+		cfg.OrderBy = append(cfg.OrderBy, types.OrderColumn{Column: col, Desc: o.Desc})
+	}
+
+	if s.HasLimit {
+		if s.Limit == 0 {
+			return fmt.Errorf("LIMIT 0 is not supported")
+		}
+		cfg.Limit = s.Limit
+	}
+	if s.HasOffset {
+		cfg.Offset = s.Offset
+	}
+
+	if s.Where != nil {
+		query.ResolveTargets(s.Where)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package sql
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/types"
+)
+
+func TestCompileMalformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"empty", "", "expected SELECT"},
+		{"no FROM", "SELECT *", "expected FROM"},
+		{"no table", "SELECT * FROM", "expected table name"},
+		{"trailing tokens", "SELECT * FROM d.csv extra", "unexpected"},
+		{"unterminated string", "SELECT * FROM d.csv WHERE a = 'x", "unterminated quoted text"},
+		{"unexpected character", "SELECT * FROM d.csv WHERE a = #", "unexpected character"},
+		{"number with two points", "SELECT * FROM d.csv WHERE a > 1.2.3", `malformed number "1.2.3"`},
+		{"number with letters", "SELECT * FROM d.csv WHERE a > 12ab", `malformed number "12ab"`},
+		{"missing operator", "SELECT * FROM d.csv WHERE a 1", "expected comparison operator"},
+		{"missing value", "SELECT * FROM d.csv WHERE a =", "expected literal value"},
+		{"compare with NULL", "SELECT * FROM d.csv WHERE a = NULL", "IS NULL"},
+		{"dangling AND", "SELECT * FROM d.csv WHERE a = 1 AND", "expected column name"},
+		{"unclosed parenthesis", "SELECT * FROM d.csv WHERE (a = 1", `expected ")"`},
+		{"empty IN list", "SELECT * FROM d.csv WHERE a IN ()", "expected literal value"},
+		{"NOT without operator", "SELECT * FROM d.csv WHERE a NOT = 1", "after NOT"},
+		{"LIKE with a number", "SELECT * FROM d.csv WHERE a LIKE 1", "expects a string pattern"},
+		{"long ESCAPE", "SELECT * FROM d.csv WHERE a LIKE 'x' ESCAPE 'ab'", "single character"},
+		{"negative LIMIT", "SELECT * FROM d.csv LIMIT -1", "non-negative integer"},
+		{"fractional LIMIT", "SELECT * FROM d.csv LIMIT 1.5", "non-negative integer"},
+		{"LIMIT 0", "SELECT * FROM d.csv LIMIT 0", "LIMIT 0"},
+		{"OFFSET twice", "SELECT * FROM d.csv LIMIT 1, 1 OFFSET 2", "OFFSET given twice"},
+		{"missing alias", "SELECT a AS FROM d.csv", "expected alias"},
+		{"duplicate alias", "SELECT a AS x, b AS x FROM d.csv", "alias x is used twice"},
+		{"alias on aggregate", "SELECT COUNT(*) AS n FROM d.csv", "aliases are only supported"},
+		{"two aggregates", "SELECT a, COUNT(*), SUM(b) FROM d.csv GROUP BY a", "only one aggregate"},
+		{"star with columns", "SELECT *, a FROM d.csv", "SELECT * cannot be combined"},
+		{"column outside GROUP BY", "SELECT a, b FROM d.csv GROUP BY a", "must appear in GROUP BY"},
+		{"two group columns", "SELECT a, COUNT(*) FROM d.csv GROUP BY a, b", "single column"},
+		{"SUM without GROUP BY", "SELECT SUM(a) FROM d.csv", "without GROUP BY"},
+		{"COUNT with columns", "SELECT a, COUNT(*) FROM d.csv", "COUNT cannot be combined"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg types.QueryConfig
+			_, err := Compile(tt.query, &cfg)
+			if err == nil {
+				t.Fatalf("Compile(%q) succeeded, want an error containing %q", tt.query, tt.want)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Compile(%q) = %v, want an error containing %q", tt.query, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileNumbers(t *testing.T) {
+	tests := []struct {
+		query string
+		want  json.Number
+	}{
+		{"SELECT * FROM d.csv WHERE a = 12", json.Number("12")},
+		{"SELECT * FROM d.csv WHERE a = -1.5", json.Number("-1.5")},
+		{"SELECT * FROM d.csv WHERE a = .5", json.Number(".5")},
+	}
+
+	for _, tt := range tests {
+		var cfg types.QueryConfig
+		where, err := Compile(tt.query, &cfg)
+		if err != nil {
+			t.Fatalf("Compile(%q): %v", tt.query, err)
+		}
+		if where == nil || where.Value != tt.want {
+			t.Fatalf("Compile(%q) = %+v, want value %v", tt.query, where, tt.want)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package sql
+
+import (
+	"fmt"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokKeyword
+	tokString
+	tokNumber
+	tokSymbol
+)
+
+func (k tokenKind) String() string {
+	switch k {
+	case tokEOF:
+		return "end of input"
+	case tokIdent:
+		return "identifier"
+	case tokKeyword:
+		return "keyword"
+	case tokString:
+		return "string"
+	case tokNumber:
+		return "number"
+	}
+	return "symbol"
+}
+
+type token struct {
+	kind tokenKind
+	text string // keywords are upper-cased, quoted identifiers and strings unquoted
+	pos  int
+}
+
+var keywords = map[string]bool{
+	"SELECT": true, "FROM": true, "WHERE": true, "AND": true, "OR": true, "NOT": true,
+	"GROUP": true, "BY": true, "ORDER": true, "ASC": true, "DESC": true, "LIMIT": true,
+	"OFFSET": true, "AS": true, "IN": true, "IS": true, "NULL": true, "LIKE": true,
+	"BETWEEN": true, "DISTINCT": true, "ILIKE": true, "ESCAPE": true,
+}
+
+// lex splits a query into tokens.
+func lex(input string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(input) {
+		c := input[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case c == '-' && i+1 < len(input) && input[i+1] == '-':
+			// Line comment
+			for i < len(input) && input[i] != '\n' {
+				i++
+			}
+
+		case isIdentStart(c):
+			start := i
+			for i < len(input) && isIdentPart(input[i]) {
+				i++
+			}
+			word := input[start:i]
+			if upper := strings.ToUpper(word); keywords[upper] {
+				tokens = append(tokens, token{kind: tokKeyword, text: upper, pos: start})
+			} else {
+				tokens = append(tokens, token{kind: tokIdent, text: word, pos: start})
+			}
+
+		case c == '"' || c == '`':
+			text, next, err := lexQuoted(input, i, c)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: text, pos: i})
+			i = next
+
+		case c == '\'':
+			text, next, err := lexQuoted(input, i, c)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: tokString, text: text, pos: i})
+			i = next
+
+		case isDigit(c) || (c == '-' || c == '.') && i+1 < len(input) && isDigit(input[i+1]):
+			start := i
+			i++
+			for i < len(input) && (isDigit(input[i]) || input[i] == '.') {
+				i++
+			}
+			// Swallow what follows a malformed number, such as 1.2.3 or 12ab,
+			// to report it whole
+			for i < len(input) && isIdentPart(input[i]) {
+				i++
+			}
+			text := input[start:i]
+			if strings.Count(text, ".") > 1 || strings.IndexFunc(text[1:], func(r rune) bool { return !isDigit(byte(r)) && r != '.' }) >= 0 {
+				return nil, fmt.Errorf("malformed number %q at position %d", text, start)
+			}
+			tokens = append(tokens, token{kind: tokNumber, text: text, pos: start})
+
+		default:
+			start := i
+			sym := string(c)
+			if i+1 < len(input) {
+				switch two := input[i : i+2]; two {
+				case "<=", ">=", "!=", "<>":
+					sym = two
+				}
+			}
+			if !strings.Contains("(),*=<>!;", sym[:1]) || sym == "!" {
+				return nil, fmt.Errorf("unexpected character %q at position %d", c, start)
+			}
+			i += len(sym)
+			tokens = append(tokens, token{kind: tokSymbol, text: sym, pos: start})
+		}
+	}
+	tokens = append(tokens, token{kind: tokEOF, pos: len(input)})
+	return tokens, nil
+}
+
+// lexQuoted reads a quoted string starting at input[start]; a doubled quote
+// character stands for itself.
+func lexQuoted(input string, start int, quote byte) (string, int, error) {
+	var b strings.Builder
+	i := start + 1
+	for i < len(input) {
+		if input[i] == quote {
+			if i+1 < len(input) && input[i+1] == quote {
+				b.WriteByte(quote)
+				i += 2
+				continue
+			}
+			return b.String(), i + 1, nil
+		}
+		b.WriteByte(input[i])
+		i++
+	}
+	return "", 0, fmt.Errorf("unterminated quoted text at position %d", start)
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentPart(c byte) bool {
+	// Dots allow unquoted file names such as data.csv in FROM
+	return isIdentStart(c) || isDigit(c) || c == '.'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,494 @@
+package sql
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/csvquery/csvquery/pkg/csvquery/types"
+)
+
+// Statement is a parsed SELECT statement.
+type Statement struct {
+	Columns   []SelectItem
+	From      string
+	Where     *types.Condition
+	GroupBy   []string
+	OrderBy   []OrderItem
+	Limit     int
+	Offset    int
+	HasLimit  bool
+	HasOffset bool
+}
+
+// SelectItem is one entry of the select list: *, a column or an aggregate.
+type SelectItem struct {
+	Star     bool
+	Column   string // lower-cased; empty for COUNT(*)
+	Func     string // lower-cased aggregate function, if any
+	Distinct bool
+	Alias    string
+}
+
+// OrderItem is one ORDER BY column.
+type OrderItem struct {
+	Column string
+	Desc   bool
+}
+
+var aggregateFuncs = map[string]bool{
+	"count": true, "sum": true, "min": true, "max": true, "avg": true,
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// Parse parses a single SELECT statement.
+func Parse(query string) (*Statement, error) {
+	tokens, err := lex(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	stmt, err := p.parseSelect()
+	if err != nil {
+		return nil, err
+	}
+	p.acceptSymbol(";")
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, p.errorf(tok, "unexpected %s", describe(tok))
+	}
+	return stmt, nil
+}
+
+func (p *parser) parseSelect() (*Statement, error) {
+	if err := p.expectKeyword("SELECT"); err != nil {
+		return nil, err
+	}
+	stmt := &Statement{}
+
+	for {
+		item, err := p.parseSelectItem()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Columns = append(stmt.Columns, item)
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	tok := p.next()
+	if tok.kind != tokIdent && tok.kind != tokString {
+		return nil, p.errorf(tok, "expected table name, got %s", describe(tok))
+	}
+	stmt.From = tok.text
+
+	if p.acceptKeyword("WHERE") {
+		cond, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Where = cond
+	}
+
+	if p.acceptKeyword("GROUP") {
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			col, err := p.parseIdent()
+			if err != nil {
+				return nil, err
+			}
+			stmt.GroupBy = append(stmt.GroupBy, col)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+
+	if p.acceptKeyword("ORDER") {
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			col, err := p.parseIdent()
+			if err != nil {
+				return nil, err
+			}
+			item := OrderItem{Column: col}
+			if p.acceptKeyword("DESC") {
+				item.Desc = true
+			} else {
+				p.acceptKeyword("ASC")
+			}
+			stmt.OrderBy = append(stmt.OrderBy, item)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+
+	if p.acceptKeyword("LIMIT") {
+		n, err := p.parseCount()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Limit, stmt.HasLimit = n, true
+		// MySQL style LIMIT offset, count
+		if p.acceptSymbol(",") {
+			count, err := p.parseCount()
+			if err != nil {
+				return nil, err
+			}
+			stmt.Offset, stmt.HasOffset = n, true
+			stmt.Limit = count
+		}
+	}
+
+	if p.acceptKeyword("OFFSET") {
+		if stmt.HasOffset {
+			return nil, p.errorf(p.tokens[p.pos-1], "OFFSET given twice")
+		}
+		n, err := p.parseCount()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Offset, stmt.HasOffset = n, true
+	}
+
+	return stmt, nil
+}
+
+func (p *parser) parseSelectItem() (SelectItem, error) {
+	if p.acceptSymbol("*") {
+		return SelectItem{Star: true}, nil
+	}
+
+	tok := p.peek()
+	var item SelectItem
+	if tok.kind == tokIdent && aggregateFuncs[strings.ToLower(tok.text)] && p.peekAt(1).text == "(" && p.peekAt(1).kind == tokSymbol {
+		p.pos += 2
+		item.Func = strings.ToLower(tok.text)
+		if p.acceptSymbol("*") {
+			if item.Func != "count" {
+				return item, p.errorf(tok, "%s(*) is not supported", strings.ToUpper(item.Func))
+			}
+		} else {
+			item.Distinct = p.acceptKeyword("DISTINCT")
+			col, err := p.parseIdent()
+			if err != nil {
+				return item, err
+			}
+			item.Column = col
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return item, err
+		}
+	} else {
+		col, err := p.parseIdent()
+		if err != nil {
+			return item, err
+		}
+		item.Column = col
+	}
+
+	if p.acceptKeyword("AS") {
+		alias := p.next()
+		if alias.kind != tokIdent {
+			return item, p.errorf(alias, "expected alias, got %s", describe(alias))
+		}
+		item.Alias = alias.text
+	} else if p.peek().kind == tokIdent {
+		item.Alias = p.next().text
+	}
+	return item, nil
+}
+
+// parseOr, parseAnd and parseNot implement the usual precedence:
+// NOT binds tighter than AND, which binds tighter than OR.
+func (p *parser) parseOr() (*types.Condition, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = combine("OR", left, right)
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (*types.Condition, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("AND") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = combine("AND", left, right)
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (*types.Condition, error) {
+	if p.acceptKeyword("NOT") {
+		child, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return negate(child), nil
+	}
+	if p.acceptSymbol("(") {
+		cond, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		return cond, nil
+	}
+	return p.parsePredicate()
+}
+
+func (p *parser) parsePredicate() (*types.Condition, error) {
+	col, err := p.parseIdent()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.acceptKeyword("IS") {
+		op := types.OpIsNull
+		if p.acceptKeyword("NOT") {
+			op = types.OpIsNotNull
+		}
+		if err := p.expectKeyword("NULL"); err != nil {
+			return nil, err
+		}
+		return &types.Condition{Operator: op, Column: col}, nil
+	}
+
+	negated := p.acceptKeyword("NOT")
+	var cond *types.Condition
+
+	switch {
+	case p.peek().kind == tokKeyword && (p.peek().text == "LIKE" || p.peek().text == "ILIKE"):
+		op := types.FilterOp(p.next().text)
+		tok := p.next()
+		if tok.kind != tokString {
+			return nil, p.errorf(tok, "%s expects a string pattern, got %s", op, describe(tok))
+		}
+		cond = &types.Condition{Operator: op, Column: col, Value: tok.text}
+		if p.acceptKeyword("ESCAPE") {
+			esc := p.next()
+			if esc.kind != tokString || len([]rune(esc.text)) != 1 {
+				return nil, p.errorf(esc, "ESCAPE expects a single character string, got %s", describe(esc))
+			}
+			cond.Escape = esc.text
+		}
+
+	case p.acceptKeyword("IN"):
+		if err := p.expectSymbol("("); err != nil {
+			return nil, err
+		}
+		var values []interface{}
+		for {
+			v, err := p.parseLiteral()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		cond = &types.Condition{Operator: types.OpIn, Column: col, Value: values}
+
+	case p.acceptKeyword("BETWEEN"):
+		low, err := p.parseLiteral()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("AND"); err != nil {
+			return nil, err
+		}
+		high, err := p.parseLiteral()
+		if err != nil {
+			return nil, err
+		}
+		cond = &types.Condition{Operator: "AND", Children: []types.Condition{
+			{Operator: types.OpGte, Column: col, Value: low},
+			{Operator: types.OpLte, Column: col, Value: high},
+		}}
+
+	default:
+		if negated {
+			return nil, p.errorf(p.peek(), "expected LIKE, ILIKE, IN or BETWEEN after NOT")
+		}
+		tok := p.next()
+		if tok.kind != tokSymbol {
+			return nil, p.errorf(tok, "expected comparison operator, got %s", describe(tok))
+		}
+		var op types.FilterOp
+		switch tok.text {
+		case "=":
+			op = types.OpEq
+		case "!=", "<>":
+			op = types.OpNeq
+		case "<":
+			op = types.OpLt
+		case ">":
+			op = types.OpGt
+		case "<=":
+			op = types.OpLte
+		case ">=":
+			op = types.OpGte
+		default:
+			return nil, p.errorf(tok, "expected comparison operator, got %s", describe(tok))
+		}
+		if p.peek().kind == tokKeyword && p.peek().text == "NULL" {
+			return nil, p.errorf(p.peek(), "use IS NULL / IS NOT NULL to compare with NULL")
+		}
+		v, err := p.parseLiteral()
+		if err != nil {
+			return nil, err
+		}
+		return &types.Condition{Operator: op, Column: col, Value: v}, nil
+	}
+
+	if negated {
+		return negate(cond), nil
+	}
+	return cond, nil
+}
+
+// parseLiteral returns string literals as strings and number literals as
+// json.Number, keeping their source text so that "12.50" compares against the
+// CSV exactly as written while range predicates still compare numerically.
+func (p *parser) parseLiteral() (interface{}, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokString:
+		return tok.text, nil
+	case tokNumber:
+		return json.Number(tok.text), nil
+	}
+	return nil, p.errorf(tok, "expected literal value, got %s", describe(tok))
+}
+
+func (p *parser) parseIdent() (string, error) {
+	tok := p.next()
+	if tok.kind != tokIdent {
+		return "", p.errorf(tok, "expected column name, got %s", describe(tok))
+	}
+	return strings.ToLower(tok.text), nil
+}
+
+func (p *parser) parseCount() (int, error) {
+	tok := p.next()
+	if tok.kind != tokNumber {
+		return 0, p.errorf(tok, "expected number, got %s", describe(tok))
+	}
+	n, err := strconv.Atoi(tok.text)
+	if err != nil || n < 0 {
+		return 0, p.errorf(tok, "expected non-negative integer, got %s", tok.text)
+	}
+	return n, nil
+}
+
+func (p *parser) peek() token { return p.peekAt(0) }
+
+func (p *parser) peekAt(n int) token {
+	if p.pos+n >= len(p.tokens) {
+		return p.tokens[len(p.tokens)-1]
+	}
+	return p.tokens[p.pos+n]
+}
+
+func (p *parser) next() token {
+	tok := p.peek()
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) acceptKeyword(kw string) bool {
+	if tok := p.peek(); tok.kind == tokKeyword && tok.text == kw {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectKeyword(kw string) error {
+	if !p.acceptKeyword(kw) {
+		return p.errorf(p.peek(), "expected %s, got %s", kw, describe(p.peek()))
+	}
+	return nil
+}
+
+func (p *parser) acceptSymbol(sym string) bool {
+	if tok := p.peek(); tok.kind == tokSymbol && tok.text == sym {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectSymbol(sym string) error {
+	if !p.acceptSymbol(sym) {
+		return p.errorf(p.peek(), "expected %q, got %s", sym, describe(p.peek()))
+	}
+	return nil
+}
+
+func (p *parser) errorf(tok token, format string, args ...interface{}) error {
+	return fmt.Errorf("syntax error at position %d: %s", tok.pos, fmt.Sprintf(format, args...))
+}
+
+func describe(tok token) string {
+	if tok.kind == tokEOF {
+		return tok.kind.String()
+	}
+	return fmt.Sprintf("%s %q", tok.kind, tok.text)
+}
+
+// combine joins two conditions, flattening nested nodes of the same kind so
+// the planner sees every conjunct as a direct child of one AND.
+func combine(op types.FilterOp, left, right *types.Condition) *types.Condition {
+	node := &types.Condition{Operator: op}
+	for _, c := range []*types.Condition{left, right} {
+		if c.Operator == op {
+			node.Children = append(node.Children, c.Children...)
+		} else {
+			node.Children = append(node.Children, *c)
+		}
+	}
+	return node
+}
+
+func negate(c *types.Condition) *types.Condition {
+	if c.Operator == "NOT" && len(c.Children) == 1 {
+		inner := c.Children[0]
+		return &inner
+	}
+	return &types.Condition{Operator: "NOT", Children: []types.Condition{*c}}
+}
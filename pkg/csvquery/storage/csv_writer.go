@@ -1,8 +1,10 @@
 package storage
 
 import (
+	"bytes"
 	"encoding/csv"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -29,25 +31,34 @@ func NewCsvWriter(config WriterConfig) *CsvWriter {
 
 // Write appends rows to the CSV file.
 func (w *CsvWriter) Write(headers []string, rows [][]string) error {
+	_, _, err := w.Append(headers, rows)
+	return err
+}
+
+// Append appends rows to the CSV file like Write and returns the offsets
+// where the new rows start and end. Rows end with the line break the header
+// of an existing file ends with, which is added first if the file does not
+// end with one.
+func (w *CsvWriter) Append(headers []string, rows [][]string) (start, end int64, err error) {
 	dir := filepath.Dir(w.config.CsvPath)
 	if err := os.MkdirAll(dir, 0755); err != nil {
-		return fmt.Errorf("failed to create directory: %v", err)
+		return 0, 0, fmt.Errorf("failed to create directory: %v", err)
 	}
 
 	file, err := os.OpenFile(w.config.CsvPath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
-		return fmt.Errorf("failed to open file: %v", err)
+		return 0, 0, fmt.Errorf("failed to open file: %v", err)
 	}
 	defer file.Close()
 
 	if err := lockFile(file); err != nil {
-		return fmt.Errorf("failed to lock file: %v", err)
+		return 0, 0, fmt.Errorf("failed to lock file: %v", err)
 	}
 	defer unlockFile(file)
 
 	stat, err := file.Stat()
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
 
 	csvW := csv.NewWriter(file)
@@ -55,34 +66,92 @@ func (w *CsvWriter) Write(headers []string, rows [][]string) error {
 
 	if stat.Size() == 0 {
 		if len(headers) == 0 {
-			return fmt.Errorf("cannot create new file without headers")
+			return 0, 0, fmt.Errorf("cannot create new file without headers")
 		}
 		if err := csvW.Write(headers); err != nil {
-			return err
+			return 0, 0, err
 		}
 	} else {
 		if len(headers) > 0 {
 			if _, err := file.Seek(0, 0); err != nil {
-				return fmt.Errorf("failed to seek: %v", err)
+				return 0, 0, fmt.Errorf("failed to seek: %v", err)
 			}
 
 			reader := csv.NewReader(file)
 			reader.Comma = rune(w.config.Separator[0])
 			existingHeaders, err := reader.Read()
 			if err != nil {
-				return fmt.Errorf("failed to read existing headers: %v", err)
+				return 0, 0, fmt.Errorf("failed to read existing headers: %v", err)
 			}
 
 			if !reflect.DeepEqual(existingHeaders, headers) {
-				return fmt.Errorf("header mismatch. File: %v, New: %v", existingHeaders, headers)
+				return 0, 0, fmt.Errorf("header mismatch. File: %v, New: %v", existingHeaders, headers)
+			}
+		}
+
+		crlf, err := endsWithCRLF(file)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to read file: %v", err)
+		}
+		csvW.UseCRLF = crlf
+
+		last := make([]byte, 1)
+		if _, err := file.ReadAt(last, stat.Size()-1); err != nil {
+			return 0, 0, fmt.Errorf("failed to read file: %v", err)
+		}
+		if last[0] != '\n' {
+			lineBreak := []byte{'\n'}
+			if crlf && last[0] != '\r' {
+				lineBreak = []byte{'\r', '\n'}
+			}
+			if _, err := file.Write(lineBreak); err != nil {
+				return 0, 0, err
 			}
 		}
 	}
 
+	csvW.Flush()
+	if err := csvW.Error(); err != nil {
+		return 0, 0, err
+	}
+	if stat, err = file.Stat(); err != nil {
+		return 0, 0, err
+	}
+	start = stat.Size()
+
 	if err := csvW.WriteAll(rows); err != nil {
-		return err
+		return 0, 0, err
+	}
+	if err := file.Sync(); err != nil {
+		return 0, 0, err
+	}
+	if stat, err = file.Stat(); err != nil {
+		return 0, 0, err
 	}
+	return start, stat.Size(), nil
+}
 
-	csvW.Flush()
-	return csvW.Error()
+// endsWithCRLF reports whether the first line of file ends with \r\n.
+func endsWithCRLF(file *os.File) (bool, error) {
+	buf := make([]byte, 4096)
+	var prev byte
+	for offset := int64(0); ; {
+		n, err := file.ReadAt(buf, offset)
+		if i := bytes.IndexByte(buf[:n], '\n'); i >= 0 {
+			if i > 0 {
+				prev = buf[i-1]
+			}
+			return prev == '\r', nil
+		}
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if n > 0 {
+			prev = buf[n-1]
+		}
+		offset += int64(n)
+	}
 }
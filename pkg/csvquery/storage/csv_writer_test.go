@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCsvWriterLineBreaks(t *testing.T) {
+	tests := []struct {
+		name, content, want string
+	}{
+		{"lf", "id,name\n1,a\n", "id,name\n1,a\n2,\"b \"\"c\"\"\"\n3,d\n"},
+		{"lf without a final line break", "id,name\n1,a", "id,name\n1,a\n2,\"b \"\"c\"\"\"\n3,d\n"},
+		{"crlf", "id,name\r\n1,a\r\n", "id,name\r\n1,a\r\n2,\"b \"\"c\"\"\"\r\n3,d\r\n"},
+		{"crlf without a final line break", "id,name\r\n1,a", "id,name\r\n1,a\r\n2,\"b \"\"c\"\"\"\r\n3,d\r\n"},
+		{"crlf cut after the cr", "id,name\r\n1,a\r", "id,name\r\n1,a\r\n2,\"b \"\"c\"\"\"\r\n3,d\r\n"},
+		{"header only", "id,name\r\n", "id,name\r\n2,\"b \"\"c\"\"\"\r\n3,d\r\n"},
+		{"header without a line break", "id,name", "id,name\n2,\"b \"\"c\"\"\"\n3,d\n"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "data.csv")
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			start, end, err := NewCsvWriter(WriterConfig{CsvPath: path}).Append(nil, [][]string{{"2", `b "c"`}, {"3", "d"}})
+			if err != nil {
+				t.Fatalf("Append: %v", err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Fatalf("file = %q, want %q", data, tt.want)
+			}
+			if end != int64(len(data)) || data[start-1] != '\n' || data[start] != '2' {
+				t.Fatalf("appended rows at %d-%d = %q", start, end, data[start:end])
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+)
+
+// FileLock is an advisory lock on <csv>.lock. Requests that read a CSV
+// file, its indexes and its pending updates hold it shared, so that a
+// compaction, which replaces all of them and holds it exclusively, never
+// swaps the files in the middle of a request.
+type FileLock struct {
+	file      *os.File
+	exclusive bool
+}
+
+// LockShared acquires the shared lock of csvPath. When the lock file
+// cannot be created, as in a read-only directory, an existing one is opened
+// read-only.
+func LockShared(csvPath string) (*FileLock, error) {
+	f, err := os.OpenFile(csvPath+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		var openErr error
+		if f, openErr = os.Open(csvPath + ".lock"); openErr != nil {
+			return nil, fmt.Errorf("failed to open lock file: %v", err)
+		}
+	}
+	if err := lockFileShared(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock file: %v", err)
+	}
+	return &FileLock{file: f}, nil
+}
+
+// LockExclusive acquires the exclusive lock of csvPath.
+func LockExclusive(csvPath string) (*FileLock, error) {
+	f, err := os.OpenFile(csvPath+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %v", err)
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock file: %v", err)
+	}
+	return &FileLock{file: f, exclusive: true}, nil
+}
+
+// Upgrade turns a shared lock into the exclusive one, waiting for the other
+// holders to release theirs, and reports whether it did. The conversion is
+// not atomic: another process may take the lock exclusively in between, so
+// what was read under the shared lock must be read again.
+func (l *FileLock) Upgrade() (bool, error) {
+	if l.file == nil || l.exclusive {
+		return false, nil
+	}
+	if err := lockFile(l.file); err != nil {
+		return false, fmt.Errorf("failed to lock file: %v", err)
+	}
+	l.exclusive = true
+	return true, nil
+}
+
+// Unlock releases the lock.
+func (l *FileLock) Unlock() {
+	if l.file == nil {
+		return
+	}
+	unlockFile(l.file)
+	l.file.Close()
+	l.file = nil
+}
@@ -0,0 +1,14 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestLockSharedFails(t *testing.T) {
+	csvPath := filepath.Join(t.TempDir(), "missing", "data.csv")
+	if lock, err := LockShared(csvPath); err == nil {
+		lock.Unlock()
+		t.Fatal("LockShared succeeded without a lock file")
+	}
+}
@@ -12,6 +12,11 @@ func lockFile(file *os.File) error {
 	return nil
 }
 
+// lockFileShared acquires a shared lock on the file
+func lockFileShared(file *os.File) error {
+	return nil
+}
+
 // unlockFile releases the lock
 func unlockFile(file *os.File) error {
 	return nil
@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"slices"
+	"sync"
+)
+
+const logHeaderSize = 8
+
+var logCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Log is an append-only file of checksummed records. Each record is the
+// length and the CRC-32C of its payload, as big-endian uint32s, followed by
+// the payload. A record torn by a crash fails its checksum; readers stop
+// before it and the next append cuts it off. Appends fail once a bad record
+// is followed by others, as only corruption leaves one there.
+//
+// Appends and checkpoints hold an exclusive flock on the log and reads a
+// shared one, so the processes sharing a log never see each other's
+// partial writes.
+type Log struct {
+	path string
+	mu   sync.Mutex
+	tail logTail
+}
+
+// logTail is where the intact records of a log end, with the position and
+// header of the last of them. Appends resume from the tail seen last when
+// that header is still in place, instead of reading the whole log again.
+type logTail struct {
+	start, end int64
+	header     [logHeaderSize]byte
+}
+
+// NewLog returns the log stored at path. The file is created by the first
+// append.
+func NewLog(path string) *Log {
+	return &Log{path: path}
+}
+
+// Path returns the location of the log.
+func (l *Log) Path() string {
+	return l.path
+}
+
+// Append writes payload as one record and syncs the log. It returns the
+// size of the log afterwards.
+func (l *Log) Append(payload []byte) (int64, error) {
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open log: %v", err)
+	}
+	defer f.Close()
+	if err := lockFile(f); err != nil {
+		return 0, fmt.Errorf("failed to lock log: %v", err)
+	}
+	defer unlockFile(f)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	end, err := l.findEnd(f)
+	if err != nil {
+		return 0, err
+	}
+	if err := f.Truncate(end); err != nil {
+		return 0, fmt.Errorf("failed to truncate log: %v", err)
+	}
+
+	record := make([]byte, logHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, logCRCTable))
+	copy(record[logHeaderSize:], payload)
+	if _, err := f.WriteAt(record, end); err != nil {
+		return 0, fmt.Errorf("failed to append to log: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		return 0, fmt.Errorf("failed to sync log: %v", err)
+	}
+	l.tail = logTail{start: end, end: end + int64(len(record))}
+	copy(l.tail.header[:], record)
+	return l.tail.end, nil
+}
+
+// findEnd returns the offset where the intact records of f end. It checks
+// the records written since the last tail seen, or all of them if another
+// process has emptied the log since. A bad record at the end was torn by a
+// crash and is cut off by the append; one followed by more records means
+// the log is corrupt, and appending after it would hide the new record from
+// readers, which stop at the first bad record.
+func (l *Log) findEnd(f *os.File) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat log: %v", err)
+	}
+	size := info.Size()
+
+	var last logTail
+	if l.tail.end > 0 && l.tail.end <= size {
+		var header [logHeaderSize]byte
+		if _, err := f.ReadAt(header[:], l.tail.start); err == nil && header == l.tail.header {
+			last = l.tail
+		}
+	}
+	var payload []byte
+	for size-last.end >= logHeaderSize {
+		next := logTail{start: last.end}
+		if _, err := f.ReadAt(next.header[:], next.start); err != nil {
+			return 0, fmt.Errorf("failed to read log: %v", err)
+		}
+		payloadSize := int64(binary.BigEndian.Uint32(next.header[0:4]))
+		if size-next.start-logHeaderSize < payloadSize {
+			break
+		}
+		next.end = next.start + logHeaderSize + payloadSize
+		payload = slices.Grow(payload[:0], int(payloadSize))[:payloadSize]
+		if _, err := f.ReadAt(payload, next.start+logHeaderSize); err != nil {
+			return 0, fmt.Errorf("failed to read log: %v", err)
+		}
+		if crc32.Checksum(payload, logCRCTable) != binary.BigEndian.Uint32(next.header[4:8]) {
+			if next.end < size {
+				return 0, fmt.Errorf("log %s is corrupt at offset %d", l.path, next.start)
+			}
+			break
+		}
+		last = next
+	}
+	l.tail = last
+	return last.end, nil
+}
+
+// Read calls fn with the payloads of the intact records in order, holding
+// the shared lock so that no checkpoint runs until fn returns. A missing
+// log has no records.
+func (l *Log) Read(fn func(records [][]byte) error) error {
+	f, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return fn(nil)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open log: %v", err)
+	}
+	defer f.Close()
+	if err := lockFileShared(f); err != nil {
+		return fmt.Errorf("failed to lock log: %v", err)
+	}
+	defer unlockFile(f)
+
+	records, tail, err := readRecords(f)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.tail = tail
+	l.mu.Unlock()
+	return fn(records)
+}
+
+// Checkpoint calls fold with the payloads of the intact records, holding
+// the exclusive lock, and empties the log once fold has saved them
+// elsewhere. fold must be idempotent: if the process dies before the log
+// is emptied, the same records are folded again by the next checkpoint. A
+// missing log is created empty, so fold is always called.
+func (l *Log) Checkpoint(fold func(records [][]byte) error) error {
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log: %v", err)
+	}
+	defer f.Close()
+	if err := lockFile(f); err != nil {
+		return fmt.Errorf("failed to lock log: %v", err)
+	}
+	defer unlockFile(f)
+
+	records, _, err := readRecords(f)
+	if err != nil {
+		return err
+	}
+	if err := fold(records); err != nil {
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate log: %v", err)
+	}
+	l.mu.Lock()
+	l.tail = logTail{}
+	l.mu.Unlock()
+	return f.Sync()
+}
+
+// readRecords returns the payloads of the intact records at the start of f
+// and the tail where they end.
+func readRecords(f *os.File) ([][]byte, logTail, error) {
+	data, err := io.ReadAll(io.NewSectionReader(f, 0, 1<<62))
+	if err != nil {
+		return nil, logTail{}, fmt.Errorf("failed to read log: %v", err)
+	}
+	var records [][]byte
+	var tail logTail
+	for int64(len(data))-tail.end >= logHeaderSize {
+		header := data[tail.end : tail.end+logHeaderSize]
+		size := int64(binary.BigEndian.Uint32(header[0:4]))
+		if int64(len(data))-tail.end-logHeaderSize < size {
+			break
+		}
+		payload := data[tail.end+logHeaderSize : tail.end+logHeaderSize+size]
+		if crc32.Checksum(payload, logCRCTable) != binary.BigEndian.Uint32(header[4:8]) {
+			break
+		}
+		records = append(records, payload)
+		tail.start, tail.end = tail.end, tail.end+logHeaderSize+size
+		copy(tail.header[:], header)
+	}
+	return records, tail, nil
+}
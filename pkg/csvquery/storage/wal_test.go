@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func logRecord(payload []byte) []byte {
+	record := make([]byte, logHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, logCRCTable))
+	copy(record[logHeaderSize:], payload)
+	return record
+}
+
+func readAll(t *testing.T, l *Log) []string {
+	t.Helper()
+	var got []string
+	err := l.Read(func(records [][]byte) error {
+		for _, r := range records {
+			got = append(got, string(r))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	return got
+}
+
+func TestLogDamagedTail(t *testing.T) {
+	tests := []struct {
+		name   string
+		damage func(data []byte) []byte
+		want   []string
+		// reuse appends through the log that wrote the records, whose cached
+		// tail is still valid since the damage lies past it
+		reuse bool
+	}{
+		{
+			name:   "intact",
+			damage: func(data []byte) []byte { return data },
+			want:   []string{"first", "second"},
+			reuse:  true,
+		},
+		{
+			name:   "torn header",
+			damage: func(data []byte) []byte { return append(data, 0, 0, 1) },
+			want:   []string{"first", "second"},
+			reuse:  true,
+		},
+		{
+			name: "torn payload",
+			damage: func(data []byte) []byte {
+				return append(data, logRecord([]byte("third record"))[:logHeaderSize+4]...)
+			},
+			want:  []string{"first", "second"},
+			reuse: true,
+		},
+		{
+			name: "bad checksum after the last record",
+			damage: func(data []byte) []byte {
+				record := logRecord([]byte("third"))
+				record[logHeaderSize] ^= 0xff
+				return append(data, record...)
+			},
+			want:  []string{"first", "second"},
+			reuse: true,
+		},
+		{
+			name: "corrupt last record",
+			damage: func(data []byte) []byte {
+				data[len(data)-1] ^= 0xff
+				return data
+			},
+			want: []string{"first"},
+		},
+		{
+			name: "last record cut short",
+			damage: func(data []byte) []byte {
+				return data[:len(data)-2]
+			},
+			want: []string{"first"},
+		},
+		{
+			name:   "only a torn record",
+			damage: func(data []byte) []byte { return logRecord([]byte("first"))[:6] },
+			want:   nil,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.log")
+			writer := NewLog(path)
+			for _, payload := range []string{"first", "second"} {
+				if _, err := writer.Append([]byte(payload)); err != nil {
+					t.Fatalf("Append: %v", err)
+				}
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, tt.damage(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := readAll(t, NewLog(path)); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("Read = %q, want %q", got, tt.want)
+			}
+
+			l := NewLog(path)
+			if tt.reuse {
+				l = writer
+			}
+			size, err := l.Append([]byte("third"))
+			if err != nil {
+				t.Fatalf("Append: %v", err)
+			}
+			want := append(append([]string(nil), tt.want...), "third")
+			if got := readAll(t, NewLog(path)); !reflect.DeepEqual(got, want) {
+				t.Fatalf("Read after Append = %q, want %q", got, want)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() != size {
+				t.Fatalf("Append returned size %d, log is %d bytes", size, info.Size())
+			}
+		})
+	}
+}
+
+func TestLogCorruptRecord(t *testing.T) {
+	tests := []struct {
+		name string
+		read bool // read the log before appending, as loading updates does
+	}{
+		{"append", false},
+		{"read then append", true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.log")
+			writer := NewLog(path)
+			for _, payload := range []string{"first", "second", "third"} {
+				if _, err := writer.Append([]byte(payload)); err != nil {
+					t.Fatalf("Append: %v", err)
+				}
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Damage the payload of the second record
+			data[2*logHeaderSize+len("first")] ^= 0xff
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			l := NewLog(path)
+			if tt.read {
+				if got, want := readAll(t, l), []string{"first"}; !reflect.DeepEqual(got, want) {
+					t.Fatalf("Read = %q, want %q", got, want)
+				}
+			}
+			if _, err := l.Append([]byte("fourth")); err == nil {
+				t.Fatal("Append after a corrupt record succeeded")
+			}
+			after, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(after, data) {
+				t.Fatal("Append changed a corrupt log")
+			}
+		})
+	}
+}
+
+func TestLogCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.log")
+	l := NewLog(path)
+	for _, payload := range []string{"first", "second"} {
+		if _, err := l.Append([]byte(payload)); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+
+	// Checkpoint through another log, as another process would, so that the
+	// tail cached by l goes stale
+	var folded []string
+	err := NewLog(path).Checkpoint(func(records [][]byte) error {
+		for _, r := range records {
+			folded = append(folded, string(r))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Checkpoint: %v", err)
+	}
+	if want := []string{"first", "second"}; !reflect.DeepEqual(folded, want) {
+		t.Fatalf("Checkpoint folded %q, want %q", folded, want)
+	}
+
+	if _, err := NewLog(path).Append([]byte("third, longer than the others")); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if _, err := l.Append([]byte("fourth")); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if got, want := readAll(t, l), []string{"third, longer than the others", "fourth"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Read = %q, want %q", got, want)
+	}
+}
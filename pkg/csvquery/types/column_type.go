@@ -0,0 +1,178 @@
+package types
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ColumnType is the type the values of a column are compared as
+type ColumnType string
+
+const (
+	TypeString   ColumnType = "string"
+	TypeInt      ColumnType = "int"
+	TypeFloat    ColumnType = "float"
+	TypeDecimal  ColumnType = "decimal"
+	TypeDate     ColumnType = "date"
+	TypeDatetime ColumnType = "datetime"
+)
+
+const (
+	DefaultDateFormat     = "2006-01-02"
+	DefaultDatetimeFormat = "2006-01-02 15:04:05"
+)
+
+// ColumnSpec declares the type of a column. Format is the Go time layout of
+// date and datetime values.
+type ColumnSpec struct {
+	Type   ColumnType `json:"type"`
+	Format string     `json:"format,omitempty"`
+}
+
+// ParseColumnSpec validates a type name and format and fills in the
+// default format of date and datetime columns.
+func ParseColumnSpec(typ, format string) (ColumnSpec, error) {
+	spec := ColumnSpec{Type: ColumnType(strings.ToLower(strings.TrimSpace(typ))), Format: format}
+	switch spec.Type {
+	case TypeString, TypeInt, TypeFloat, TypeDecimal:
+		if format != "" {
+			return spec, fmt.Errorf("type %s does not take a format", spec.Type)
+		}
+	case TypeDate:
+		if spec.Format == "" {
+			spec.Format = DefaultDateFormat
+		}
+	case TypeDatetime:
+		if spec.Format == "" {
+			spec.Format = DefaultDatetimeFormat
+		}
+	default:
+		return spec, fmt.Errorf("unknown column type: %q", typ)
+	}
+	return spec, nil
+}
+
+// IsString reports whether values compare as plain strings.
+func (s ColumnSpec) IsString() bool {
+	return s.Type == "" || s.Type == TypeString
+}
+
+// SameAs reports whether values compare the same way under both specs.
+func (s ColumnSpec) SameAs(o ColumnSpec) bool {
+	if s.IsString() || o.IsString() {
+		return s.IsString() && o.IsString()
+	}
+	return s == o
+}
+
+// String renders the spec for plans, e.g. "date(02/01/2006)".
+func (s ColumnSpec) String() string {
+	if s.IsString() {
+		return string(TypeString)
+	}
+	if s.Format != "" {
+		return string(s.Type) + "(" + s.Format + ")"
+	}
+	return string(s.Type)
+}
+
+// AppendKey appends the comparison key of v to dst. Keys of the same column
+// type compare with bytes.Compare in the order of the values they encode,
+// which lets filters and index scans share one set of comparison rules.
+// It reports false if v is not a valid value of the type.
+func (s ColumnSpec) AppendKey(dst []byte, v string) ([]byte, bool) {
+	if s.IsString() {
+		return append(dst, v...), true
+	}
+	v = strings.TrimSpace(v)
+	switch s.Type {
+	case TypeInt:
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return dst, false
+		}
+		return binary.BigEndian.AppendUint64(dst, uint64(n)^1<<63), true
+	case TypeFloat:
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || math.IsNaN(f) {
+			return dst, false
+		}
+		if f == 0 {
+			f = 0 // -0 sorts with 0
+		}
+		bits := math.Float64bits(f)
+		if bits&(1<<63) != 0 {
+			bits = ^bits
+		} else {
+			bits |= 1 << 63
+		}
+		return binary.BigEndian.AppendUint64(dst, bits), true
+	case TypeDecimal:
+		return appendDecimalKey(dst, v)
+	case TypeDate, TypeDatetime:
+		t, err := time.ParseInLocation(s.Format, v, time.UTC)
+		if err != nil {
+			return dst, false
+		}
+		dst = binary.BigEndian.AppendUint64(dst, uint64(t.Unix())^1<<63)
+		if s.Type == TypeDatetime {
+			dst = binary.BigEndian.AppendUint32(dst, uint32(t.Nanosecond()))
+		}
+		return dst, true
+	}
+	return dst, false
+}
+
+// appendDecimalKey encodes an exact decimal as a sign byte (0 negative,
+// 1 zero, 2 positive), the number of integer digits and the significant
+// digits followed by a zero terminator. The bytes after the sign byte are
+// inverted for negative numbers.
+func appendDecimalKey(dst []byte, v string) ([]byte, bool) {
+	neg := false
+	if v != "" && (v[0] == '-' || v[0] == '+') {
+		neg = v[0] == '-'
+		v = v[1:]
+	}
+	intPart, frac, _ := strings.Cut(v, ".")
+	if intPart == "" && frac == "" || !isDigits(intPart) || !isDigits(frac) {
+		return dst, false
+	}
+	intPart = strings.TrimLeft(intPart, "0")
+	frac = strings.TrimRight(frac, "0")
+	if intPart == "" && frac == "" {
+		return append(dst, 1), true
+	}
+	if len(intPart) > math.MaxUint16 {
+		return dst, false
+	}
+
+	if neg {
+		dst = append(dst, 0)
+	} else {
+		dst = append(dst, 2)
+	}
+	start := len(dst)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(intPart)))
+	dst = append(dst, intPart...)
+	dst = append(dst, frac...)
+	dst = append(dst, 0)
+	if neg {
+		for i := start; i < len(dst); i++ {
+			dst[i] = ^dst[i]
+		}
+	}
+	return dst, true
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
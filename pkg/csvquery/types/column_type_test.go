@@ -0,0 +1,145 @@
+package types
+
+import (
+	"bytes"
+	"cmp"
+	"math/big"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// typedCompare compares two valid values of spec by their type.
+func typedCompare(t *testing.T, spec ColumnSpec, a, b string) int {
+	t.Helper()
+	a, b = strings.TrimSpace(a), strings.TrimSpace(b)
+	switch spec.Type {
+	case TypeInt:
+		x, err1 := strconv.ParseInt(a, 10, 64)
+		y, err2 := strconv.ParseInt(b, 10, 64)
+		if err1 != nil || err2 != nil {
+			t.Fatalf("bad int in test: %q, %q", a, b)
+		}
+		return cmp.Compare(x, y)
+	case TypeFloat:
+		x, err1 := strconv.ParseFloat(a, 64)
+		y, err2 := strconv.ParseFloat(b, 64)
+		if err1 != nil || err2 != nil {
+			t.Fatalf("bad float in test: %q, %q", a, b)
+		}
+		return cmp.Compare(x, y)
+	case TypeDecimal:
+		x, ok1 := new(big.Rat).SetString(a)
+		y, ok2 := new(big.Rat).SetString(b)
+		if !ok1 || !ok2 {
+			t.Fatalf("bad decimal in test: %q, %q", a, b)
+		}
+		return x.Cmp(y)
+	case TypeDate, TypeDatetime:
+		x, err1 := time.ParseInLocation(spec.Format, a, time.UTC)
+		y, err2 := time.ParseInLocation(spec.Format, b, time.UTC)
+		if err1 != nil || err2 != nil {
+			t.Fatalf("bad time in test: %q, %q", a, b)
+		}
+		return x.Compare(y)
+	}
+	t.Fatalf("no comparison for %s", spec)
+	return 0
+}
+
+func TestAppendKeyOrder(t *testing.T) {
+	tests := []struct {
+		spec   ColumnSpec
+		values []string
+	}{
+		{
+			spec:   ColumnSpec{Type: TypeInt},
+			values: []string{"-9223372036854775808", "-100", "-10", "-9", "-1", "0", "-0", "+0", " 7 ", "9", "10", "100", "9223372036854775807"},
+		},
+		{
+			spec:   ColumnSpec{Type: TypeFloat},
+			values: []string{"-Inf", "-1e300", "-2.5", "-1", "-0.5", "-1e-300", "-0", "0", "0.0", "1e-300", "0.5", "1", "1.0", "1.5", "10", "1e300", "+Inf"},
+		},
+		{
+			spec: ColumnSpec{Type: TypeDecimal},
+			values: []string{
+				"-1000", "-100.5", "-100", "-10.25", "-10.2", "-10", "-9.99", "-0.5", "-0.05", "-0.001",
+				"0", "-0", "+0", "0.000", ".0", "0.001", "0.01", "0.010", ".1", "0.1", "0.10", "1", "1.0", "01.00",
+				"1.05", "1.5", "9.99", "10", "10.01", "99.9", "100", "+100.5", "1000",
+			},
+		},
+		{
+			spec:   ColumnSpec{Type: TypeDate, Format: DefaultDateFormat},
+			values: []string{"0001-01-01", "1969-12-31", "1970-01-01", "1999-12-31", "2000-01-01", "2024-02-29", "9999-12-31"},
+		},
+		{
+			spec:   ColumnSpec{Type: TypeDate, Format: "02/01/2006"},
+			values: []string{"31/12/1999", "01/01/2000", "02/01/2000", "01/02/2000"},
+		},
+		{
+			spec: ColumnSpec{Type: TypeDatetime, Format: "2006-01-02 15:04:05.999999999"},
+			values: []string{
+				"1969-12-31 23:59:59.5", "1970-01-01 00:00:00", "2024-01-01 00:00:00", "2024-01-01 00:00:00.000000001",
+				"2024-01-01 00:00:00.25", "2024-01-01 00:00:00.5", "2024-01-01 00:00:01", "2024-01-01 23:59:59.999999999", "2024-01-02 00:00:00",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		keys := make([][]byte, len(tt.values))
+		for i, v := range tt.values {
+			key, ok := tt.spec.AppendKey(nil, v)
+			if !ok {
+				t.Fatalf("%s: AppendKey(%q) failed", tt.spec, v)
+			}
+			keys[i] = key
+		}
+		for i, a := range tt.values {
+			for j, b := range tt.values {
+				want := typedCompare(t, tt.spec, a, b)
+				if got := bytes.Compare(keys[i], keys[j]); got != want {
+					t.Errorf("%s: keys of %q and %q compare %d, want %d", tt.spec, a, b, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestAppendKeyInvalid(t *testing.T) {
+	tests := []struct {
+		spec   ColumnSpec
+		values []string
+	}{
+		{ColumnSpec{Type: TypeInt}, []string{"", " ", "abc", "1.5", "1e3", "0x10", "9223372036854775808", "- 1"}},
+		{ColumnSpec{Type: TypeFloat}, []string{"", "abc", "NaN", "nan", "1.2.3", "1,5"}},
+		{ColumnSpec{Type: TypeDecimal}, []string{"", "-", "+", ".", "-.", "abc", "1e5", "1.2.3", "1,5", "--1", "0x10", "Inf"}},
+		{ColumnSpec{Type: TypeDate, Format: DefaultDateFormat}, []string{"", "2024-13-01", "2024-02-30", "01/02/2024", "2024-01-01 10:00:00"}},
+		{ColumnSpec{Type: TypeDatetime, Format: DefaultDatetimeFormat}, []string{"", "2024-01-01", "2024-01-01 25:00:00"}},
+	}
+
+	for _, tt := range tests {
+		for _, v := range tt.values {
+			if key, ok := tt.spec.AppendKey([]byte("x"), v); ok || string(key) != "x" {
+				t.Errorf("%s: AppendKey(%q) = %q, %v; want it rejected and dst unchanged", tt.spec, v, key, ok)
+			}
+		}
+	}
+}
+
+// Decimal keys are compared as they are, without being cut to a fixed
+// size, so that one never sorts between the keys of longer values it is a
+// prefix of.
+func TestDecimalKeyPrefixFree(t *testing.T) {
+	spec := ColumnSpec{Type: TypeDecimal}
+	values := []string{"1", "1.1", "11", "-1", "-1.1", "-11", "0.1", "-0.1"}
+	for _, a := range values {
+		ka, _ := spec.AppendKey(nil, a)
+		for _, b := range values {
+			kb, _ := spec.AppendKey(nil, b)
+			if a != b && bytes.HasPrefix(kb, ka) {
+				t.Errorf("key of %q is a prefix of the key of %q", a, b)
+			}
+		}
+	}
+}
@@ -10,4 +10,11 @@ const (
 
 	// MaxBatchSize is the maximum number of rows to process in a batch
 	MaxBatchSize = 1000
+
+	// DefaultSortMemoryMB is the ORDER BY sort buffer used when a query does
+	// not set one
+	DefaultSortMemoryMB = 64
+
+	// ProtocolVersion is the latest NDJSON result protocol version
+	ProtocolVersion = 1
 )
@@ -0,0 +1,139 @@
+package types
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// DefaultLikeEscape is the escape character of LIKE patterns that do not set
+// their own.
+const DefaultLikeEscape = '\\'
+
+const (
+	likeLiteral = iota
+	likeOne
+	likeAny
+)
+
+type likeToken struct {
+	kind int
+	r    rune
+}
+
+// LikePattern is a compiled SQL LIKE pattern: % matches any run of
+// characters, _ exactly one character, and the escape character makes the
+// character after it literal. Folded patterns (ILIKE) ignore case.
+type LikePattern struct {
+	tokens []likeToken
+	fold   bool
+	prefix string
+	exact  bool
+	// literal is set when the prefix is the whole pattern
+	literal bool
+}
+
+// CompileLike compiles pattern with the given escape character. An empty
+// escape selects DefaultLikeEscape.
+func CompileLike(pattern, escape string, fold bool) (*LikePattern, error) {
+	esc := rune(DefaultLikeEscape)
+	if escape != "" {
+		if utf8.RuneCountInString(escape) != 1 {
+			return nil, fmt.Errorf("LIKE escape must be a single character, got %q", escape)
+		}
+		esc, _ = utf8.DecodeRuneInString(escape)
+	}
+
+	p := &LikePattern{fold: fold}
+	var prefix strings.Builder
+	inPrefix := true
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		var t likeToken
+		switch {
+		case r == esc:
+			i++
+			if i == len(runes) {
+				return nil, fmt.Errorf("LIKE pattern %q ends with the escape character", pattern)
+			}
+			t = likeToken{kind: likeLiteral, r: runes[i]}
+		case r == '%':
+			if n := len(p.tokens); n > 0 && p.tokens[n-1].kind == likeAny {
+				continue
+			}
+			t = likeToken{kind: likeAny}
+		case r == '_':
+			t = likeToken{kind: likeOne}
+		default:
+			t = likeToken{kind: likeLiteral, r: r}
+		}
+
+		// A folded literal only belongs to the prefix if it has no other case
+		if inPrefix && t.kind == likeLiteral && (!fold || unicode.SimpleFold(t.r) == t.r) {
+			prefix.WriteRune(t.r)
+		} else {
+			inPrefix = false
+		}
+		if fold && t.kind == likeLiteral {
+			t.r = unicode.ToLower(t.r)
+		}
+		p.tokens = append(p.tokens, t)
+	}
+
+	p.prefix = prefix.String()
+	rest := p.tokens[utf8.RuneCountInString(p.prefix):]
+	p.literal = len(rest) == 0
+	p.exact = len(rest) == 1 && rest[0].kind == likeAny
+	return p, nil
+}
+
+// Prefix returns the literal text every matching value starts with.
+func (p *LikePattern) Prefix() string {
+	return p.prefix
+}
+
+// IsPrefixOnly reports whether the pattern is its prefix followed by a single
+// %, and so matches exactly the values that start with the prefix.
+func (p *LikePattern) IsPrefixOnly() bool {
+	return p.exact
+}
+
+// IsLiteral reports whether the pattern matches nothing but its prefix.
+func (p *LikePattern) IsLiteral() bool {
+	return p.literal
+}
+
+// Match reports whether s matches the whole pattern.
+func (p *LikePattern) Match(s string) bool {
+	ti, si := 0, 0
+	star, mark := -1, 0
+	for si < len(s) {
+		r, n := utf8.DecodeRuneInString(s[si:])
+		if ti < len(p.tokens) {
+			t := p.tokens[ti]
+			if t.kind == likeAny {
+				star, mark = ti, si
+				ti++
+				continue
+			}
+			if t.kind == likeOne || t.r == r || p.fold && t.r == unicode.ToLower(r) {
+				ti++
+				si += n
+				continue
+			}
+		}
+		// Let the last % absorb one more character and retry
+		if star < 0 {
+			return false
+		}
+		_, n = utf8.DecodeRuneInString(s[mark:])
+		mark += n
+		ti, si = star+1, mark
+	}
+	for ti < len(p.tokens) && p.tokens[ti].kind == likeAny {
+		ti++
+	}
+	return ti == len(p.tokens)
+}
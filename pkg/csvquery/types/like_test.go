@@ -0,0 +1,120 @@
+package types
+
+import "testing"
+
+func TestLikeMatch(t *testing.T) {
+	tests := []struct {
+		pattern, escape string
+		fold            bool
+		value           string
+		want            bool
+	}{
+		{pattern: "abc", value: "abc", want: true},
+		{pattern: "abc", value: "abcd", want: false},
+		{pattern: "abc", value: "ABC", want: false},
+		{pattern: "", value: "", want: true},
+		{pattern: "", value: "a", want: false},
+		{pattern: "%", value: "", want: true},
+		{pattern: "%", value: "anything", want: true},
+		{pattern: "a%", value: "a", want: true},
+		{pattern: "a%", value: "abc", want: true},
+		{pattern: "a%", value: "ba", want: false},
+		{pattern: "%c", value: "abc", want: true},
+		{pattern: "%c", value: "abcd", want: false},
+		{pattern: "%b%", value: "abc", want: true},
+		{pattern: "%b%", value: "ac", want: false},
+		{pattern: "a%%c", value: "abbc", want: true},
+		{pattern: "a%b%c", value: "aXbYbZc", want: true},
+		{pattern: "a%b%c", value: "acb", want: false},
+		{pattern: "_", value: "a", want: true},
+		{pattern: "_", value: "", want: false},
+		{pattern: "_", value: "ab", want: false},
+		{pattern: "a_c", value: "abc", want: true},
+		{pattern: "a_c", value: "ac", want: false},
+		{pattern: "_é_", value: "héé", want: true},
+		{pattern: "%_", value: "", want: false},
+		{pattern: "%_", value: "x", want: true},
+		{pattern: `50\%`, value: "50%", want: true},
+		{pattern: `50\%`, value: "500", want: false},
+		{pattern: `a\_c`, value: "a_c", want: true},
+		{pattern: `a\_c`, value: "abc", want: false},
+		{pattern: `a\\c`, value: `a\c`, want: true},
+		{pattern: "a!_c", escape: "!", value: "a_c", want: true},
+		{pattern: "a!_c", escape: "!", value: "abc", want: false},
+		{pattern: `a\_c`, escape: "!", value: `a\bc`, want: true},
+		{pattern: "abc", fold: true, value: "ABC", want: true},
+		{pattern: "ÉCOLE%", fold: true, value: "école primaire", want: true},
+		{pattern: "%straße", fold: true, value: "HAUPTSTRAßE", want: true},
+		{pattern: "ΣΟΦΙΑ", fold: true, value: "σοφια", want: true},
+		{pattern: "я%", fold: true, value: "Янв", want: true},
+		{pattern: "abc", fold: true, value: "abd", want: false},
+		{pattern: "ÉCOLE", fold: false, value: "école", want: false},
+	}
+
+	for _, tt := range tests {
+		p, err := CompileLike(tt.pattern, tt.escape, tt.fold)
+		if err != nil {
+			t.Fatalf("CompileLike(%q, %q): %v", tt.pattern, tt.escape, err)
+		}
+		if got := p.Match(tt.value); got != tt.want {
+			t.Errorf("%q LIKE %q (escape %q, fold %v) = %v, want %v", tt.value, tt.pattern, tt.escape, tt.fold, got, tt.want)
+		}
+	}
+}
+
+func TestLikePrefix(t *testing.T) {
+	tests := []struct {
+		pattern, escape string
+		fold            bool
+		prefix          string
+		prefixOnly      bool
+		literal         bool
+	}{
+		{pattern: "abc%", prefix: "abc", prefixOnly: true},
+		{pattern: "abc%%", prefix: "abc", prefixOnly: true},
+		{pattern: "abc", prefix: "abc", literal: true},
+		{pattern: "a_c%", prefix: "a"},
+		{pattern: "ab%c", prefix: "ab"},
+		{pattern: "%x", prefix: ""},
+		{pattern: "_x%", prefix: ""},
+		{pattern: "%", prefix: "", prefixOnly: true},
+		{pattern: `\%%`, prefix: "%", prefixOnly: true},
+		{pattern: `50\%%`, prefix: "50%", prefixOnly: true},
+		{pattern: `a\_b%`, prefix: "a_b", prefixOnly: true},
+		{pattern: `a\%`, prefix: "a%", literal: true},
+		{pattern: "x!%y%", escape: "!", prefix: "x%y", prefixOnly: true},
+		{pattern: "élan%", prefix: "élan", prefixOnly: true},
+		// Only characters without another case can start the keys of ILIKE
+		{pattern: "12ab%", fold: true, prefix: "12"},
+		{pattern: "12-%", fold: true, prefix: "12-", prefixOnly: true},
+		{pattern: "abc%", fold: true, prefix: ""},
+	}
+
+	for _, tt := range tests {
+		p, err := CompileLike(tt.pattern, tt.escape, tt.fold)
+		if err != nil {
+			t.Fatalf("CompileLike(%q, %q): %v", tt.pattern, tt.escape, err)
+		}
+		if p.Prefix() != tt.prefix || p.IsPrefixOnly() != tt.prefixOnly || p.IsLiteral() != tt.literal {
+			t.Errorf("CompileLike(%q, %q, %v): prefix %q, prefix only %v, literal %v; want %q, %v, %v",
+				tt.pattern, tt.escape, tt.fold, p.Prefix(), p.IsPrefixOnly(), p.IsLiteral(), tt.prefix, tt.prefixOnly, tt.literal)
+		}
+	}
+}
+
+func TestLikeInvalid(t *testing.T) {
+	tests := []struct {
+		pattern, escape string
+	}{
+		{pattern: `abc\`},
+		{pattern: `\`},
+		{pattern: "ab!", escape: "!"},
+		{pattern: "abc", escape: "!!"},
+	}
+
+	for _, tt := range tests {
+		if _, err := CompileLike(tt.pattern, tt.escape, false); err == nil {
+			t.Errorf("CompileLike(%q, %q) succeeded, want an error", tt.pattern, tt.escape)
+		}
+	}
+}
@@ -1,6 +1,10 @@
 package types
 
-import "time"
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+)
 
 // FilterOp represents a comparison operator
 type FilterOp string
@@ -13,6 +17,7 @@ const (
 	OpGte       FilterOp = ">="
 	OpLte       FilterOp = "<="
 	OpLike      FilterOp = "LIKE"
+	OpILike     FilterOp = "ILIKE"
 	OpIsNull    FilterOp = "IS NULL"
 	OpIsNotNull FilterOp = "IS NOT NULL"
 	OpIn        FilterOp = "IN"
@@ -24,7 +29,16 @@ type Condition struct {
 	Column         string      `json:"column,omitempty"`
 	Value          interface{} `json:"value,omitempty"`
 	Children       []Condition `json:"children,omitempty"`
-	ResolvedTarget string      `json:"-"` // Internal use for optimization
+	Escape         string      `json:"escape,omitempty"` // LIKE escape character, DefaultLikeEscape if empty
+	ResolvedTarget string      `json:"-"`                // Internal use for optimization
+	// ResolvedTargets holds the sorted, de-duplicated values of an IN list
+	ResolvedTargets []string `json:"-"`
+	// ResolvedType is the type range operators compare as and ResolvedKey
+	// the comparison key of the target under that type
+	ResolvedType ColumnSpec `json:"-"`
+	ResolvedKey  []byte     `json:"-"`
+	// ResolvedLike is the compiled pattern of LIKE and ILIKE
+	ResolvedLike *LikePattern `json:"-"`
 }
 
 // QueryRequest represents an incoming query
@@ -49,13 +63,35 @@ type QueryConfig struct {
 	CountOnly bool
 	Limit     int
 	Offset    int
+	OrderBy   []OrderColumn
+	Select    []string              // columns whose values are returned with each row
+	Names     []string              // names the Select columns are returned under, such as SQL aliases; their own if empty
+	SortMemMB int                   // memory budget of the ORDER BY sort before it spills to disk
+	Types     map[string]ColumnSpec // declared column types, keyed by lower-cased name
 	Explain   bool
+	Analyze   bool   // run the query and report actual execution counters with the plan
+	Protocol  int    // 0 = legacy text output, otherwise the NDJSON protocol version
+	OnStale   string // stale policy for indexes that no longer match the CSV, overriding the dataset's
+}
+
+// SelectNames returns the names the selected columns are returned under.
+func (c QueryConfig) SelectNames() []string {
+	if len(c.Names) == len(c.Select) {
+		return c.Names
+	}
+	return c.Select
+}
+
+// OrderColumn is one column of an ORDER BY clause
+type OrderColumn struct {
+	Column string `json:"column"`
+	Desc   bool   `json:"desc,omitempty"`
 }
 
 // QueryResult represents the response to a query
 type QueryResult struct {
 	Status string      `json:"status"`
-	Count  int         `json:"count,omitempty"`
+	Count  int         `json:"count"`
 	Rows   []RowOffset `json:"rows,omitempty"`
 	Groups interface{} `json:"groups,omitempty"`
 	Error  string      `json:"error,omitempty"`
@@ -68,13 +104,92 @@ type RowOffset struct {
 	Line   int64 `json:"line"`
 }
 
-// QueryStats holds performance metrics for a query
+// QueryStats holds performance metrics for a query.
+// FetchingTime is the time spent emitting results to the client and
+// ExecutionTime is the remainder of TotalTime.
 type QueryStats struct {
 	ExecutionTime string `json:"execution_time"`
 	FetchingTime  string `json:"fetching_time"`
 	TotalTime     string `json:"total_time"`
 }
 
+// FrameType identifies a frame in the NDJSON result protocol
+type FrameType string
+
+const (
+	FrameHeader      FrameType = "header"
+	FrameRow         FrameType = "row"
+	FrameAggregation FrameType = "aggregation"
+	FramePlan        FrameType = "plan"
+	FrameTrailer     FrameType = "trailer"
+)
+
+// HeaderFrame opens every NDJSON response
+type HeaderFrame struct {
+	Type    FrameType `json:"type"`
+	Version int       `json:"version"`
+	Action  string    `json:"action"`
+	Columns []string  `json:"columns,omitempty"` // the select list, if any
+}
+
+// RowFrame carries one matching row
+type RowFrame struct {
+	Type FrameType `json:"type"`
+	RowOffset
+	Values *Record `json:"values,omitempty"`
+}
+
+// Record holds the selected values of a row. It encodes as a JSON object
+// whose keys keep the order of the select list.
+type Record struct {
+	Columns []string
+	Values  []interface{}
+}
+
+func (r Record) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	// The caller decides about HTML escaping when it compacts the output
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	buf.WriteByte('{')
+	for i, col := range r.Columns {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		var v interface{}
+		if i < len(r.Values) {
+			v = r.Values[i]
+		}
+		if err := enc.Encode(col); err != nil {
+			return nil, err
+		}
+		buf.WriteByte(':')
+		if err := enc.Encode(v); err != nil {
+			return nil, err
+		}
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// AggregationFrame carries the grouped results of an aggregation
+type AggregationFrame struct {
+	Type   FrameType   `json:"type"`
+	Groups interface{} `json:"groups"`
+}
+
+// PlanFrame carries the query plan of an EXPLAIN request
+type PlanFrame struct {
+	Type FrameType   `json:"type"`
+	Plan interface{} `json:"plan"`
+}
+
+// TrailerFrame closes every NDJSON response with the final status
+type TrailerFrame struct {
+	Type FrameType `json:"type"`
+	QueryResult
+}
+
 // IndexRecord represents a single entry in an index file
 type IndexRecord struct {
 	Key    [64]byte `json:"key"`
@@ -90,10 +205,53 @@ type IndexMeta struct {
 	CsvMtime   int64                 `json:"csvMtime"`
 	CsvHash    string                `json:"csvHash"`
 	Indexes    map[string]IndexStats `json:"indexes"`
+	// Separator is the field separator the CSV was indexed with, empty for
+	// metadata written before it was recorded; see CsvSeparator
+	Separator string `json:"separator,omitempty"`
+	// StalePolicy is how queries treat these indexes once they no longer
+	// match the CSV, unless a query says otherwise
+	StalePolicy string `json:"stalePolicy,omitempty"`
+}
+
+// CsvVersion identifies the contents of a CSV by their size and a
+// fingerprint of them.
+type CsvVersion struct {
+	Size int64  `json:"size"`
+	Hash string `json:"hash"`
+}
+
+// CsvSeparator returns the field separator the CSV was indexed with, a
+// comma unless another was recorded.
+func (m *IndexMeta) CsvSeparator() string {
+	if m == nil || m.Separator == "" {
+		return ","
+	}
+	return m.Separator
+}
+
+// Stale policies: what a query does when an index it would use was built
+// from a CSV that has changed since
+const (
+	StaleFail     = "fail"     // the query fails
+	StaleFallback = "fallback" // the index is ignored, as if it did not exist
+	StaleRebuild  = "rebuild"  // the stale indexes are rebuilt before planning
+)
+
+// ValidStalePolicy reports whether policy is a stale policy, or empty for
+// the default.
+func ValidStalePolicy(policy string) bool {
+	switch policy {
+	case "", StaleFail, StaleFallback, StaleRebuild:
+		return true
+	}
+	return false
 }
 
 // IndexStats provides summary statistics for a specific column index
 type IndexStats struct {
-	DistinctCount int64 `json:"distinctCount"`
-	FileSize      int64 `json:"fileSize"`
+	DistinctCount int64       `json:"distinctCount"`
+	FileSize      int64       `json:"fileSize"`
+	Type          *ColumnSpec `json:"type,omitempty"`      // key type of a typed index
+	Columns       []string    `json:"columns,omitempty"`   // columns of a composite index, in key order
+	BloomRate     float64     `json:"bloomRate,omitempty"` // false positive rate of the bloom filter, if built
 }
@@ -4,6 +4,9 @@ namespace CsvQuery;
 
 class Client
 {
+    // NDJSON result protocol version understood by decodeFrames()
+    public const PROTOCOL_VERSION = 1;
+
     private Config $config;
 
     public function __construct(Config $config)
@@ -14,6 +17,7 @@ class Client
     public function query(array $payload): array
     {
         $payload['action'] = $payload['action'] ?? 'query';
+        $payload['protocol'] = $payload['protocol'] ?? self::PROTOCOL_VERSION;
         $payload['csv'] = $this->config->getCsvPath();
         $payload['indexDir'] = $this->config->getIndexDir();
 
@@ -32,10 +36,87 @@ class Client
             'memory' => $options['memory'] ?? 512,
             'bloom_rate' => $options['bloom_rate'] ?? 0.01,
             'verbose' => $options['verbose'] ?? false,
+            'full' => $options['full'] ?? false,
+        ];
+        if (!empty($options['stale_policy'])) {
+            $payload['stalePolicy'] = $options['stale_policy'];
+        }
+        if (!empty($options['types'])) {
+            $payload['types'] = $options['types'];
+        }
+        return $this->execute($payload);
+    }
+
+    /**
+     * Sets columns of the rows matching $where; an empty $where matches all.
+     * Returns the number of rows updated.
+     */
+    public function update(array $where, array $set, array $types = []): int
+    {
+        return $this->modify(['action' => 'update', 'where' => $where, 'set' => (object) $set], $types);
+    }
+
+    /**
+     * Deletes the rows matching $where; an empty $where matches all.
+     * Returns the number of rows deleted.
+     */
+    public function delete(array $where, array $types = []): int
+    {
+        return $this->modify(['action' => 'delete', 'where' => $where], $types);
+    }
+
+    /**
+     * Appends rows, each an array of column => value, to the CSV and adds
+     * them to its indexes. Returns the number of rows inserted.
+     */
+    public function insert(array $rows): int
+    {
+        $result = $this->execute([
+            'action' => 'insert',
+            'csv' => $this->config->getCsvPath(),
+            'indexDir' => $this->config->getIndexDir(),
+            'rows' => array_map(fn(array $row) => (object) $row, array_values($rows)),
+        ]);
+        if (($result['status'] ?? '') !== 'ok') {
+            throw new \RuntimeException("Insert failed: " . ($result['error'] ?? 'unknown error'));
+        }
+        return (int) $result['affected'];
+    }
+
+    /**
+     * Rewrites the CSV with its pending updates and deletions and rebuilds
+     * its indexes. Returns the rows, updated, deleted and indexes counts.
+     */
+    public function compact(array $options = []): array
+    {
+        $payload = [
+            'action' => 'compact',
+            'csv' => $this->config->getCsvPath(),
+            'indexDir' => $this->config->getIndexDir(),
+            'workers' => $options['workers'] ?? 4,
+            'memory' => $options['memory'] ?? 512,
         ];
+        if (isset($options['bloom_rate'])) {
+            $payload['bloom_rate'] = $options['bloom_rate'];
+        }
         return $this->execute($payload);
     }
 
+    private function modify(array $payload, array $types): int
+    {
+        $payload['where'] = $payload['where'] ?: new \stdClass();
+        $payload['csv'] = $this->config->getCsvPath();
+        $payload['indexDir'] = $this->config->getIndexDir();
+        if ($types) {
+            $payload['types'] = $types;
+        }
+        $result = $this->execute($payload);
+        if (($result['status'] ?? '') !== 'ok') {
+            throw new \RuntimeException("Update failed: " . ($result['error'] ?? 'unknown error'));
+        }
+        return (int) $result['affected'];
+    }
+
     private function execute(array $payload): array
     {
         $bin = $this->config->getBinPath();
@@ -72,6 +153,17 @@ class Client
 
         $exitCode = proc_close($process);
 
+        if (!empty($payload['protocol'])) {
+            $result = $this->decodeFrames($stdout);
+            if ($result['status'] === 'error') {
+                throw new \RuntimeException("Query failed: " . ($result['error'] ?? 'unknown error'));
+            }
+            if ($exitCode !== 0) {
+                throw new \RuntimeException("Go binary failed (Exit $exitCode): $stderr");
+            }
+            return $result;
+        }
+
         if ($exitCode !== 0) {
             throw new \RuntimeException("Go binary failed (Exit $exitCode): $stderr");
         }
@@ -87,18 +179,13 @@ class Client
         
         $action = $payload['action'] ?? 'query';
         
-        if ($action === 'index') {
+        if (in_array($action, ['index', 'insert', 'update', 'delete', 'compact'], true)) {
             return json_decode($stdout, true) ?? ['error' => 'Invalid JSON output'];
         }
         
         if (!empty($payload['explain'])) {
-             // Expect JSON plan usually, roughly
-             // Executor output: "Plan: map[...]" which is NOT JSON. Use Go's JSON output for explain?
-             // Main.go handled explain via executor. 
-             // Executor writes "Plan: ..."
-             // This needs adjustment in Go if we want valid JSON.
-             // For now return raw string wrapped
-             return ['output' => $stdout]; 
+            $plan = json_decode($stdout, true);
+            return ['status' => 'ok', 'plan' => $plan ?? $stdout];
         }
 
         if ($action === 'count' || !empty($payload['countOnly'])) {
@@ -130,4 +217,50 @@ class Client
         }
         return ['status' => 'ok', 'rows' => $rows];
     }
+
+    /**
+     * Folds an NDJSON response (header, row/aggregation/plan frames, trailer)
+     * into the QueryResult shape used by Result.
+     */
+    private function decodeFrames(string $stdout): array
+    {
+        $result = ['status' => 'error', 'error' => 'Missing trailer frame', 'rows' => []];
+        foreach (explode("\n", $stdout) as $line) {
+            if (trim($line) === '') {
+                continue;
+            }
+            $frame = json_decode($line, true);
+            if (!is_array($frame)) {
+                return ['status' => 'error', 'error' => 'Invalid frame: ' . $line];
+            }
+            switch ($frame['type'] ?? '') {
+                case 'row':
+                    unset($frame['type']);
+                    $result['rows'][] = $frame;
+                    break;
+                case 'aggregation':
+                    $result['groups'] = $frame['groups'];
+                    break;
+                case 'plan':
+                    $result['plan'] = $frame['plan'];
+                    break;
+                case 'trailer':
+                    unset($frame['type']);
+                    $rows = $result['rows'];
+                    $result = array_merge($result, $frame);
+                    $result['rows'] = $rows;
+                    if ($frame['status'] !== 'error') {
+                        unset($result['error']);
+                    }
+                    break;
+                default:
+                    // An "error" object without a type comes from a request
+                    // rejected before the response could be framed.
+                    if (($frame['status'] ?? '') === 'error') {
+                        return $frame;
+                    }
+            }
+        }
+        return $result;
+    }
 }
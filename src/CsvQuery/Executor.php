@@ -21,6 +21,38 @@ class Executor
         return new Result($this->client->query($params));
     }
 
+    /**
+     * @param array $types Column types, as for QueryBuilder::types()
+     */
+    public function sql(string $sql, array $types = []): Result
+    {
+        $params = ['sql' => $sql];
+        if ($types) {
+            $params['types'] = $types;
+        }
+        return $this->execute($params);
+    }
+
+    public function insert(array $rows): int
+    {
+        return $this->client->insert($rows);
+    }
+
+    public function update(array $where, array $set, array $types = []): int
+    {
+        return $this->client->update($where, $set, $types);
+    }
+
+    public function delete(array $where, array $types = []): int
+    {
+        return $this->client->delete($where, $types);
+    }
+
+    public function compact(array $options = []): array
+    {
+        return $this->client->compact($options);
+    }
+
     public function index(array $columns, array $options = []): array
     {
         return $this->client->index($columns, $options);
@@ -12,6 +12,10 @@ class QueryBuilder
     private string $aggFunc = '';
     private int $limit = 0;
     private int $offset = 0;
+    private array $orderBy = [];
+    private array $select = [];
+    private array $types = [];
+    private string $onStale = '';
     private bool $explain = false;
 
     public function __construct(Executor $executor)
@@ -19,6 +23,32 @@ class QueryBuilder
         $this->executor = $executor;
     }
 
+    public function select(array $columns): self
+    {
+        $this->select = $columns;
+        return $this;
+    }
+
+    /**
+     * @param array $types ['PRICE' => 'decimal', 'CREATED_AT' => ['type' => 'date', 'format' => '02/01/2006']]
+     */
+    public function types(array $types): self
+    {
+        $this->types = $types;
+        return $this;
+    }
+
+    /**
+     * What to do with indexes built before the CSV changed: 'fail',
+     * 'fallback' (ignore them) or 'rebuild'. Defaults to the dataset's
+     * policy, set when indexing.
+     */
+    public function onStale(string $policy): self
+    {
+        $this->onStale = $policy;
+        return $this;
+    }
+
     public function where(string $column, string $operator, $value = null): self
     {
         if ($value === null) {
@@ -69,6 +99,21 @@ class QueryBuilder
         return $this;
     }
     
+    /**
+     * @param array $columns ['CREATED_AT' => SORT_DESC, 'ID'] (SORT_ASC when no direction is given)
+     */
+    public function orderBy(array $columns): self
+    {
+        foreach ($columns as $column => $direction) {
+            if (is_int($column)) {
+                $column = $direction;
+                $direction = SORT_ASC;
+            }
+            $this->orderBy[] = ['column' => $column, 'desc' => $direction === SORT_DESC];
+        }
+        return $this;
+    }
+
     public function explain(): self
     {
         $this->explain = true;
@@ -84,15 +129,39 @@ class QueryBuilder
             'aggFunc' => $this->aggFunc,
             'limit' => $this->limit,
             'offset' => $this->offset,
+            'orderBy' => $this->orderBy,
+            'select' => $this->select,
+            'types' => (object) $this->types,
             'explain' => $this->explain,
+            'onStale' => $this->onStale,
         ]);
     }
 
+    /**
+     * Sets columns of every row matching the where conditions and returns
+     * the number of rows updated.
+     */
+    public function update(array $set): int
+    {
+        return $this->executor->update($this->where, $set, $this->types);
+    }
+
+    /**
+     * Deletes every row matching the where conditions and returns the
+     * number of rows deleted.
+     */
+    public function delete(): int
+    {
+        return $this->executor->delete($this->where, $this->types);
+    }
+
     public function count(): int
     {
         $res = $this->executor->execute([
             'where' => $this->where,
             'groupBy' => $this->groupBy,
+            'types' => (object) $this->types,
+            'onStale' => $this->onStale,
             'action' => 'count'
         ]);
         return $res->getCount();